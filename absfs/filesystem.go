@@ -2,6 +2,7 @@ package absfs
 
 import (
 	"io/fs"
+	"time"
 )
 
 type FileSystem interface {
@@ -82,6 +83,23 @@ type FileSystem interface {
 	// of type *fs.PathError.
 	Truncate(name string, size int64) error
 
+	// Chmod changes the mode of the named file to mode. If the file is a symbolic
+	// link, it changes the mode of the link's target. If there is an error, it will
+	// be of type *fs.PathError.
+	Chmod(name string, mode fs.FileMode) error
+
+	// Chtimes changes the access and modification times of the named file, similar
+	// to the Unix utime() or utimes() functions. A zero time.Time value will leave
+	// the corresponding file time unchanged. If there is an error, it will be of
+	// type *fs.PathError.
+	Chtimes(name string, atime, mtime time.Time) error
+
+	// Chown changes the numeric uid and gid of the named file. If the file is a
+	// symbolic link, it changes the uid and gid of the link's target. A uid or gid
+	// of -1 means to not change that value. If there is an error, it will be of
+	// type *fs.PathError.
+	Chown(name string, uid, gid int) error
+
 	// WalkDir walks the file tree rooted at root, calling fn for each file or directory
 	// in the tree, including root. All errors that arise visiting files and directories
 	// are filtered by fn: see the fs.WalkDirFunc documentation for details. The files may
@@ -2,27 +2,106 @@ package pandorasbox
 
 import (
 	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/awnumar/memguard"
 	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/inode"
 	"github.com/capnspacehook/pandorasbox/ioutil"
 	"github.com/capnspacehook/pandorasbox/osfs"
 	"github.com/capnspacehook/pandorasbox/vfs"
 )
 
 type Box struct {
-	osfs absfs.FileSystem
-	vfs  absfs.FileSystem
+	osfs   absfs.FileSystem
+	vfs    absfs.FileSystem
+	prefix string
 }
 
-func NewBox() *Box {
+// BoxOptions configures a Box created by NewBoxWithOptions. The zero
+// value is the configuration used by NewBox.
+type BoxOptions struct {
+	// Prefix is the prefix of paths that refer to files in the VFS,
+	// used in place of VFSPrefix. Changing it avoids clashes with data
+	// that contains real "vfs://" URLs.
+	Prefix string
+
+	// VFS configures the Box's VFS.
+	VFS vfs.Options
+}
+
+// BoxError records an error from one of the filesystems of a Box, along
+// with which one it came from. Err is the error returned by the
+// filesystem, so errors.Is and errors.As can be used to inspect it.
+type BoxError struct {
+	Backend string // "vfs" or "os"
+	Op      string
+	Path    string
+	Err     error
+}
+
+func (e *BoxError) Error() string {
+	return e.Backend + ": " + e.Err.Error()
+}
+
+func (e *BoxError) Unwrap() error {
+	return e.Err
+}
+
+// wrapErr returns err wrapped in a *BoxError, or nil if err is nil.
+func wrapErr(backend, op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &BoxError{Backend: backend, Op: op, Path: path, Err: err}
+}
+
+// NewBox returns a new Box, with a new VFS alongside the host's
+// filesystem.
+func NewBox() (*Box, error) {
+	return NewBoxWithOptions(BoxOptions{})
+}
+
+// NewBoxWithOptions returns a new Box configured by opts.
+func NewBoxWithOptions(opts BoxOptions) (*Box, error) {
+	v, err := vfs.NewFSWithOptions(opts.VFS)
+	if err != nil {
+		return nil, err
+	}
+
 	box := new(Box)
 	box.osfs = osfs.NewFS()
-	box.vfs = vfs.NewFS()
+	box.vfs = v
+	box.prefix = opts.Prefix
+	if box.prefix == "" {
+		box.prefix = VFSPrefix
+	}
 
-	return box
+	return box, nil
+}
+
+// ConvertVFSPath reports whether path refers to a file in the VFS, and
+// if so returns the path in the VFS it refers to.
+func (b *Box) ConvertVFSPath(path string) (string, bool) {
+	return convertVFSPath(b.prefix, path)
+}
+
+// IsVFSPath reports whether path refers to a file in the VFS.
+func (b *Box) IsVFSPath(path string) bool {
+	return strings.HasPrefix(path, b.prefix)
+}
+
+// MakeVFSPath returns the path that refers to the file path in the VFS.
+func (b *Box) MakeVFSPath(path string) string {
+	return makeVFSPath(b.prefix, path)
 }
 
 func (b *Box) OSFS() absfs.FileSystem {
@@ -33,141 +112,398 @@ func (b *Box) VFS() absfs.FileSystem {
 	return b.vfs
 }
 
+// vfsTree is implemented by the VFS to expose its inode tree.
+type vfsTree interface {
+	Root() *inode.Inode
+	TreeLock() *sync.RWMutex
+}
+
+// VFSRoot returns the root of the VFS's inode tree, for tooling that needs
+// to traverse the tree directly. The tree must only be accessed while
+// holding the lock returned by VFSLock.
+func (b *Box) VFSRoot() *inode.Inode {
+	return b.vfs.(vfsTree).Root()
+}
+
+// VFSLock returns the lock guarding the structure of the VFS's inode
+// tree. Hold it for reading while traversing the tree returned by VFSRoot.
+func (b *Box) VFSLock() *sync.RWMutex {
+	return b.vfs.(vfsTree).TreeLock()
+}
+
+// vfsSub is implemented by VFSs that can be scoped to a subdirectory.
+type vfsSub interface {
+	Sub(dir string) (absfs.FileSystem, error)
+}
+
+// Sub returns a new Box whose VFS is rooted at the VFS directory
+// vfsPrefix, which may be given with or without the Box's VFS prefix. The
+// files of the new Box's VFS are shared with b, and it uses the same
+// host filesystem.
+func (b *Box) Sub(vfsPrefix string) (*Box, error) {
+	dir, _ := b.ConvertVFSPath(vfsPrefix)
+	v, err := b.vfs.(vfsSub).Sub(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{osfs: b.osfs, vfs: v, prefix: b.prefix}, nil
+}
+
 func (b *Box) Open(name string) (absfs.File, error) {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Open(vfsName)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		f, err := b.vfs.Open(vfsName)
+		return f, wrapErr("vfs", "open", name, err)
 	}
 
-	return b.osfs.Open(name)
+	f, err := b.osfs.Open(name)
+	return f, wrapErr("os", "open", name, err)
 }
 
 func (b *Box) OpenFile(name string, flag int, perm fs.FileMode) (absfs.File, error) {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.OpenFile(vfsName, flag, perm)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		f, err := b.vfs.OpenFile(vfsName, flag, perm)
+		return f, wrapErr("vfs", "openfile", name, err)
 	}
 
-	return b.osfs.OpenFile(name, flag, perm)
+	f, err := b.osfs.OpenFile(name, flag, perm)
+	return f, wrapErr("os", "openfile", name, err)
 }
 
 func (b *Box) Create(name string) (absfs.File, error) {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Create(vfsName)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		f, err := b.vfs.Create(vfsName)
+		return f, wrapErr("vfs", "create", name, err)
 	}
 
-	return b.osfs.Create(name)
+	f, err := b.osfs.Create(name)
+	return f, wrapErr("os", "create", name, err)
 }
 
 func (b *Box) ReadFile(filename string) ([]byte, error) {
-	if vfsFilename, ok := ConvertVFSPath(filename); ok {
-		return b.vfs.ReadFile(vfsFilename)
+	if vfsFilename, ok := b.ConvertVFSPath(filename); ok {
+		data, err := b.vfs.ReadFile(vfsFilename)
+		return data, wrapErr("vfs", "readfile", filename, err)
 	}
 
-	return b.osfs.ReadFile(filename)
+	data, err := b.osfs.ReadFile(filename)
+	return data, wrapErr("os", "readfile", filename, err)
 }
 
 func (b *Box) ReadDir(dirname string) ([]fs.DirEntry, error) {
-	if vfsDirname, ok := ConvertVFSPath(dirname); ok {
-		return b.vfs.ReadDir(vfsDirname)
+	if vfsDirname, ok := b.ConvertVFSPath(dirname); ok {
+		entries, err := b.vfs.ReadDir(vfsDirname)
+		return entries, wrapErr("vfs", "readdir", dirname, err)
 	}
 
-	return b.osfs.ReadDir(dirname)
+	entries, err := b.osfs.ReadDir(dirname)
+	return entries, wrapErr("os", "readdir", dirname, err)
 }
 
 func (b *Box) WriteFile(filename string, data []byte, perm fs.FileMode) error {
-	if vfsFilename, ok := ConvertVFSPath(filename); ok {
-		return ioutil.WriteFile(b.vfs, vfsFilename, data, perm)
+	if vfsFilename, ok := b.ConvertVFSPath(filename); ok {
+		return wrapErr("vfs", "writefile", filename, ioutil.WriteFile(b.vfs, vfsFilename, data, perm))
 	}
 
-	return ioutil.WriteFile(b.osfs, filename, data, perm)
+	return wrapErr("os", "writefile", filename, ioutil.WriteFile(b.osfs, filename, data, perm))
 }
 
 func (b *Box) Mkdir(name string, perm fs.FileMode) error {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Mkdir(vfsName, perm)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "mkdir", name, b.vfs.Mkdir(vfsName, perm))
 	}
 
-	return b.osfs.Mkdir(name, perm)
+	return wrapErr("os", "mkdir", name, b.osfs.Mkdir(name, perm))
 }
 
 func (b *Box) MkdirAll(name string, perm fs.FileMode) error {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.MkdirAll(vfsName, perm)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "mkdirall", name, b.vfs.MkdirAll(vfsName, perm))
 	}
 
-	return b.osfs.MkdirAll(name, perm)
+	return wrapErr("os", "mkdirall", name, b.osfs.MkdirAll(name, perm))
 }
 
 func (b *Box) Stat(name string) (fs.FileInfo, error) {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Stat(vfsName)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		fi, err := b.vfs.Stat(vfsName)
+		return fi, wrapErr("vfs", "stat", name, err)
 	}
 
-	return b.osfs.Stat(name)
+	fi, err := b.osfs.Stat(name)
+	return fi, wrapErr("os", "stat", name, err)
 }
 
 func (b *Box) Lstat(name string) (fs.FileInfo, error) {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Lstat(vfsName)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		fi, err := b.vfs.Lstat(vfsName)
+		return fi, wrapErr("vfs", "lstat", name, err)
 	}
 
-	return b.osfs.Lstat(name)
+	fi, err := b.osfs.Lstat(name)
+	return fi, wrapErr("os", "lstat", name, err)
 }
 
 func (b *Box) Rename(oldpath, newpath string) error {
-	vfsOldPath, oldPathVFS := ConvertVFSPath(oldpath)
-	vfsNewPath, newPathVFS := ConvertVFSPath(newpath)
+	vfsOldPath, oldPathVFS := b.ConvertVFSPath(oldpath)
+	vfsNewPath, newPathVFS := b.ConvertVFSPath(newpath)
 	if oldPathVFS && newPathVFS {
-		return b.vfs.Rename(vfsOldPath, vfsNewPath)
+		return wrapErr("vfs", "rename", oldpath, b.vfs.Rename(vfsOldPath, vfsNewPath))
 	} else if (oldPathVFS && !newPathVFS) || (!oldPathVFS && newPathVFS) {
 		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("oldpath and newpath must both either be a VFS path, or normal path")}
 	}
 
-	return b.osfs.Rename(oldpath, newpath)
+	return wrapErr("os", "rename", oldpath, b.osfs.Rename(oldpath, newpath))
+}
+
+// Copy copies the contents of the file src to the file dst, either of
+// which may be in the VFS or on the host's filesystem, and returns the
+// number of bytes copied. If dst doesn't exist it is created with the
+// permissions of src, along with any missing parent directories. Copying
+// a file to itself, including through a link, is an error.
+func (b *Box) Copy(dst, src string) (int64, error) {
+	in, err := b.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, &fs.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	// dst is truncated before src is read, which would empty src
+	if dfi, err := b.Stat(dst); err == nil && sameFile(fi, dfi) {
+		return 0, &os.LinkError{Op: "copy", Old: src, New: dst, Err: errors.New("src and dst are the same file")}
+	}
+
+	dir := filepath.Dir(dst)
+	if vfsDst, ok := b.ConvertVFSPath(dst); ok {
+		dir = b.MakeVFSPath(path.Dir(vfsDst))
+	}
+	if err := b.MkdirAll(dir, 0777); err != nil {
+		return 0, err
+	}
+
+	out, err := b.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return n, err
+}
+
+// sameFile reports whether fi1 and fi2 describe the same file, which may
+// be in the VFS or on the host's filesystem.
+func sameFile(fi1, fi2 fs.FileInfo) bool {
+	if n1, ok := fi1.Sys().(*inode.Inode); ok {
+		n2, ok := fi2.Sys().(*inode.Inode)
+		return ok && n1 == n2
+	}
+
+	return os.SameFile(fi1, fi2)
+}
+
+// symlinkFS is implemented by filesystems that support symbolic links.
+type symlinkFS interface {
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+}
+
+// Symlink creates newname as a symbolic link to oldname. Both must be
+// paths in the VFS, or both paths on the host's filesystem.
+func (b *Box) Symlink(oldname, newname string) error {
+	vfsOldName, oldNameVFS := b.ConvertVFSPath(oldname)
+	vfsNewName, newNameVFS := b.ConvertVFSPath(newname)
+	if oldNameVFS && newNameVFS {
+		return wrapErr("vfs", "symlink", newname, b.vfs.(symlinkFS).Symlink(vfsOldName, vfsNewName))
+	} else if oldNameVFS || newNameVFS {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.New("oldname and newname must both either be a VFS path, or normal path")}
+	}
+
+	return wrapErr("os", "symlink", newname, b.osfs.(symlinkFS).Symlink(oldname, newname))
+}
+
+// Readlink returns the destination of the named symbolic link. Absolute
+// destinations of links in the VFS are returned as VFS paths.
+func (b *Box) Readlink(name string) (string, error) {
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		target, err := b.vfs.(symlinkFS).Readlink(vfsName)
+		if err != nil {
+			return "", wrapErr("vfs", "readlink", name, err)
+		}
+		if path.IsAbs(target) {
+			target = b.MakeVFSPath(target)
+		}
+
+		return target, nil
+	}
+
+	target, err := b.osfs.(symlinkFS).Readlink(name)
+	return target, wrapErr("os", "readlink", name, err)
 }
 
 func (b *Box) Remove(name string) error {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Remove(vfsName)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "remove", name, b.vfs.Remove(vfsName))
 	}
 
-	return b.osfs.Remove(name)
+	return wrapErr("os", "remove", name, b.osfs.Remove(name))
 }
 
 func (b *Box) RemoveAll(path string) error {
-	if vfsPath, ok := ConvertVFSPath(path); ok {
-		return b.vfs.RemoveAll(vfsPath)
+	if vfsPath, ok := b.ConvertVFSPath(path); ok {
+		return wrapErr("vfs", "removeall", path, b.vfs.RemoveAll(vfsPath))
 	}
 
-	return b.osfs.RemoveAll(path)
+	return wrapErr("os", "removeall", path, b.osfs.RemoveAll(path))
 }
 
 func (b *Box) Truncate(name string, size int64) error {
-	if vfsName, ok := ConvertVFSPath(name); ok {
-		return b.vfs.Truncate(vfsName, size)
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "truncate", name, b.vfs.Truncate(vfsName, size))
 	}
 
-	return b.osfs.Truncate(name, size)
+	return wrapErr("os", "truncate", name, b.osfs.Truncate(name, size))
 }
 
+func (b *Box) Chmod(name string, mode fs.FileMode) error {
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "chmod", name, b.vfs.Chmod(vfsName, mode))
+	}
+
+	return wrapErr("os", "chmod", name, b.osfs.Chmod(name, mode))
+}
+
+func (b *Box) Chtimes(name string, atime, mtime time.Time) error {
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "chtimes", name, b.vfs.Chtimes(vfsName, atime, mtime))
+	}
+
+	return wrapErr("os", "chtimes", name, b.osfs.Chtimes(name, atime, mtime))
+}
+
+func (b *Box) Chown(name string, uid, gid int) error {
+	if vfsName, ok := b.ConvertVFSPath(name); ok {
+		return wrapErr("vfs", "chown", name, b.vfs.Chown(vfsName, uid, gid))
+	}
+
+	return wrapErr("os", "chown", name, b.osfs.Chown(name, uid, gid))
+}
+
+// vfsStatFS is implemented by VFSs that report the space available to
+// file contents, and hostStatFS by host filesystems that report the size
+// of the filesystem holding a file.
+type (
+	vfsStatFS interface {
+		StatFS() (total, used, free int64)
+	}
+	hostStatFS interface {
+		StatFS(name string) (total, used, free int64, err error)
+	}
+)
+
+// StatFS reports the total size of the filesystem name is on, and how
+// many bytes of it are used and free. For VFS paths these describe the
+// VFS's MaxBytes limit, and total and free are zero if it has none.
+func (b *Box) StatFS(name string) (total, used, free int64, err error) {
+	if _, ok := b.ConvertVFSPath(name); ok {
+		total, used, free = b.vfs.(vfsStatFS).StatFS()
+		return total, used, free, nil
+	}
+
+	total, used, free, err = b.osfs.(hostStatFS).StatFS(name)
+	return total, used, free, wrapErr("os", "statfs", name, err)
+}
+
+// globFS is implemented by filesystems that can match file names
+// against shell patterns.
+type globFS interface {
+	Glob(pattern string) ([]string, error)
+}
+
+// Glob returns the names of all files matching pattern, as filepath.Glob
+// does. Patterns that are VFS paths are matched in the VFS, and return
+// VFS paths.
+func (b *Box) Glob(pattern string) ([]string, error) {
+	if vfsPattern, ok := b.ConvertVFSPath(pattern); ok {
+		matches, err := b.vfs.(globFS).Glob(vfsPattern)
+		if err != nil {
+			return nil, wrapErr("vfs", "glob", pattern, err)
+		}
+		for i, m := range matches {
+			matches[i] = b.MakeVFSPath(m)
+		}
+
+		return matches, nil
+	}
+
+	matches, err := b.osfs.(globFS).Glob(pattern)
+	return matches, wrapErr("os", "glob", pattern, err)
+}
+
+// WalkDir walks the file tree rooted at root, in the VFS or on the host's
+// filesystem, calling fn for each file or directory in the tree as
+// fs.WalkDir does. The paths passed to fn for files in the VFS are VFS
+// paths, so they can be passed to the other methods of b.
 func (b *Box) WalkDir(root string, fn fs.WalkDirFunc) error {
-	if vfsName, ok := ConvertVFSPath(root); ok {
-		return b.vfs.WalkDir(vfsName, fn)
+	if vfsName, ok := b.ConvertVFSPath(root); ok {
+		return wrapErr("vfs", "walkdir", root, b.walkVFS(vfsName, fn))
 	}
 
-	return b.osfs.WalkDir(root, fn)
+	return wrapErr("os", "walkdir", root, b.osfs.WalkDir(root, fn))
+}
+
+// Walk walks the file tree rooted at root, in the VFS or on the host's
+// filesystem, calling fn for each file or directory in the tree as
+// filepath.Walk does. The paths passed to fn for files in the VFS are
+// VFS paths, so they can be passed to the other methods of b.
+func (b *Box) Walk(root string, fn filepath.WalkFunc) error {
+	vfsName, ok := b.ConvertVFSPath(root)
+	if !ok {
+		return wrapErr("os", "walk", root, filepath.Walk(root, fn))
+	}
+
+	err := b.walkVFS(vfsName, func(name string, d fs.DirEntry, err error) error {
+		var info fs.FileInfo
+		if d != nil {
+			var infoErr error
+			if info, infoErr = d.Info(); err == nil {
+				err = infoErr
+			}
+		}
+		return fn(name, info, err)
+	})
+
+	return wrapErr("vfs", "walk", root, err)
+}
+
+// walkVFS walks the VFS tree rooted at root, calling fn with VFS paths.
+func (b *Box) walkVFS(root string, fn fs.WalkDirFunc) error {
+	return b.vfs.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		return fn(b.MakeVFSPath(path.Join("/", name)), d, err)
+	})
 }
 
 func (b *Box) Abs(path string) (string, error) {
-	if vfsPath, ok := ConvertVFSPath(path); ok {
+	if vfsPath, ok := b.ConvertVFSPath(path); ok {
 		absPath, err := b.vfs.Abs(vfsPath)
 		if err != nil {
-			return "", err
+			return "", wrapErr("vfs", "abs", path, err)
 		}
 
-		return MakeVFSPath(absPath), nil
+		return b.MakeVFSPath(absPath), nil
 	}
 
-	return b.osfs.Abs(path)
+	absPath, err := b.osfs.Abs(path)
+	return absPath, wrapErr("os", "abs", path, err)
 }
 
 func (b *Box) Separator(vfsMode bool) uint8 {
@@ -196,18 +532,20 @@ func (b *Box) IsPathSeparator(c uint8, vfsMode bool) bool {
 
 func (b *Box) Chdir(dir string, vfsMode bool) error {
 	if vfsMode {
-		return b.vfs.Chdir(dir)
+		return wrapErr("vfs", "chdir", dir, b.vfs.Chdir(dir))
 	}
 
-	return b.osfs.Chdir(dir)
+	return wrapErr("os", "chdir", dir, b.osfs.Chdir(dir))
 }
 
 func (b *Box) Getwd(vfsMode bool) (string, error) {
 	if vfsMode {
-		return b.vfs.Getwd()
+		dir, err := b.vfs.Getwd()
+		return dir, wrapErr("vfs", "getwd", "", err)
 	}
 
-	return b.osfs.Getwd()
+	dir, err := b.osfs.Getwd()
+	return dir, wrapErr("os", "getwd", "", err)
 }
 
 func (b *Box) GetTempDir(vfsMode bool) string {
@@ -218,6 +556,11 @@ func (b *Box) GetTempDir(vfsMode bool) string {
 	return b.osfs.TempDir()
 }
 
+// Close wipes the contents of every file in the Box's VFS, leaving it
+// empty. Other Boxes are unaffected. Closing a Box returned by Sub does
+// nothing, as its files belong to the VFS of the Box it came from.
 func (b *Box) Close() {
-	memguard.Purge()
+	if c, ok := b.vfs.(io.Closer); ok {
+		c.Close()
+	}
 }
@@ -0,0 +1,547 @@
+package pandorasbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/inode"
+	"github.com/capnspacehook/pandorasbox/vfs"
+)
+
+func TestVFSRoot(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	if err := box.MkdirAll("vfs://a/b/c", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	for _, name := range []string{"vfs://file", "vfs://a/file", "vfs://a/b/c/file"} {
+		if err := box.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	var walked int
+	err = box.WalkDir("vfs://", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %s", err)
+	}
+
+	var count func(n *inode.Inode) int
+	count = func(n *inode.Inode) int {
+		c := 1
+		for _, e := range n.Dir.Entries() {
+			if e.Name != "." && e.Name != ".." {
+				c += count(e.Inode)
+			}
+		}
+		return c
+	}
+
+	lock := box.VFSLock()
+	lock.RLock()
+	nodes := count(box.VFSRoot())
+	lock.RUnlock()
+
+	if nodes != walked {
+		t.Errorf("counted %d nodes, WalkDir visited %d", nodes, walked)
+	}
+}
+
+func TestGlobalBox(t *testing.T) {
+	// the global Box is created on first use, even by concurrent callers
+	var wg sync.WaitGroup
+	boxes := make([]*Box, 10)
+	for i := range boxes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			boxes[i] = GlobalBox()
+		}()
+	}
+	wg.Wait()
+	for _, b := range boxes {
+		if b == nil || b != boxes[0] {
+			t.Fatalf("GlobalBox returned different boxes: %p and %p", b, boxes[0])
+		}
+	}
+
+	if err := WriteFile("vfs://global", []byte("global"), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	InitGlobalBox()
+	if data, err := GlobalBox().ReadFile("vfs://global"); err != nil || string(data) != "global" {
+		t.Errorf("ReadFile = %q, %v; want %q", data, err, "global")
+	}
+}
+
+func TestBoxSub(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	if err := box.MkdirAll("vfs://requests/1", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := box.WriteFile("vfs://secret", []byte("secret"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	sub, err := box.Sub("vfs://requests/1")
+	if err != nil {
+		t.Fatalf("Sub error: %s", err)
+	}
+	if err := sub.MkdirAll("vfs://out", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := sub.WriteFile("vfs://out/data", []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if data, err := box.ReadFile("vfs://requests/1/out/data"); err != nil || string(data) != "data" {
+		t.Errorf("ReadFile of file written by sub box = %q, %v; want %q", data, err, "data")
+	}
+
+	// files outside of the prefix can't be reached
+	if _, err := sub.ReadFile("vfs://../../secret"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile outside of prefix: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := sub.RemoveAll("vfs://"); err == nil {
+		t.Error("RemoveAll of sub box root succeeded")
+	}
+
+	if _, err := box.Sub("vfs://secret"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Sub of a file: got %v, want %v", err, syscall.ENOTDIR)
+	}
+}
+
+func TestBoxError(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+
+	_, err = box.Open("vfs://nonexistent")
+	var boxErr *BoxError
+	if !errors.As(err, &boxErr) {
+		t.Fatalf("Open error %v (%T) is not a *BoxError", err, err)
+	}
+	if boxErr.Backend != "vfs" || boxErr.Op != "open" || boxErr.Path != "vfs://nonexistent" {
+		t.Errorf("got BoxError{%q, %q, %q}, want {%q, %q, %q}",
+			boxErr.Backend, boxErr.Op, boxErr.Path, "vfs", "open", "vfs://nonexistent")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors.Is(%v, fs.ErrNotExist) = false", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("error %v does not wrap a *fs.PathError", err)
+	}
+
+	_, err = box.Stat(t.TempDir() + "/nonexistent")
+	if !errors.As(err, &boxErr) || boxErr.Backend != "os" {
+		t.Errorf("Stat of host file: got %v, want a *BoxError from the os backend", err)
+	}
+}
+
+func TestBoxPrefix(t *testing.T) {
+	box, err := NewBoxWithOptions(BoxOptions{Prefix: "mem://"})
+	if err != nil {
+		t.Fatalf("NewBoxWithOptions error: %s", err)
+	}
+	if err := box.WriteFile("mem://file", []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if data, err := box.VFS().ReadFile("/file"); err != nil || string(data) != "data" {
+		t.Errorf("ReadFile from VFS = %q, %v; want %q", data, err, "data")
+	}
+
+	if box.IsVFSPath("vfs://file") {
+		t.Errorf("IsVFSPath(%q) = true with prefix %q", "vfs://file", "mem://")
+	}
+	if _, err := box.Stat("vfs://file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of default-prefixed path: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if abs, err := box.Abs("mem://dir/../file"); err != nil || abs != "mem://file" {
+		t.Errorf("Abs = %q, %v; want %q", abs, err, "mem://file")
+	}
+
+	// the package-level helpers use the default prefix
+	if p, ok := ConvertVFSPath("vfs://file"); !ok || p != "/file" {
+		t.Errorf("ConvertVFSPath = %q, %t; want %q, true", p, ok, "/file")
+	}
+}
+
+func TestBoxCopy(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	dir := t.TempDir()
+	data := []byte("copied between filesystems")
+	if err := os.WriteFile(filepath.Join(dir, "src"), data, 0640); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	n, err := box.Copy("vfs://a/b/file", filepath.Join(dir, "src"))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy to VFS = %d, %v; want %d", n, err, len(data))
+	}
+	if got, err := box.ReadFile("vfs://a/b/file"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFile of copy in VFS = %q, %v; want %q", got, err, data)
+	}
+	if fi, err := box.Stat("vfs://a/b/file"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Stat of copy in VFS: %v, %v; want mode %v", fi.Mode(), err, fs.FileMode(0640))
+	}
+
+	dst := filepath.Join(dir, "new", "dst")
+	if n, err := box.Copy(dst, "vfs://a/b/file"); err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy to host = %d, %v; want %d", n, err, len(data))
+	}
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFile of copy on host = %q, %v; want %q", got, err, data)
+	}
+
+	if _, err := box.Copy("vfs://dir", "vfs://a"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("Copy of a directory: got %v, want %v", err, syscall.EISDIR)
+	}
+	if _, err := box.Copy("vfs://file", filepath.Join(dir, "nonexistent")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Copy of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	// copying a file to itself must leave it intact
+	if err := box.Symlink("vfs://a/b/file", "vfs://link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := os.Symlink(dst, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	for _, same := range [][2]string{
+		{"vfs://a/b/file", "vfs://a/b/file"},
+		{"vfs://link", "vfs://a/b/file"},
+		{dst, dst},
+		{filepath.Join(dir, "link"), dst},
+	} {
+		var linkErr *os.LinkError
+		if _, err := box.Copy(same[0], same[1]); !errors.As(err, &linkErr) {
+			t.Errorf("Copy(%q, %q): got %v, want *os.LinkError", same[0], same[1], err)
+		}
+		if got, err := box.ReadFile(same[1]); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("ReadFile of %q after copying it to itself = %q, %v; want %q", same[1], got, err, data)
+		}
+	}
+}
+
+func TestBoxChmod(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, name := range []string{"vfs://file", filepath.Join(t.TempDir(), "file")} {
+		if err := box.WriteFile(name, nil, 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+
+		if err := box.Chmod(name, 0600); err != nil {
+			t.Errorf("Chmod(%q) error: %s", name, err)
+		}
+		if err := box.Chtimes(name, time.Time{}, mtime); err != nil {
+			t.Errorf("Chtimes(%q) error: %s", name, err)
+		}
+		fi, err := box.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat error: %s", err)
+		}
+		if fi.Mode() != 0600 {
+			t.Errorf("mode of %q = %v, want %v", name, fi.Mode(), fs.FileMode(0600))
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("ModTime of %q = %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+
+	// files on the host can have their owner changed, files in the VFS
+	// have no owners
+	hostFile := filepath.Join(t.TempDir(), "file")
+	if err := box.WriteFile(hostFile, nil, 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := box.Chown(hostFile, -1, -1); err != nil {
+		t.Errorf("Chown of host file error: %s", err)
+	}
+	if err := box.Chown("vfs://file", -1, -1); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Chown of VFS file: got %v, want %v", err, errors.ErrUnsupported)
+	}
+	if err := box.Chmod("vfs://nonexistent", 0600); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chmod of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestBoxGlob(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	hostDir := t.TempDir()
+
+	names := []string{"a.txt", "b.txt", "c.md", "dir/d.txt"}
+	for _, dir := range []string{"vfs://", hostDir + "/"} {
+		if err := box.MkdirAll(dir+"dir", 0755); err != nil {
+			t.Fatalf("MkdirAll error: %s", err)
+		}
+		for _, name := range names {
+			if err := box.WriteFile(dir+name, nil, 0644); err != nil {
+				t.Fatalf("WriteFile error: %s", err)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.txt", []string{"a.txt", "b.txt"}},
+		{"*/*.txt", []string{"dir/d.txt"}},
+		{"[bc].*", []string{"b.txt", "c.md"}},
+		{"*.go", nil},
+	} {
+		vfsMatches, err := box.Glob("vfs://" + tt.pattern)
+		if err != nil {
+			t.Fatalf("Glob error: %s", err)
+		}
+		hostMatches, err := box.Glob(filepath.Join(hostDir, tt.pattern))
+		if err != nil {
+			t.Fatalf("Glob error: %s", err)
+		}
+
+		var wantVFS, wantHost []string
+		for _, name := range tt.want {
+			wantVFS = append(wantVFS, "vfs://"+name)
+			wantHost = append(wantHost, filepath.Join(hostDir, name))
+		}
+		if fmt.Sprint(vfsMatches) != fmt.Sprint(wantVFS) {
+			t.Errorf("Glob(%q) in VFS = %q, want %q", tt.pattern, vfsMatches, wantVFS)
+		}
+		if fmt.Sprint(hostMatches) != fmt.Sprint(wantHost) {
+			t.Errorf("Glob(%q) on host = %q, want %q", tt.pattern, hostMatches, wantHost)
+		}
+	}
+
+	if _, err := box.Glob("vfs://["); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("Glob of malformed VFS pattern: got %v, want %v", err, path.ErrBadPattern)
+	}
+}
+
+func TestBoxStatFS(t *testing.T) {
+	box, err := NewBoxWithOptions(BoxOptions{VFS: vfs.Options{MaxBytes: 1000}})
+	if err != nil {
+		t.Fatalf("NewBoxWithOptions error: %s", err)
+	}
+
+	if err := box.WriteFile("vfs://file", make([]byte, 100), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if total, used, free, err := box.StatFS("vfs://"); err != nil || total != 1000 || used != 100 || free != 900 {
+		t.Errorf("StatFS of VFS = %d, %d, %d, %v; want 1000, 100, 900", total, used, free, err)
+	}
+
+	total, used, free, err := box.StatFS(t.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("StatFS of host error: %s", err)
+	}
+	if total <= 0 || used < 0 || free < 0 || used > total || free > total {
+		t.Errorf("StatFS of host = %d, %d, %d", total, used, free)
+	}
+}
+
+func TestBoxSymlink(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	if err := box.WriteFile("vfs://target", []byte("vfs"), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	dir := t.TempDir()
+	hostTarget := filepath.Join(dir, "target")
+	if err := box.WriteFile(hostTarget, []byte("host"), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	links := []struct {
+		target, link, data string
+	}{
+		{"vfs://target", "vfs://link", "vfs"},
+		{hostTarget, filepath.Join(dir, "link"), "host"},
+	}
+	for _, l := range links {
+		if err := box.Symlink(l.target, l.link); err != nil {
+			t.Fatalf("Symlink(%q, %q) error: %s", l.target, l.link, err)
+		}
+		if target, err := box.Readlink(l.link); err != nil || target != l.target {
+			t.Errorf("Readlink(%q) = %q, %v; want %q", l.link, target, err, l.target)
+		}
+		if data, err := box.ReadFile(l.link); err != nil || string(data) != l.data {
+			t.Errorf("ReadFile(%q) = %q, %v; want %q", l.link, data, err, l.data)
+		}
+	}
+
+	if err := box.Symlink(hostTarget, "vfs://cross"); err == nil {
+		t.Error("Symlink from the VFS to the host succeeded")
+	}
+	if err := box.Symlink("vfs://target", filepath.Join(dir, "cross")); err == nil {
+		t.Error("Symlink from the host to the VFS succeeded")
+	}
+	if _, err := box.Lstat("vfs://cross"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lstat of rejected link: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestBoxSubSymlink(t *testing.T) {
+	box, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	if err := box.MkdirAll("vfs://requests/1", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := box.WriteFile("vfs://secret", []byte("secret"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := box.WriteFile("vfs://requests/1/secret", []byte("inner"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	sub, err := box.Sub("vfs://requests/1")
+	if err != nil {
+		t.Fatalf("Sub error: %s", err)
+	}
+
+	// link targets are resolved within the sub box, so they can't
+	// refer to files outside of it
+	for _, target := range []string{"vfs:///secret", "vfs://../../secret"} {
+		if err := sub.Symlink(target, "vfs://link"); err != nil {
+			t.Fatalf("Symlink(%q) error: %s", target, err)
+		}
+		if data, err := sub.ReadFile("vfs://link"); err != nil || string(data) != "inner" {
+			t.Errorf("ReadFile of link to %q = %q, %v; want %q", target, data, err, "inner")
+		}
+		if target, err := sub.Readlink("vfs://link"); err != nil || target != "vfs://secret" {
+			t.Errorf("Readlink = %q, %v; want %q", target, err, "vfs://secret")
+		}
+		if err := sub.Remove("vfs://link"); err != nil {
+			t.Fatalf("Remove error: %s", err)
+		}
+	}
+}
+
+func TestBoxClose(t *testing.T) {
+	box1, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	box2, err := NewBox()
+	if err != nil {
+		t.Fatalf("NewBox error: %s", err)
+	}
+	for i, box := range []*Box{box1, box2} {
+		if err := box.WriteFile("vfs://file", []byte{byte(i)}, 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	box1.Close()
+	if _, err := box1.Stat("vfs://file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of file in closed box: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if data, err := box2.ReadFile("vfs://file"); err != nil || !bytes.Equal(data, []byte{1}) {
+		t.Errorf("ReadFile of file in other box = %v, %v; want %v", data, err, []byte{1})
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir := t.TempDir()
+	roots := []string{"vfs://walk", dir}
+	for _, root := range roots {
+		for _, name := range []string{"a/b", "c"} {
+			if err := MkdirAll(Join(root, name), 0755); err != nil {
+				t.Fatalf("MkdirAll error: %s", err)
+			}
+		}
+		if err := WriteFile(Join(root, "a/b/file"), []byte("data"), 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	for _, root := range roots {
+		want := []string{
+			root,
+			Join(root, "a"),
+			Join(root, "a/b"),
+			Join(root, "a/b/file"),
+			Join(root, "c"),
+		}
+
+		var walked, walkedDir []string
+		err := Walk(root, func(name string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Name() != path.Base(name) {
+				t.Errorf("Walk: info for %q has name %q", name, info.Name())
+			}
+			walked = append(walked, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Walk(%q) error: %s", root, err)
+		}
+		err = WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			walkedDir = append(walkedDir, name)
+			// paths round-trip through the rest of the API
+			if _, err := Lstat(name); err != nil {
+				t.Errorf("WalkDir: Lstat of %q failed: %v", name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WalkDir(%q) error: %s", root, err)
+		}
+
+		for _, got := range [][]string{walked, walkedDir} {
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("walked %q, want %q", got, want)
+			}
+		}
+	}
+
+	err := Walk("vfs://nonexistent", func(name string, info fs.FileInfo, err error) error {
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Walk of nonexistent root: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
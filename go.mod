@@ -1,11 +1,14 @@
 module github.com/capnspacehook/pandorasbox
 
-go 1.16
+go 1.23
 
 require (
 	github.com/awnumar/fastrand v0.0.0-20210315215012-30ee0990fa2d
-	github.com/awnumar/memcall v0.1.1 // indirect
 	github.com/awnumar/memguard v0.22.2
-	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b // indirect
+	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b
+)
+
+require (
+	github.com/awnumar/memcall v0.1.1 // indirect
 	golang.org/x/sys v0.0.0-20210316092937-0b90fd5c4c48 // indirect
 )
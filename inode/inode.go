@@ -27,9 +27,28 @@ type Inode struct {
 	Atime time.Time // access time
 	Mtime time.Time // modification time
 
+	// Flags holds attribute flags such as FlagImmutable, similar to
+	// those set by chattr(1). It is accessed atomically.
+	Flags uint32
+
+	// Xattrs holds the extended attributes of the file, and is guarded
+	// by the lock of the Inode.
+	Xattrs map[string][]byte
+
 	Dir Directory
 }
 
+// Attribute flags of an Inode.
+const (
+	// FlagImmutable marks a file that may not be modified, removed,
+	// renamed or linked to.
+	FlagImmutable uint32 = 1 << iota
+
+	// FlagNoTimes marks a file whose timestamps are never updated when
+	// it is accessed or modified.
+	FlagNoTimes
+)
+
 type DirEntry struct {
 	Name  string
 	Inode *Inode
@@ -43,20 +62,92 @@ func (e *DirEntry) IsDir() bool {
 	return e.Inode.IsDir()
 }
 
-type Directory []*DirEntry
+// Directory holds the entries of a directory indexed by name, so that
+// entries can be looked up, added and removed in constant time. A view
+// of the entries sorted by name is built when it's first needed after
+// the directory changes. Like the rest of an Inode, a Directory is
+// guarded by the lock of the Inode it belongs to.
+type Directory struct {
+	entries map[string]*DirEntry
+	sorted  atomic.Pointer[[]*DirEntry]
+}
+
+// Len returns the number of entries in d, including "." and "..".
+func (d *Directory) Len() int {
+	return len(d.entries)
+}
+
+// Lookup returns the entry of d named name, or nil if there is none.
+func (d *Directory) Lookup(name string) *DirEntry {
+	return d.entries[name]
+}
+
+// Entries returns the entries of d sorted by name, including "." and
+// "..". The returned slice is shared and must not be modified, but
+// later changes to d don't affect it. Only a read lock of the Inode
+// needs to be held.
+func (d *Directory) Entries() []*DirEntry {
+	if sorted := d.sorted.Load(); sorted != nil {
+		return *sorted
+	}
+
+	sorted := make([]*DirEntry, 0, len(d.entries))
+	for _, e := range d.entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	// readers holding the read lock may race to build the view, but
+	// they all build the same one
+	d.sorted.Store(&sorted)
+
+	return sorted
+}
+
+func (d *Directory) set(entry *DirEntry) {
+	if d.entries == nil {
+		d.entries = make(map[string]*DirEntry)
+	}
+	d.entries[entry.Name] = entry
+	d.sorted.Store(nil)
+}
+
+func (d *Directory) delete(name string) {
+	delete(d.entries, name)
+	d.sorted.Store(nil)
+}
 
-func (d Directory) Len() int           { return len(d) }
-func (d Directory) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
-func (d Directory) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d *Directory) clear() {
+	clear(d.entries)
+	d.sorted.Store(nil)
+}
 
 type Ino uint64
 
 func (n *Ino) New(mode os.FileMode) *Inode {
-	atomic.AddUint64((*uint64)(unsafe.Pointer(n)), 1)
+	return newInode(atomic.AddUint64((*uint64)(unsafe.Pointer(n)), 1), mode)
+}
+
+// NewIno returns a new Inode numbered ino, advancing n to ino if it is
+// behind, so that inodes created later are numbered after it. The caller
+// must ensure no other Inode is numbered ino.
+func (n *Ino) NewIno(ino uint64, mode os.FileMode) *Inode {
+	for {
+		cur := atomic.LoadUint64((*uint64)(unsafe.Pointer(n)))
+		if cur >= ino || atomic.CompareAndSwapUint64((*uint64)(unsafe.Pointer(n)), cur, ino) {
+			break
+		}
+	}
+
+	return newInode(ino, mode)
+}
+
+func newInode(ino uint64, mode os.FileMode) *Inode {
 	now := time.Now()
 
 	return &Inode{
-		Ino:   uint64(*n),
+		Ino:   ino,
 		Atime: now,
 		Mtime: now,
 		Ctime: now,
@@ -92,15 +183,12 @@ func (n *Inode) Link(name string, child *Inode) error {
 	n.Lock()
 	defer n.Unlock()
 
-	x := n.find(name)
-
-	entry := &DirEntry{name, child}
-
-	if x < len(n.Dir) && n.Dir[x].Name == name {
-		n.linkswapi(x, entry)
-		return nil
+	if old := n.Dir.Lookup(name); old != nil {
+		old.Inode.countDown()
 	}
-	n.linki(x, entry)
+	n.Dir.set(&DirEntry{name, child})
+	child.countUp()
+	n.modified()
 
 	return nil
 }
@@ -115,13 +203,14 @@ func (n *Inode) Unlink(name string) error {
 	n.Lock()
 	defer n.Unlock()
 
-	x := n.find(name)
-
-	if x == n.Dir.Len() || n.Dir[x].Name != name {
+	e := n.Dir.Lookup(name)
+	if e == nil {
 		return syscall.ENOENT // os.ErrNotExist
 	}
 
-	n.unlinki(x)
+	e.Inode.countDown()
+	n.Dir.delete(name)
+	n.modified()
 
 	return nil
 }
@@ -129,7 +218,7 @@ func (n *Inode) Unlink(name string) error {
 func (n *Inode) UnlinkAll() {
 	n.Lock()
 
-	for _, e := range n.Dir {
+	for _, e := range n.Dir.Entries() {
 		if e.Name == ".." {
 			continue
 		}
@@ -144,14 +233,104 @@ func (n *Inode) UnlinkAll() {
 		e.Inode.countDown()
 	}
 
-	n.Dir = n.Dir[:0]
+	n.Dir.clear()
 	n.Unlock()
 }
 
+// HasChildren reports whether n contains any directory entries other
+// than the "." and ".." self-links.
+func (n *Inode) HasChildren() bool {
+	n.RLock()
+	defer n.RUnlock()
+
+	for name := range n.Dir.entries {
+		if name != "." && name != ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetFlag sets or clears flag on n.
+func (n *Inode) SetFlag(flag uint32, set bool) {
+	for {
+		old := atomic.LoadUint32(&n.Flags)
+		new := old &^ flag
+		if set {
+			new |= flag
+		}
+		if atomic.CompareAndSwapUint32(&n.Flags, old, new) {
+			return
+		}
+	}
+}
+
+// Setxattr sets the extended attribute key of n to a copy of value.
+func (n *Inode) Setxattr(key string, value []byte) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.Xattrs == nil {
+		n.Xattrs = make(map[string][]byte)
+	}
+	n.Xattrs[key] = append([]byte(nil), value...)
+}
+
+// Getxattr returns a copy of the value of the extended attribute key of
+// n, and whether it is set.
+func (n *Inode) Getxattr(key string) ([]byte, bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	value, ok := n.Xattrs[key]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte{}, value...), true
+}
+
+// Listxattr returns the sorted names of the extended attributes of n.
+func (n *Inode) Listxattr() []string {
+	n.RLock()
+	defer n.RUnlock()
+
+	keys := make([]string, 0, len(n.Xattrs))
+	for key := range n.Xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Removexattr removes the extended attribute key of n, and reports
+// whether it was set.
+func (n *Inode) Removexattr(key string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	_, ok := n.Xattrs[key]
+	delete(n.Xattrs, key)
+
+	return ok
+}
+
+// IsImmutable reports whether n has FlagImmutable set.
+func (n *Inode) IsImmutable() bool {
+	return atomic.LoadUint32(&n.Flags)&FlagImmutable != 0
+}
+
 func (n *Inode) IsDir() bool {
 	return n.Mode&fs.ModeDir != 0
 }
 
+// Rename moves the entry at oldpath to newpath, both resolved relative to n.
+// If newpath names an existing file it is replaced, unless either of them is
+// a directory, or a directory would be moved inside itself. When a directory
+// is moved to a new parent, its ".." entry is re-pointed so that link counts
+// of both the old and new parent stay consistent.
 func (n *Inode) Rename(oldpath, newpath string) error {
 	dir, name := filepath.Split(oldpath)
 	dir = filepath.Clean(dir)
@@ -166,44 +345,64 @@ func (n *Inode) Rename(oldpath, newpath string) error {
 		return err
 	}
 
-	var rename string
 	tnode, err := n.Resolve(newpath)
+	if err == nil && tnode == snode {
+		// renaming an entry to itself is a no-op
+		return nil
+	}
 	if err == nil && tnode.IsDir() {
 		return syscall.EEXIST
 	}
-	if (err == nil && !tnode.IsDir()) || (err != nil && errors.Is(err, fs.ErrNotExist)) {
-		var tdir string
-		tdir, rename = filepath.Split(newpath)
-		tdir = filepath.Clean(tdir)
-		tnode, err = n.Resolve(tdir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
+	exists := err == nil
+
+	tdir, rename := filepath.Split(newpath)
+	tdir = filepath.Clean(tdir)
+	tp, err := n.Resolve(tdir)
 	if err != nil {
 		return err
 	}
-
-	if len(rename) > 0 {
-		name, rename = rename, name
+	if snode.IsDir() && tp.within(snode) {
+		// a directory can't be moved inside itself
+		return syscall.EINVAL
+	}
+	if exists && snode.IsDir() {
+		return syscall.ENOTDIR
 	}
-	err = tnode.Link(name, snode)
+
+	err = tp.Link(rename, snode)
 	if err != nil {
 		return err
 	}
-	if len(rename) > 0 {
-		name, rename = rename, name
-	}
 	err = p.Unlink(name)
 	if err != nil {
 		return err
 	}
 
+	// a moved directory must have its parent link updated, which
+	// moves the link count from the old parent to the new one
+	if snode.IsDir() && p != tp {
+		if err := snode.Link("..", tp); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Resolve returns the inode that path refers to. Relative paths, and the
+// empty path, which refers to n itself, are resolved relative to n.
 func (n *Inode) Resolve(path string) (*Inode, error) {
 	n.RLock()
 	defer n.RUnlock()
 
 	name, trim := PopPath(path)
+	if name == "" {
+		// an empty path refers to n itself, as "." does
+		return n, nil
+	}
 	if name == "/" {
 		if trim == "" {
 			return n, nil
@@ -218,9 +417,8 @@ func (n *Inode) Resolve(path string) (*Inode, error) {
 		return nn, err
 	}
 
-	x := n.find(name)
-	if x < len(n.Dir) && n.Dir[x].Name == name {
-		nn := n.Dir[x].Inode
+	if e := n.Dir.Lookup(name); e != nil {
+		nn := e.Inode
 		if len(trim) == 0 {
 			return nn, nil
 		}
@@ -230,11 +428,32 @@ func (n *Inode) Resolve(path string) (*Inode, error) {
 	return nil, syscall.ENOENT // os.ErrNotExist
 }
 
+// within reports whether n is dir or one of its descendants, following
+// the ".." entries of n up to the root.
+func (n *Inode) within(dir *Inode) bool {
+	for {
+		if n == dir {
+			return true
+		}
+		parent, err := n.Resolve("..")
+		if err != nil || parent == n {
+			return false
+		}
+		n = parent
+	}
+}
+
 func (n *Inode) accessed() {
+	if atomic.LoadUint32(&n.Flags)&FlagNoTimes != 0 {
+		return
+	}
 	n.Atime = time.Now()
 }
 
 func (n *Inode) modified() {
+	if atomic.LoadUint32(&n.Flags)&FlagNoTimes != 0 {
+		return
+	}
 	now := time.Now()
 	n.Atime = now
 	n.Mtime = now
@@ -252,35 +471,3 @@ func (n *Inode) countDown() {
 	n.Nlink--
 	n.accessed() // (I don't think link count mod counts as node mod )
 }
-
-func (n *Inode) unlinki(i int) {
-	n.Dir[i].Inode.countDown()
-	copy(n.Dir[i:], n.Dir[i+1:])
-	n.Dir = n.Dir[:len(n.Dir)-1]
-
-	n.modified()
-}
-
-func (n *Inode) linkswapi(i int, entry *DirEntry) {
-	n.Dir[i].Inode.countDown()
-	n.Dir[i] = entry
-	n.Dir[i].Inode.countUp()
-
-	n.modified()
-}
-
-func (n *Inode) linki(i int, entry *DirEntry) {
-	n.Dir = append(n.Dir, nil)
-	copy(n.Dir[i+1:], n.Dir[i:])
-
-	n.Dir[i] = entry
-	n.Dir[i].Inode.countUp()
-
-	n.modified()
-}
-
-func (n *Inode) find(name string) int {
-	return sort.Search(len(n.Dir), func(i int) bool {
-		return n.Dir[i].Name >= name
-	})
-}
@@ -21,6 +21,10 @@ func TestPopPath(t *testing.T) {
 		{"foo/bar/bat", "foo", "bar/bat"},
 		{"bar/bat", "bar", "bat"},
 		{"bat", "bat", ""},
+		{"//foo//bar", "/", "foo//bar"},
+		{"foo//bar", "foo", "bar"},
+		{"foo/", "foo", ""},
+		{"foo//", "foo", ""},
 	}
 
 	for i, test := range tests {
@@ -174,7 +178,7 @@ func TestInode(t *testing.T) {
 		if path == "/" {
 			path = ""
 		}
-		for _, entry := range node.Dir {
+		for _, entry := range node.Dir.Entries() {
 			err := walk(entry.Inode, path+"/"+entry.Name)
 			if err != nil {
 				return err
@@ -187,7 +191,7 @@ func TestInode(t *testing.T) {
 		defer close(testoutput)
 		err = walk(root, "/")
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -367,7 +371,7 @@ func TestLinkUnlinkMove(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = root.Rename("/file_0001.txt", "/dir01")
+	err = root.Rename("/file_0001.txt", "/dir01/file_0001.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -403,7 +407,7 @@ func TestLinkUnlinkMove(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = root.Rename("/dir01", "/dir00")
+	err = root.Rename("/dir01", "/dir00/dir01")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -434,6 +438,212 @@ func TestLinkUnlinkMove(t *testing.T) {
 	}
 }
 
+func TestRenameDir(t *testing.T) {
+	ino := new(Ino)
+	root := ino.NewDir(0777)
+
+	mkdir := func(parent *Inode, name string) *Inode {
+		dir := ino.NewDir(0777)
+		if err := parent.Link(name, dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.Link("..", parent); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	a := mkdir(root, "a")
+	b := mkdir(root, "b")
+	dir := mkdir(a, "dir")
+	sub := mkdir(dir, "sub")
+	file := ino.New(0666)
+	if err := dir.Link("file", file); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Nlink != 3 {
+		t.Fatalf("a: incorrect link count before move %d != %d", a.Nlink, 3)
+	}
+	if b.Nlink != 2 {
+		t.Fatalf("b: incorrect link count before move %d != %d", b.Nlink, 2)
+	}
+
+	if err := root.Rename("/a/dir", "/b/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := root.Resolve("/a/dir"); err == nil {
+		t.Fatal("old path still resolves after move")
+	}
+	node, err := root.Resolve("/b/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != dir {
+		t.Fatalf("expected /b/dir to be Ino %d, got %d", dir.Ino, node.Ino)
+	}
+	node, err = root.Resolve("/b/dir/..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != b {
+		t.Fatalf("expected /b/dir/.. to be Ino %d, got %d", b.Ino, node.Ino)
+	}
+	node, err = root.Resolve("/b/dir/sub/../file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != file {
+		t.Fatalf("expected /b/dir/sub/../file to be Ino %d, got %d", file.Ino, node.Ino)
+	}
+
+	tests := []struct {
+		Name  string
+		Node  *Inode
+		Nlink uint64
+	}{
+		{"a", a, 2},
+		{"b", b, 3},
+		{"dir", dir, 3},
+		{"sub", sub, 2},
+		{"file", file, 1},
+	}
+	for _, test := range tests {
+		if test.Node.Nlink != test.Nlink {
+			t.Errorf("%s: incorrect link count after move %d != %d", test.Name, test.Node.Nlink, test.Nlink)
+		}
+	}
+
+	// renaming within the same directory keeps link counts intact
+	if err := root.Rename("/b/dir", "/b/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Nlink != 3 {
+		t.Errorf("b: incorrect link count after rename %d != %d", b.Nlink, 3)
+	}
+	if dir.Nlink != 3 {
+		t.Errorf("dir: incorrect link count after rename %d != %d", dir.Nlink, 3)
+	}
+
+	// renaming an entry to itself is a no-op
+	if err := root.Rename("/b/moved", "/b/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Resolve("/b/moved"); err != nil {
+		t.Fatalf("entry renamed to itself was removed: %v", err)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	ino := new(Ino)
+	root := ino.NewDir(0777)
+
+	dir := ino.NewDir(0777)
+	if err := root.Link("dir", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Link("..", root); err != nil {
+		t.Fatal(err)
+	}
+	sub := ino.NewDir(0777)
+	if err := dir.Link("sub", sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Link("..", dir); err != nil {
+		t.Fatal(err)
+	}
+	file := ino.New(0666)
+	if err := root.Link("file", file); err != nil {
+		t.Fatal(err)
+	}
+	target := ino.New(0666)
+	if err := dir.Link("target", target); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file can't replace a directory
+	if err := root.Rename("/file", "/dir/sub"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("rename onto directory: got %v, want %v", err, os.ErrExist)
+	}
+	if node, err := root.Resolve("/dir/sub"); err != nil || node != sub {
+		t.Errorf("directory replaced by failed rename: %v", err)
+	}
+
+	// an existing file is replaced
+	if err := root.Rename("/file", "/dir/target"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := root.Resolve("/dir/target"); err != nil || node != file {
+		t.Errorf("expected /dir/target to be Ino %d after rename", file.Ino)
+	}
+	if _, err := root.Resolve("/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old path after rename: got %v, want %v", err, os.ErrNotExist)
+	}
+	if file.Nlink != 1 {
+		t.Errorf("file: incorrect link count after rename %d != %d", file.Nlink, 1)
+	}
+	if target.Nlink != 0 {
+		t.Errorf("target: incorrect link count after replace %d != %d", target.Nlink, 0)
+	}
+
+	// a new name in another directory moves the file
+	if err := root.Rename("/dir/target", "/dir/sub/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := root.Resolve("/dir/sub/moved"); err != nil || node != file {
+		t.Errorf("expected /dir/sub/moved to be Ino %d after move", file.Ino)
+	}
+	if _, err := root.Resolve("/dir/target"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old path after move: got %v, want %v", err, os.ErrNotExist)
+	}
+	if file.Nlink != 1 {
+		t.Errorf("file: incorrect link count after move %d != %d", file.Nlink, 1)
+	}
+	if dir.Nlink != 3 || sub.Nlink != 2 {
+		t.Errorf("directory link counts changed by moving a file: %d, %d", dir.Nlink, sub.Nlink)
+	}
+}
+
+func TestDirectoryEntries(t *testing.T) {
+	var ino Ino
+	dir := ino.NewDir(0755)
+	for _, name := range []string{"c", "a", "e", "b", "d"} {
+		if err := dir.Link(name, ino.New(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := dir.Dir.Entries()
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{".", "..", "a", "b", "c", "d", "e"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("Entries = %q, want %q", names, want)
+	}
+
+	// earlier views aren't affected by later changes
+	if err := dir.Unlink("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Link("f", ino.New(0644)); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 || entries[2].Name != "a" {
+		t.Errorf("Entries view changed after Unlink and Link")
+	}
+	if n := dir.Dir.Len(); n != 7 {
+		t.Errorf("Len = %d, want 7", n)
+	}
+	if e := dir.Dir.Lookup("a"); e != nil {
+		t.Errorf("Lookup of unlinked entry = %v, want nil", e)
+	}
+	if entries := dir.Dir.Entries(); entries[len(entries)-1].Name != "f" {
+		t.Errorf("last entry = %q, want %q", entries[len(entries)-1].Name, "f")
+	}
+}
+
 func TestResolve(t *testing.T) {
 	ino := new(Ino)
 
@@ -572,7 +782,7 @@ func TestResolve(t *testing.T) {
 		if path == "/" {
 			path = ""
 		}
-		for _, entry := range node.Dir {
+		for _, entry := range node.Dir.Entries() {
 			err := walk(entry.Inode, path+"/"+entry.Name)
 			if err != nil {
 				return err
@@ -584,7 +794,7 @@ func TestResolve(t *testing.T) {
 		defer close(testoutput)
 		err = walk(root, "/")
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -603,10 +813,13 @@ func TestResolve(t *testing.T) {
 	t.Run("resolve", func(t *testing.T) {
 		tests := make(map[string]uint64)
 		tests["/"] = 1
+		tests[""] = 1
 		tests["/tmp"] = 2
 		tests["/tmp/bar"] = 4
 		tests["/tmp/bat"] = 5
 		tests["/tmp/foo"] = 3
+		tests["//tmp//bar/"] = 4
+		tests["tmp///bat"] = 5
 		var dir *Inode
 		for Path, Ino := range tests {
 			node, err := root.Resolve(Path)
@@ -628,6 +841,9 @@ func TestResolve(t *testing.T) {
 		tests["../bar"] = 4
 		tests["../bat"] = 5
 		tests["."] = 3
+		tests[""] = 3
+		tests["..//bar"] = 4
+		tests[".//..///bat//"] = 5
 		for Path, Ino := range tests {
 			node, err := dir.Resolve(Path)
 			if err != nil {
@@ -665,7 +881,7 @@ func Walk(node *Inode, path string, fn func(path string, n *Inode) error) error
 	if path == "/" {
 		path = ""
 	}
-	for _, entry := range node.Dir {
+	for _, entry := range node.Dir.Entries() {
 		err := Walk(entry.Inode, path+"/"+entry.Name, fn)
 		if err != nil {
 			return err
@@ -673,3 +889,93 @@ func Walk(node *Inode, path string, fn func(path string, n *Inode) error) error
 	}
 	return nil
 }
+
+// pathSeeds are tricky paths used to seed the path fuzzers.
+var pathSeeds = []string{
+	"", "/", "//", ".", "..", "/.", "/..", "a", "a/", "a//b", "//a//b//",
+	"a/./b", "a/../a/b", "../../a", "a/b/f", "a/b/f/", "a/b/f/..", "a/b/f/.",
+	"/a/b/../../c", "c/../a/b", "a/\x00/b", "a/b/nonexistent", ".../a",
+}
+
+func FuzzPopPath(f *testing.F) {
+	for _, seed := range pathSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		name, trim := PopPath(path)
+		if path == "" {
+			if name != "" || trim != "" {
+				t.Fatalf("PopPath(%q) = %q, %q; want empty strings", path, name, trim)
+			}
+			return
+		}
+
+		if strings.HasPrefix(trim, "/") {
+			t.Errorf("PopPath(%q): rest %q starts with a slash", path, trim)
+		}
+		if name != "/" && strings.Contains(name, "/") {
+			t.Errorf("PopPath(%q): name %q contains a slash", path, name)
+		}
+		if !strings.HasPrefix(path, name) || strings.TrimLeft(path[len(name):], "/") != trim {
+			t.Errorf("PopPath(%q) = %q, %q; not a split of the path", path, name, trim)
+		}
+
+		joined := name
+		if trim != "" {
+			joined = filepath.Join(name, trim)
+		}
+		if filepath.Clean(joined) != filepath.Clean(path) {
+			t.Errorf("PopPath(%q) = %q, %q; rejoined as %q", path, name, trim, joined)
+		}
+	})
+}
+
+func FuzzResolve(f *testing.F) {
+	for _, seed := range pathSeeds {
+		f.Add(seed)
+	}
+
+	var ino Ino
+	root := ino.NewDir(0755)
+	a, b, c := ino.NewDir(0755), ino.NewDir(0755), ino.NewDir(0755)
+	file := ino.New(0644)
+	for _, l := range []struct {
+		parent *Inode
+		name   string
+		child  *Inode
+	}{
+		{root, "a", a}, {a, "..", root},
+		{a, "b", b}, {b, "..", a},
+		{root, "c", c}, {c, "..", root},
+		{b, "f", file},
+	} {
+		if err := l.parent.Link(l.name, l.child); err != nil {
+			f.Fatal(err)
+		}
+	}
+	tree := map[string]*Inode{
+		"/":      root,
+		"/a":     a,
+		"/a/b":   b,
+		"/a/b/f": file,
+		"/c":     c,
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		node, err := root.Resolve(path)
+		if err != nil {
+			if node != nil {
+				t.Errorf("Resolve(%q) returned a node along with error %v", path, err)
+			}
+			return
+		}
+
+		want, ok := tree[filepath.Join("/", path)]
+		if !ok {
+			t.Fatalf("Resolve(%q) = inode %d, but the path isn't in the tree", path, node.Ino)
+		}
+		if node != want {
+			t.Errorf("Resolve(%q) = inode %d, want %d", path, node.Ino, want.Ino)
+		}
+	})
+}
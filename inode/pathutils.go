@@ -17,7 +17,8 @@ func Abs(cwd, name string) string {
 }
 
 // PopPath returns the first name in `path` and the rest of the `path` string.
-// The path provided must use forward slashes ("/").
+// The path provided must use forward slashes ("/"). Consecutive slashes are
+// treated as one, as path.Clean does, so the rest never starts with a slash.
 func PopPath(path string) (string, string) {
 	if path == "" {
 		return "", "" // 1
@@ -33,5 +34,5 @@ func PopPath(path string) (string, string) {
 		return "/", strings.TrimLeft(path, "/") // 3
 	}
 
-	return path[:x], path[x+1:] // 4, 5
+	return path[:x], strings.TrimLeft(path[x+1:], "/") // 4, 5
 }
@@ -4,6 +4,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/capnspacehook/pandorasbox/absfs"
 )
@@ -22,6 +23,8 @@ func (stdFS) Sub(dir string) (fs.FS, error) {
 
 type pbFS struct{}
 
+var _ absfs.FileSystem = pbFS{}
+
 func NewFS() absfs.FileSystem {
 	return pbFS{}
 }
@@ -101,6 +104,30 @@ func (pbFS) Truncate(name string, size int64) error {
 	return os.Truncate(name, size)
 }
 
+func (pbFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (pbFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (pbFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (pbFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (pbFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (pbFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
 func (pbFS) WalkDir(root string, fn fs.WalkDirFunc) error {
 	return filepath.WalkDir(root, fn)
 }
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package osfs
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// StatFS is not supported on this platform.
+func (pbFS) StatFS(name string) (total, used, free int64, err error) {
+	return 0, 0, 0, &fs.PathError{Op: "statfs", Path: name, Err: errors.ErrUnsupported}
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+
+package osfs
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// StatFS reports the size of the filesystem holding the named file, and
+// how much of it is used and free, in bytes. free is the space available
+// to unprivileged users.
+func (pbFS) StatFS(name string) (total, used, free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, 0, 0, &fs.PathError{Op: "statfs", Path: name, Err: err}
+	}
+
+	bsize := int64(st.Bsize)
+	total = int64(st.Blocks) * bsize
+	used = total - int64(st.Bfree)*bsize
+	free = int64(st.Bavail) * bsize
+
+	return total, used, free, nil
+}
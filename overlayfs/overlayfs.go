@@ -0,0 +1,722 @@
+// Package overlayfs implements a copy-on-write union of two
+// absfs.FileSystems.
+//
+// Files are read from the upper filesystem if they exist there, and from
+// the lower filesystem otherwise. The lower filesystem is never modified:
+// a file from the lower filesystem is copied up to the upper filesystem
+// before it is written to, and removing a file that exists in the lower
+// filesystem records a whiteout that hides it. Whiteouts are only held in
+// memory, and are lost along with the overlay.
+package overlayfs
+
+import (
+	"errors"
+	"io"
+	stdfs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+)
+
+const _O_ACCESS = 0x3 // masks the access mode (os.O_RDONLY, os.O_WRONLY, or os.O_RDWR)
+
+// stdFS adapts an overlay to the io/fs interfaces. Names are resolved
+// relative to the root of the overlay regardless of its working
+// directory.
+type stdFS struct {
+	*pbFS
+}
+
+func (fs stdFS) Open(name string) (stdfs.File, error) {
+	if err := checkPath(name, "open"); err != nil {
+		return nil, err
+	}
+
+	return fs.pbFS.Open("/" + name)
+}
+
+func (fs stdFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
+	if err := checkPath(name, "open"); err != nil {
+		return nil, err
+	}
+
+	return fs.pbFS.ReadDir("/" + name)
+}
+
+func (fs stdFS) ReadFile(name string) ([]byte, error) {
+	if err := checkPath(name, "open"); err != nil {
+		return nil, err
+	}
+
+	return fs.pbFS.ReadFile("/" + name)
+}
+
+func (fs stdFS) Stat(name string) (stdfs.FileInfo, error) {
+	if err := checkPath(name, "stat"); err != nil {
+		return nil, err
+	}
+
+	return fs.pbFS.Stat("/" + name)
+}
+
+func checkPath(name, op string) error {
+	if !stdfs.ValidPath(name) {
+		return &stdfs.PathError{Op: op, Path: name, Err: stdfs.ErrInvalid}
+	}
+
+	return nil
+}
+
+type pbFS struct {
+	mtx sync.RWMutex
+
+	lower absfs.FileSystem
+	upper absfs.FileSystem
+	cwd   string
+
+	// whiteouts are removed files that hide files of the same name in
+	// the lower filesystem, along with everything beneath them. Opaque
+	// directories are directories in the upper filesystem that were
+	// created where a whiteout was, and so hide everything beneath
+	// them in the lower filesystem.
+	whiteouts map[string]bool
+	opaque    map[string]bool
+}
+
+var _ absfs.FileSystem = (*pbFS)(nil)
+
+// NewFS returns an overlay of upper on top of lower. Only upper is ever
+// modified.
+func NewFS(lower, upper absfs.FileSystem) absfs.FileSystem {
+	return &pbFS{
+		lower:     lower,
+		upper:     upper,
+		cwd:       "/",
+		whiteouts: make(map[string]bool),
+		opaque:    make(map[string]bool),
+	}
+}
+
+func (fs *pbFS) FS() stdfs.FS {
+	return stdFS{pbFS: fs}
+}
+
+// abs returns the absolute form of name. The caller must hold fs.mtx.
+func (fs *pbFS) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+
+	return path.Join(fs.cwd, name)
+}
+
+// inLower reports whether name, which must be absolute, is not hidden
+// by a whiteout or opaque directory. The caller must hold fs.mtx.
+func (fs *pbFS) inLower(name string) bool {
+	for p := name; ; p = path.Dir(p) {
+		if fs.whiteouts[p] || (p != name && fs.opaque[p]) {
+			return false
+		}
+		if p == "/" {
+			return true
+		}
+	}
+}
+
+// layer returns the filesystem the file name, which must be absolute,
+// is visible in, along with its FileInfo as returned by Lstat. The caller
+// must hold fs.mtx.
+func (fs *pbFS) layer(name string) (absfs.FileSystem, stdfs.FileInfo, error) {
+	fi, err := fs.upper.Lstat(name)
+	if err == nil {
+		return fs.upper, fi, nil
+	}
+	if !errors.Is(err, stdfs.ErrNotExist) {
+		return nil, nil, underlying(err)
+	}
+	if !fs.inLower(name) {
+		return nil, nil, syscall.ENOENT
+	}
+
+	fi, err = fs.lower.Lstat(name)
+	if err != nil {
+		return nil, nil, underlying(err)
+	}
+
+	return fs.lower, fi, nil
+}
+
+// underlying returns the error wrapped by a *fs.PathError, so that it can
+// be wrapped again with the name the caller used.
+func underlying(err error) error {
+	var pathErr *stdfs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+
+	return err
+}
+
+// copyUp copies the file name, which must be absolute, and the
+// directories containing it from the lower filesystem to the upper one
+// if they aren't already there. Directories are copied without their
+// contents. The caller must hold fs.mtx for writing.
+func (fs *pbFS) copyUp(name string) error {
+	if name != "/" {
+		if err := fs.copyUp(path.Dir(name)); err != nil {
+			return err
+		}
+	}
+
+	layer, fi, err := fs.layer(name)
+	if err != nil {
+		return err
+	}
+	if layer == fs.upper {
+		return nil
+	}
+
+	if fi.IsDir() {
+		return fs.upper.Mkdir(name, fi.Mode().Perm())
+	}
+
+	src, err := fs.lower.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.upper.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// copyUpAll copies the tree rooted at name, which must be absolute, from
+// the lower filesystem to the upper one. The caller must hold fs.mtx for
+// writing.
+func (fs *pbFS) copyUpAll(name string) error {
+	if err := fs.copyUp(name); err != nil {
+		return err
+	}
+	fi, err := fs.upper.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+
+	entries, err := fs.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fs.copyUpAll(path.Join(name, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unhide removes any whiteout at name, which must be absolute, once a
+// file has been created there in the upper filesystem. A directory
+// created in place of a removed file must not show the removed file's
+// contents, so it is made opaque. The caller must hold fs.mtx for
+// writing.
+func (fs *pbFS) unhide(name string, dir bool) {
+	if !fs.whiteouts[name] {
+		return
+	}
+	delete(fs.whiteouts, name)
+	if dir {
+		fs.opaque[name] = true
+	}
+}
+
+// hide records that name, which must be absolute, was removed, hiding it
+// in the lower filesystem if it exists there. The caller must hold
+// fs.mtx for writing.
+func (fs *pbFS) hide(name string) {
+	for p := range fs.opaque {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(fs.opaque, p)
+		}
+	}
+	for p := range fs.whiteouts {
+		if strings.HasPrefix(p, name+"/") {
+			delete(fs.whiteouts, p)
+		}
+	}
+
+	if fs.inLower(name) {
+		if _, err := fs.lower.Lstat(name); err == nil {
+			fs.whiteouts[name] = true
+		}
+	}
+}
+
+func (fs *pbFS) Open(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file from the layer it is visible in. If the
+// file is opened for writing or truncated, it is copied up to the upper
+// filesystem first. Directories are opened so that reading their entries
+// returns the entries of both layers.
+func (fs *pbFS) OpenFile(name string, flag int, perm stdfs.FileMode) (absfs.File, error) {
+	writable := flag&_O_ACCESS != os.O_RDONLY || flag&(os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if writable {
+		fs.mtx.Lock()
+		defer fs.mtx.Unlock()
+	} else {
+		fs.mtx.RLock()
+		defer fs.mtx.RUnlock()
+	}
+	abs := fs.abs(name)
+
+	layer, fi, err := fs.layer(abs)
+	if err != nil && !errors.Is(err, stdfs.ErrNotExist) {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if err != nil && flag&os.O_CREATE == 0 {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	if err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrExist}
+	}
+
+	if writable {
+		if err == nil {
+			if fi.IsDir() {
+				return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+			}
+			err = fs.copyUp(abs)
+		} else {
+			// the file is being created, so only its directory has
+			// to be copied up
+			err = fs.copyUp(path.Dir(abs))
+		}
+		if err != nil {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		f, err := fs.upper.OpenFile(abs, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		fs.unhide(abs, false)
+
+		return f, nil
+	}
+
+	f, err := layer.OpenFile(abs, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dirFile{File: f, fs: fs, name: abs}, nil
+	}
+
+	return f, nil
+}
+
+func (fs *pbFS) Create(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *pbFS) ReadFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// ReadDir returns the entries of the named directory in both layers,
+// sorted by filename. If a name exists in both layers, the entry from
+// the upper filesystem is returned.
+func (fs *pbFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	abs := fs.abs(name)
+	_, fi, err := fs.layer(abs)
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !fi.IsDir() {
+		return nil, &stdfs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	return fs.readDir(abs)
+}
+
+// readDir returns the merged entries of the directory name, which must
+// be absolute and exist. The caller must hold fs.mtx.
+func (fs *pbFS) readDir(name string) ([]stdfs.DirEntry, error) {
+	merged := make(map[string]stdfs.DirEntry)
+	if fs.inLower(name) && !fs.opaque[name] {
+		entries, err := fs.lower.ReadDir(name)
+		if err != nil && !errors.Is(err, stdfs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !fs.whiteouts[path.Join(name, e.Name())] {
+				merged[e.Name()] = e
+			}
+		}
+	}
+
+	entries, err := fs.upper.ReadDir(name)
+	if err != nil && !errors.Is(err, stdfs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		merged[e.Name()] = e
+	}
+
+	dirs := make([]stdfs.DirEntry, 0, len(merged))
+	for _, e := range merged {
+		dirs = append(dirs, e)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
+
+	return dirs, nil
+}
+
+func (fs *pbFS) WriteFile(name string, data []byte, perm stdfs.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+
+	return err
+}
+
+func (fs *pbFS) Mkdir(name string, perm stdfs.FileMode) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if _, _, err := fs.layer(abs); err == nil {
+		return &stdfs.PathError{Op: "mkdir", Path: name, Err: stdfs.ErrExist}
+	}
+	if err := fs.copyUp(path.Dir(abs)); err != nil {
+		return &stdfs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if err := fs.upper.Mkdir(abs, perm); err != nil {
+		return err
+	}
+	fs.unhide(abs, true)
+
+	return nil
+}
+
+func (fs *pbFS) MkdirAll(name string, perm stdfs.FileMode) error {
+	fs.mtx.RLock()
+	name = fs.abs(name)
+	fs.mtx.RUnlock()
+
+	dirpath := "/"
+	for _, p := range strings.Split(name, "/") {
+		dirpath = path.Join(dirpath, p)
+		if err := fs.Mkdir(dirpath, perm); err != nil && !errors.Is(err, stdfs.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *pbFS) Stat(name string) (stdfs.FileInfo, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	abs := fs.abs(name)
+	layer, _, err := fs.layer(abs)
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return layer.Stat(abs)
+}
+
+func (fs *pbFS) Lstat(name string) (stdfs.FileInfo, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	_, fi, err := fs.layer(fs.abs(name))
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return fi, nil
+}
+
+// Rename renames oldpath to newpath in the upper filesystem, copying
+// oldpath up first, along with its contents if it is a directory.
+func (fs *pbFS) Rename(oldpath, newpath string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	linkErr := &os.LinkError{Op: "rename", Old: oldpath, New: newpath}
+	oldabs, newabs := fs.abs(oldpath), fs.abs(newpath)
+
+	if err := fs.copyUpAll(oldabs); err != nil {
+		linkErr.Err = err
+		return linkErr
+	}
+	if _, fi, err := fs.layer(newabs); err == nil && fi.IsDir() {
+		linkErr.Err = syscall.EEXIST
+		return linkErr
+	}
+	if err := fs.copyUp(path.Dir(newabs)); err != nil {
+		linkErr.Err = err
+		return linkErr
+	}
+
+	if err := fs.upper.Rename(oldabs, newabs); err != nil {
+		return err
+	}
+
+	fi, err := fs.upper.Lstat(newabs)
+	if err != nil {
+		return err
+	}
+	_, lerr := fs.lower.Lstat(newabs)
+	shadows := lerr == nil && fs.inLower(newabs)
+	fs.hide(oldabs)
+	fs.unhide(newabs, fi.IsDir())
+	if fi.IsDir() && shadows {
+		// the contents of a lower directory of the same name must not
+		// show through the renamed directory
+		fs.opaque[newabs] = true
+	}
+
+	return nil
+}
+
+func (fs *pbFS) Remove(name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if abs == "/" {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	layer, fi, err := fs.layer(abs)
+	if err != nil {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if fi.IsDir() {
+		entries, err := fs.readDir(abs)
+		if err != nil {
+			return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if len(entries) != 0 {
+			return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if layer == fs.upper {
+		// a directory may still contain whited out files, which
+		// don't need to be kept
+		if err := fs.upper.RemoveAll(abs); err != nil {
+			return err
+		}
+	}
+	fs.hide(abs)
+
+	return nil
+}
+
+func (fs *pbFS) RemoveAll(name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if abs == "/" {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if err := fs.upper.RemoveAll(abs); err != nil {
+		return err
+	}
+	fs.hide(abs)
+
+	return nil
+}
+
+func (fs *pbFS) Truncate(name string, size int64) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if err := fs.copyUp(abs); err != nil {
+		return &stdfs.PathError{Op: "truncate", Path: name, Err: err}
+	}
+
+	return fs.upper.Truncate(abs, size)
+}
+
+func (fs *pbFS) Chmod(name string, mode stdfs.FileMode) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if err := fs.copyUp(abs); err != nil {
+		return &stdfs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	return fs.upper.Chmod(abs, mode)
+}
+
+func (fs *pbFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if err := fs.copyUp(abs); err != nil {
+		return &stdfs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	return fs.upper.Chtimes(abs, atime, mtime)
+}
+
+func (fs *pbFS) Chown(name string, uid, gid int) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	if err := fs.copyUp(abs); err != nil {
+		return &stdfs.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return fs.upper.Chown(abs, uid, gid)
+}
+
+func (fs *pbFS) WalkDir(root string, fn stdfs.WalkDirFunc) error {
+	fs.mtx.RLock()
+	abs := fs.abs(root)
+	fs.mtx.RUnlock()
+
+	if abs == "/" {
+		abs = "."
+	} else {
+		abs = abs[1:]
+	}
+
+	return stdfs.WalkDir(fs.FS(), abs, func(name string, d stdfs.DirEntry, err error) error {
+		return fn(path.Join("/", name), d, err)
+	})
+}
+
+func (fs *pbFS) Abs(p string) (string, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	return fs.abs(p), nil
+}
+
+func (fs *pbFS) Separator() uint8 {
+	return fs.upper.Separator()
+}
+
+func (fs *pbFS) ListSeparator() uint8 {
+	return fs.upper.ListSeparator()
+}
+
+func (fs *pbFS) Chdir(name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	abs := fs.abs(name)
+	layer, _, err := fs.layer(abs)
+	if err != nil {
+		return &stdfs.PathError{Op: "chdir", Path: name, Err: err}
+	}
+	// follow symbolic links
+	fi, err := layer.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &stdfs.PathError{Op: "chdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	fs.cwd = abs
+
+	return nil
+}
+
+func (fs *pbFS) Getwd() (dir string, err error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	return fs.cwd, nil
+}
+
+func (fs *pbFS) TempDir() string {
+	return fs.upper.TempDir()
+}
+
+// dirFile is a directory opened from one of the layers, whose entries
+// are read from both of them.
+type dirFile struct {
+	absfs.File
+
+	fs      *pbFS
+	name    string
+	entries []stdfs.DirEntry
+	read    bool
+}
+
+func (f *dirFile) ReadDir(n int) ([]stdfs.DirEntry, error) {
+	if !f.read {
+		f.fs.mtx.RLock()
+		entries, err := f.fs.readDir(f.name)
+		f.fs.mtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+
+	return entries, nil
+}
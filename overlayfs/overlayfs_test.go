@@ -0,0 +1,217 @@
+package overlayfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/ioutil"
+	"github.com/capnspacehook/pandorasbox/vfs"
+)
+
+// newOverlay returns an overlay of an empty VFS on top of a VFS holding
+// files.
+func newOverlay(t *testing.T, files map[string]string) (ofs, lower, upper absfs.FileSystem) {
+	t.Helper()
+
+	m := make(map[string]vfs.MapFile)
+	for name, data := range files {
+		m[name] = vfs.MapFile{Data: []byte(data)}
+	}
+	lower, err := vfs.FromMap(m)
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+	upper = vfs.NewFS()
+
+	return NewFS(lower, upper), lower, upper
+}
+
+func readDirNames(t *testing.T, fsys absfs.FileSystem, name string) string {
+	t.Helper()
+
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		t.Fatalf("ReadDir error: %s", err)
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+
+	return fmt.Sprint(names)
+}
+
+func TestReadThrough(t *testing.T) {
+	ofs, _, upper := newOverlay(t, map[string]string{
+		"base/a.txt":     "lower a",
+		"base/sub/b.txt": "lower b",
+	})
+
+	if b, err := ioutil.ReadFile(ofs, "/base/a.txt"); err != nil || string(b) != "lower a" {
+		t.Errorf("ReadFile = %q, %v; want %q", b, err, "lower a")
+	}
+	if err := ofs.Chdir("/base"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+	if b, err := ofs.ReadFile("sub/b.txt"); err != nil || string(b) != "lower b" {
+		t.Errorf("ReadFile of relative path = %q, %v; want %q", b, err, "lower b")
+	}
+	if _, err := upper.Stat("/base"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading copied files to the upper filesystem: %v", err)
+	}
+
+	// files in the upper filesystem take precedence
+	if err := upper.MkdirAll("/base", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(upper, "/base/a.txt", []byte("upper a"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(upper, "/base/c.txt", []byte("upper c"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if b, err := ofs.ReadFile("/base/a.txt"); err != nil || string(b) != "upper a" {
+		t.Errorf("ReadFile of shadowed file = %q, %v; want %q", b, err, "upper a")
+	}
+	if got, want := readDirNames(t, ofs, "/base"), "[a.txt c.txt sub]"; got != want {
+		t.Errorf("ReadDir = %s, want %s", got, want)
+	}
+
+	f, err := ofs.Open("/base")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	entries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil || len(entries) != 3 {
+		t.Errorf("ReadDir of opened directory returned %d entries, %v; want 3", len(entries), err)
+	}
+
+	if err := fstest.TestFS(ofs.FS(), "base/a.txt", "base/c.txt", "base/sub/b.txt"); err != nil {
+		t.Errorf("error testing overlay: %v", err)
+	}
+}
+
+func TestCopyUp(t *testing.T) {
+	ofs, lower, upper := newOverlay(t, map[string]string{
+		"base/a.txt": "lower a",
+		"base/b.txt": "lower b",
+	})
+
+	f, err := ofs.OpenFile("/base/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	if _, err := f.Write([]byte(" appended")); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	if b, err := ofs.ReadFile("/base/a.txt"); err != nil || string(b) != "lower a appended" {
+		t.Errorf("ReadFile after write = %q, %v; want %q", b, err, "lower a appended")
+	}
+	if b, err := upper.ReadFile("/base/a.txt"); err != nil || string(b) != "lower a appended" {
+		t.Errorf("ReadFile of upper copy = %q, %v; want %q", b, err, "lower a appended")
+	}
+	if b, err := lower.ReadFile("/base/a.txt"); err != nil || string(b) != "lower a" {
+		t.Errorf("lower file was modified: %q, %v", b, err)
+	}
+
+	if err := ofs.Truncate("/base/b.txt", 5); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	if b, err := ofs.ReadFile("/base/b.txt"); err != nil || string(b) != "lower" {
+		t.Errorf("ReadFile after truncate = %q, %v; want %q", b, err, "lower")
+	}
+
+	if err := ofs.Chmod("/base/b.txt", 0600); err != nil {
+		t.Fatalf("Chmod error: %s", err)
+	}
+	if fi, err := ofs.Stat("/base/b.txt"); err != nil || fi.Mode() != 0600 {
+		t.Errorf("Stat after Chmod: %v, %v; want mode %v", fi.Mode(), err, fs.FileMode(0600))
+	}
+	if fi, err := lower.Stat("/base/b.txt"); err != nil || fi.Mode() == 0600 {
+		t.Errorf("lower file mode was changed: %v, %v", fi.Mode(), err)
+	}
+
+	if err := ofs.WriteFile("/base/new/c.txt", nil, 0666); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WriteFile in nonexistent directory: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := ofs.MkdirAll("/base/new", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ofs.WriteFile("/base/new/c.txt", []byte("c"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if _, err := lower.Stat("/base/new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("lower filesystem was modified: %v", err)
+	}
+
+	if err := ofs.Rename("/base", "/renamed"); err != nil {
+		t.Fatalf("Rename error: %s", err)
+	}
+	if got, want := readDirNames(t, ofs, "/"), "[renamed]"; got != want {
+		t.Errorf("ReadDir of root after rename = %s, want %s", got, want)
+	}
+	if got, want := readDirNames(t, ofs, "/renamed"), "[a.txt b.txt new]"; got != want {
+		t.Errorf("ReadDir of renamed directory = %s, want %s", got, want)
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	ofs, lower, _ := newOverlay(t, map[string]string{
+		"base/a.txt":     "lower a",
+		"base/b.txt":     "lower b",
+		"base/sub/c.txt": "lower c",
+	})
+
+	if err := ofs.Remove("/base/a.txt"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if _, err := ofs.Stat("/base/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of removed file: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := lower.Stat("/base/a.txt"); err != nil {
+		t.Errorf("lower file was removed: %v", err)
+	}
+	if got, want := readDirNames(t, ofs, "/base"), "[b.txt sub]"; got != want {
+		t.Errorf("ReadDir after Remove = %s, want %s", got, want)
+	}
+
+	// recreating a removed file doesn't bring back its old contents
+	if err := ofs.WriteFile("/base/a.txt", []byte("new a"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if b, err := ofs.ReadFile("/base/a.txt"); err != nil || string(b) != "new a" {
+		t.Errorf("ReadFile of recreated file = %q, %v; want %q", b, err, "new a")
+	}
+
+	if err := ofs.Remove("/base/sub"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Remove of non-empty directory: got %v, want %v", err, syscall.ENOTEMPTY)
+	}
+	if err := ofs.RemoveAll("/base/sub"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+	if _, err := ofs.Stat("/base/sub/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of file in removed directory: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	// a directory recreated in place of a removed one starts out empty
+	if err := ofs.Mkdir("/base/sub", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if got, want := readDirNames(t, ofs, "/base/sub"), "[]"; got != want {
+		t.Errorf("ReadDir of recreated directory = %s, want %s", got, want)
+	}
+	if _, err := ofs.Stat("/base/sub/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of file in recreated directory: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -3,112 +3,167 @@ package pandorasbox
 import (
 	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/capnspacehook/pandorasbox/absfs"
 )
 
-var box *Box
+var (
+	box     *Box
+	boxOnce sync.Once
+)
+
+// GlobalBox returns the global Box used by the top-level functions of
+// this package, creating it the first time it is called. It is safe to
+// call from multiple goroutines.
+func GlobalBox() *Box {
+	boxOnce.Do(func() {
+		var err error
+		// the default configuration is always valid
+		if box, err = NewBox(); err != nil {
+			panic(err)
+		}
+	})
 
+	return box
+}
+
+// InitGlobalBox creates the global Box if it hasn't been already. Calling
+// it is not required, as the global Box is created when first used.
 func InitGlobalBox() {
-	box = NewBox()
+	GlobalBox()
 }
 
 func GlobalOSFS() absfs.FileSystem {
-	return box.osfs
+	return GlobalBox().osfs
 }
 
 func GlobalVFS() absfs.FileSystem {
-	return box.vfs
+	return GlobalBox().vfs
 }
 
 func Open(name string) (absfs.File, error) {
-	return box.Open(name)
+	return GlobalBox().Open(name)
 }
 
 func OpenFile(name string, flag int, perm fs.FileMode) (absfs.File, error) {
-	return box.OpenFile(name, flag, perm)
+	return GlobalBox().OpenFile(name, flag, perm)
 }
 
 func Create(name string) (absfs.File, error) {
-	return box.Create(name)
+	return GlobalBox().Create(name)
 }
 
 func ReadFile(filename string) ([]byte, error) {
-	return box.ReadFile(filename)
+	return GlobalBox().ReadFile(filename)
 }
 
 func ReadDir(dirname string) ([]os.DirEntry, error) {
-	return box.ReadDir(dirname)
+	return GlobalBox().ReadDir(dirname)
 }
 
 func WriteFile(filename string, data []byte, perm fs.FileMode) error {
-	return box.WriteFile(filename, data, perm)
+	return GlobalBox().WriteFile(filename, data, perm)
 }
 
 func Mkdir(name string, perm fs.FileMode) error {
-	return box.Mkdir(name, perm)
+	return GlobalBox().Mkdir(name, perm)
 }
 
 func MkdirAll(name string, perm fs.FileMode) error {
-	return box.MkdirAll(name, perm)
+	return GlobalBox().MkdirAll(name, perm)
 }
 
 func Stat(name string) (fs.FileInfo, error) {
-	return box.Stat(name)
+	return GlobalBox().Stat(name)
 }
 
 func Lstat(name string) (fs.FileInfo, error) {
-	return box.Lstat(name)
+	return GlobalBox().Lstat(name)
 }
 
 func Rename(oldpath, newpath string) error {
-	return box.Rename(oldpath, newpath)
+	return GlobalBox().Rename(oldpath, newpath)
+}
+
+func Symlink(oldname, newname string) error {
+	return GlobalBox().Symlink(oldname, newname)
+}
+
+func Readlink(name string) (string, error) {
+	return GlobalBox().Readlink(name)
 }
 
 func Remove(name string) error {
-	return box.Remove(name)
+	return GlobalBox().Remove(name)
 }
 
 func RemoveAll(path string) error {
-	return box.RemoveAll(path)
+	return GlobalBox().RemoveAll(path)
 }
 
 func Truncate(name string, size int64) error {
-	return box.Truncate(name, size)
+	return GlobalBox().Truncate(name, size)
+}
+
+func Chmod(name string, mode fs.FileMode) error {
+	return GlobalBox().Chmod(name, mode)
+}
+
+func Chtimes(name string, atime, mtime time.Time) error {
+	return GlobalBox().Chtimes(name, atime, mtime)
+}
+
+func Chown(name string, uid, gid int) error {
+	return GlobalBox().Chown(name, uid, gid)
+}
+
+func Glob(pattern string) ([]string, error) {
+	return GlobalBox().Glob(pattern)
+}
+
+func StatFS(name string) (total, used, free int64, err error) {
+	return GlobalBox().StatFS(name)
 }
 
 func WalkDir(root string, fn fs.WalkDirFunc) error {
-	return box.WalkDir(root, fn)
+	return GlobalBox().WalkDir(root, fn)
+}
+
+func Walk(root string, fn filepath.WalkFunc) error {
+	return GlobalBox().Walk(root, fn)
 }
 
 func Abs(path string) (string, error) {
-	return box.Abs(path)
+	return GlobalBox().Abs(path)
 }
 
 func Separator(vfs bool) uint8 {
-	return box.Separator(vfs)
+	return GlobalBox().Separator(vfs)
 }
 
 func ListSeparator(vfs bool) uint8 {
-	return box.ListSeparator(vfs)
+	return GlobalBox().ListSeparator(vfs)
 }
 
 func IsPathSeparator(c uint8, vfs bool) bool {
-	return box.IsPathSeparator(c, vfs)
+	return GlobalBox().IsPathSeparator(c, vfs)
 }
 
 func Chdir(dir string, vfs bool) error {
-	return box.Chdir(dir, vfs)
+	return GlobalBox().Chdir(dir, vfs)
 }
 
 func Getwd(vfs bool) (string, error) {
-	return box.Getwd(vfs)
+	return GlobalBox().Getwd(vfs)
 }
 
 func GetTempDir(vfs bool) string {
-	return box.GetTempDir(vfs)
+	return GlobalBox().GetTempDir(vfs)
 }
 
 func Close() {
-	box.Close()
+	GlobalBox().Close()
 }
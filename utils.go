@@ -9,18 +9,13 @@ import (
 	"github.com/capnspacehook/pandorasbox/vfs"
 )
 
+// VFSPrefix is the default prefix of paths that refer to files in the
+// VFS. The package-level path functions always use it, while the methods
+// of a Box use the prefix it was created with.
 const VFSPrefix = "vfs://"
 
 func ConvertVFSPath(path string) (string, bool) {
-	if IsVFSPath(path) {
-		return convertVFSPath(path), true
-	}
-
-	return path, false
-}
-
-func convertVFSPath(path string) string {
-	return strings.Replace(path, VFSPrefix, "/", 1)
+	return convertVFSPath(VFSPrefix, path)
 }
 
 func IsVFSPath(path string) bool {
@@ -28,15 +23,27 @@ func IsVFSPath(path string) bool {
 }
 
 func MakeVFSPath(path string) string {
-	if IsVFSPath(path) {
+	return makeVFSPath(VFSPrefix, path)
+}
+
+func convertVFSPath(prefix, path string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+
+	return strings.Replace(path, prefix, "/", 1), true
+}
+
+func makeVFSPath(prefix, path string) string {
+	if strings.HasPrefix(path, prefix) {
 		return path
 	}
 
 	if len(path) > 0 && path[0] != '/' {
-		return VFSPrefix + path
+		return prefix + path
 	}
 
-	return strings.Replace(path, "/", VFSPrefix, 1)
+	return strings.Replace(path, "/", prefix, 1)
 }
 
 func IsVFS(fi fs.FileInfo) bool {
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errBlockFull = errors.New("block full")
+
+// flateWriters holds flate writers for reuse, indexed by compression
+// level offset by flate.HuffmanOnly, as creating one is expensive.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+var flateReaders sync.Pool
+
+// fixedWriter writes into a buffer of fixed capacity, failing once it
+// is full instead of growing it. Unlike a bytes.Buffer, it never leaves
+// behind copies of what was written that haven't been wiped.
+type fixedWriter struct {
+	buf []byte
+}
+
+func (w *fixedWriter) Write(p []byte) (int, error) {
+	if len(p) > cap(w.buf)-len(w.buf) {
+		return 0, errBlockFull
+	}
+	w.buf = append(w.buf, p...)
+
+	return len(p), nil
+}
+
+// compress compresses src into dst at the given level and returns the
+// length of the compressed data. It reports false if the compressed data
+// wouldn't be smaller than src, in which case src should be stored as is.
+func compress(dst, src []byte, level int) (int, bool) {
+	out := &fixedWriter{buf: dst[: 0 : len(src)-1]}
+
+	pool := &flateWriters[level-flate.HuffmanOnly]
+	w, ok := pool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(out)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(out, level); err != nil {
+			return 0, false
+		}
+	}
+	defer func() {
+		// don't keep a reference to dst around
+		w.Reset(io.Discard)
+		pool.Put(w)
+	}()
+
+	if _, err := w.Write(src); err != nil {
+		return 0, false
+	}
+	if err := w.Close(); err != nil {
+		return 0, false
+	}
+
+	return len(out.buf), true
+}
+
+// decompress decompresses src into dst, which must be exactly the length
+// of the uncompressed data.
+func decompress(dst, src []byte) error {
+	in := bytes.NewReader(src)
+	r, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		if err := r.(flate.Resetter).Reset(in, nil); err != nil {
+			return err
+		}
+	} else {
+		r = flate.NewReader(in)
+	}
+	defer flateReaders.Put(r)
+
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return err
+	}
+
+	return r.Close()
+}
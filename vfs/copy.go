@@ -0,0 +1,102 @@
+package vfs
+
+import (
+	"io"
+	stdfs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// CopyFromOS recursively copies the host directory hostDir into the VFS
+// directory vfsDir, creating vfsDir if necessary. File modes and
+// modification times are preserved, and symbolic links are copied as
+// symbolic links to the same target. Irregular files such as sockets and
+// devices are skipped.
+func (fs *pbFS) CopyFromOS(hostDir, vfsDir string) error {
+	type times struct {
+		name  string
+		mtime time.Time
+	}
+	var fileTimes []times
+
+	err := filepath.WalkDir(hostDir, func(hostPath string, d stdfs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		name := path.Join(vfsDir, filepath.ToSlash(rel))
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode()
+		switch {
+		case mode.IsDir():
+			if err := fs.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			node, err := fs.lookup("mkdir", name, true)
+			if err != nil {
+				return err
+			}
+			fs.mtx.Lock()
+			node.Lock()
+			node.Mode = stdfs.ModeDir | fs.createMode(mode)
+			node.Unlock()
+			fs.mtx.Unlock()
+		case mode&stdfs.ModeSymlink != 0:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			return fs.Symlink(filepath.ToSlash(target), name)
+		case mode.IsRegular():
+			if err := fs.copyFileFromOS(hostPath, name, mode); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		fileTimes = append(fileTimes, times{name, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// copying files changes the times of their parent directories, so
+	// times are only set once every file has been copied
+	for _, t := range fileTimes {
+		if err := fs.Chtimes(t.name, time.Time{}, t.mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *pbFS) copyFileFromOS(hostPath, name string, mode stdfs.FileMode) error {
+	src, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
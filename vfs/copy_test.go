@@ -0,0 +1,75 @@
+package vfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyFromOS(t *testing.T) {
+	hostDir := t.TempDir()
+	files := map[string]string{
+		"readme.txt":         dots,
+		"sub/nested.txt":     abc,
+		"sub/deeper/x.txt":   dots + abc,
+		"sub/deeper/empty":   "",
+		"sub/deeper/exec.sh": "#!/bin/sh\n",
+	}
+	mtime := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	for name, data := range files {
+		hostPath := filepath.Join(hostDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(hostPath, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(hostPath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(hostDir, "sub/deeper/exec.sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("readme.txt", filepath.Join(hostDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// irregular files are skipped
+	if l, err := net.Listen("unix", filepath.Join(hostDir, "sock")); err == nil {
+		defer l.Close()
+	}
+
+	vfs := NewFS().(*pbFS)
+	if err := vfs.CopyFromOS(hostDir, "/copy"); err != nil {
+		t.Fatalf("CopyFromOS error: %s", err)
+	}
+
+	for name, data := range files {
+		hfi, err := os.Stat(filepath.Join(hostDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := vfs.Stat("/copy/" + name)
+		if err != nil {
+			t.Errorf("Stat error: %s", err)
+			continue
+		}
+		if fi.Mode() != hfi.Mode() || !fi.ModTime().Equal(hfi.ModTime()) {
+			t.Errorf("%s: mode, modtime = %v, %v; want %v, %v", name, fi.Mode(), fi.ModTime(), hfi.Mode(), hfi.ModTime())
+		}
+		if b, err := vfs.ReadFile("/copy/" + name); err != nil || string(b) != data {
+			t.Errorf("%s: contents = %q, %v; want %q", name, b, err, data)
+		}
+	}
+	if fi, err := vfs.Stat("/copy/sub"); err != nil || fi.Mode() != os.ModeDir|0750 {
+		t.Errorf("Stat of copied directory = %v, %v", fi, err)
+	}
+	if target, err := vfs.Readlink("/copy/link"); err != nil || target != "readme.txt" {
+		t.Errorf("Readlink of copied link = %q, %v", target, err)
+	}
+	if _, err := vfs.Lstat("/copy/sock"); !os.IsNotExist(err) {
+		t.Errorf("Lstat of socket: got %v, want not exist", err)
+	}
+}
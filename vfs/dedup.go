@@ -0,0 +1,123 @@
+package vfs
+
+import (
+	"sync"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/blake2b"
+)
+
+// dedupStore shares sealed blocks with identical plaintext between files.
+// Blocks are indexed by a MAC of their plaintext keyed with a secret
+// random key, so the index can't be used to confirm guesses of the
+// contents of a file. As sealed blocks are never modified, only replaced,
+// writing to a shared block gives the writing file a block of its own.
+type dedupStore struct {
+	mtx sync.Mutex
+
+	key    *memguard.LockedBuffer
+	blocks map[[blake2b.Size256]byte]*sealedBlock
+}
+
+func newDedupStore() *dedupStore {
+	key := memguard.NewBufferRandom(keySize)
+	key.Freeze()
+
+	return &dedupStore{
+		key:    key,
+		blocks: make(map[[blake2b.Size256]byte]*sealedBlock),
+	}
+}
+
+func (d *dedupStore) sum(plaintext []byte) ([blake2b.Size256]byte, error) {
+	var sum [blake2b.Size256]byte
+
+	h, err := blake2b.New256(d.key.Bytes())
+	if err != nil {
+		return sum, err
+	}
+	h.Write(plaintext)
+	h.Sum(sum[:0])
+
+	return sum, nil
+}
+
+// seal returns a block holding plaintext, sharing an existing block if
+// one has the same contents. Otherwise plaintext is sealed with
+// sealBlock.
+func (d *dedupStore) seal(plaintext []byte, sealBlock func([]byte) (*sealedBlock, error)) (*sealedBlock, error) {
+	sum, err := d.sum(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if b, ok := d.blocks[sum]; ok {
+		b.refs++
+		return b, nil
+	}
+
+	b, err := sealBlock(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	b.sum, b.refs = sum, 1
+	d.blocks[sum] = b
+
+	return b, nil
+}
+
+// reseal seals plaintext again even if a block with the same contents
+// exists, and shares the new block with files that write the same
+// contents afterwards. Files still holding the previous block keep it
+// until they are re-sealed themselves.
+func (d *dedupStore) reseal(plaintext []byte, sealBlock func([]byte) (*sealedBlock, error)) (*sealedBlock, error) {
+	sum, err := d.sum(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := sealBlock(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	b.sum, b.refs = sum, 1
+
+	d.mtx.Lock()
+	d.blocks[sum] = b
+	d.mtx.Unlock()
+
+	return b, nil
+}
+
+// release drops a reference to a block returned by seal or reseal,
+// removing it from the store once no files hold it. It reports whether
+// that was the last reference.
+func (d *dedupStore) release(b *sealedBlock) bool {
+	if b == nil {
+		return false
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	b.refs--
+	if b.refs > 0 {
+		return false
+	}
+	if d.blocks[b.sum] == b {
+		delete(d.blocks, b.sum)
+	}
+
+	return true
+}
+
+// len returns the number of distinct blocks in the store.
+func (d *dedupStore) len() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return len(d.blocks)
+}
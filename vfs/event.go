@@ -0,0 +1,84 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op describes a set of file operations. The names and values of the
+// operations mirror those of fsnotify.Op, so code already written
+// against fsnotify can handle VFS events by converting with
+// fsnotify.Op(op):
+//
+//	vfs.Create -> fsnotify.Create
+//	vfs.Write  -> fsnotify.Write
+//	vfs.Remove -> fsnotify.Remove
+//	vfs.Rename -> fsnotify.Rename
+//	vfs.Chmod  -> fsnotify.Chmod
+type Op uint32
+
+const (
+	// Create is a new file or directory being created.
+	Create Op = 1 << iota
+	// Write is a file being written to or truncated.
+	Write
+	// Remove is a file or directory being removed.
+	Remove
+	// Rename is a file or directory being moved to a new path. The
+	// event is reported for the old path.
+	Rename
+	// Chmod is the metadata of a file or directory being changed.
+	Chmod
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Write, "WRITE"},
+	{Remove, "REMOVE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+}
+
+// Has reports whether op contains all of the operations in o.
+func (op Op) Has(o Op) bool {
+	return op&o == o
+}
+
+// String returns the names of the operations in op separated by "|",
+// in the same format as fsnotify.Op.String.
+func (op Op) String() string {
+	var names []string
+	for _, n := range opNames {
+		if op.Has(n.op) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "[no events]"
+	}
+
+	return strings.Join(names, "|")
+}
+
+// Event is a change to a file or directory in the VFS. Its fields match
+// those of fsnotify.Event.
+type Event struct {
+	// Name is the absolute path of the file or directory.
+	Name string
+	// Op is the set of operations that triggered the event.
+	Op Op
+}
+
+// Has reports whether the event contains all of the operations in op.
+func (e Event) Has(op Op) bool {
+	return e.Op.Has(op)
+}
+
+// String returns a representation of the event in the same format as
+// fsnotify.Event.String.
+func (e Event) String() string {
+	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
+}
@@ -0,0 +1,133 @@
+package vfs
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEventOps(t *testing.T) {
+	// values of the corresponding fsnotify.Op constants
+	tests := []struct {
+		op       Op
+		fsnotify uint32
+		name     string
+	}{
+		{Create, 1, "CREATE"},
+		{Write, 2, "WRITE"},
+		{Remove, 4, "REMOVE"},
+		{Rename, 8, "RENAME"},
+		{Chmod, 16, "CHMOD"},
+	}
+
+	var all Op
+	for _, tt := range tests {
+		if uint32(tt.op) != tt.fsnotify {
+			t.Errorf("%s = %d, want %d", tt.name, tt.op, tt.fsnotify)
+		}
+		if s := tt.op.String(); s != tt.name {
+			t.Errorf("%s.String() = %q", tt.name, s)
+		}
+
+		e := Event{Name: "/file", Op: tt.op}
+		if !e.Has(tt.op) {
+			t.Errorf("Event with %s does not have %s", tt.name, tt.name)
+		}
+		if s := e.String(); !strings.HasPrefix(s, tt.name+" ") || !strings.HasSuffix(s, ` "/file"`) {
+			t.Errorf("Event.String() = %q", s)
+		}
+		for _, other := range tests {
+			if other.op != tt.op && e.Has(other.op) {
+				t.Errorf("Event with %s has %s", tt.name, other.name)
+			}
+		}
+		all |= tt.op
+	}
+
+	if s := all.String(); s != "CREATE|WRITE|REMOVE|RENAME|CHMOD" {
+		t.Errorf("String() of all ops = %q", s)
+	}
+	if s := Op(0).String(); s != "[no events]" {
+		t.Errorf("String() of no ops = %q", s)
+	}
+	if s := (Event{Name: "/file", Op: Create | Write}).String(); s != `CREATE|WRITE  "/file"` {
+		t.Errorf("Event.String() = %q", s)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := vfs.Chdir("/dir"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+
+	events, cancel := vfs.Watch()
+	defer cancel()
+
+	ops := []struct {
+		name string
+		fn   func() error
+	}{
+		{"WriteFile", func() error { return vfs.WriteFile("file", []byte(abc), 0666) }},
+		{"Truncate", func() error { return vfs.Truncate("/dir/file", 1) }},
+		{"Mkdir", func() error { return vfs.Mkdir("/dir/sub", 0777) }},
+		{"Rename", func() error { return vfs.Rename("file", "sub/renamed") }},
+		{"Remove", func() error { return vfs.Remove("/dir/sub/renamed") }},
+		{"RemoveAll", func() error { return vfs.RemoveAll("/dir") }},
+	}
+	for _, op := range ops {
+		if err := op.fn(); err != nil {
+			t.Fatalf("%s error: %s", op.name, err)
+		}
+	}
+	cancel()
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	want := []Event{
+		{Name: "/dir/file", Op: Create},
+		{Name: "/dir/file", Op: Write},
+		{Name: "/dir/file", Op: Write},
+		{Name: "/dir/sub", Op: Create},
+		{Name: "/dir/file", Op: Rename},
+		{Name: "/dir/sub/renamed", Op: Create},
+		{Name: "/dir/sub/renamed", Op: Remove},
+		{Name: "/dir", Op: Remove},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got events:\n%v\nwant:\n%v", got, want)
+	}
+
+	// changes after the watch is canceled aren't sent to the closed
+	// channel, and canceling again does nothing
+	if err := vfs.Mkdir("/other", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	cancel()
+}
+
+func TestWatchDrops(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	events, cancel := vfs.Watch()
+
+	// a watcher that doesn't receive doesn't block the VFS
+	for i := 0; i < 2*watchBuffer; i++ {
+		if err := vfs.WriteFile("/file", []byte(abc), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	cancel()
+
+	var n int
+	for range events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Errorf("received %d events, want %d", n, watchBuffer)
+	}
+}
@@ -0,0 +1,486 @@
+package vfs
+
+import (
+	"archive/tar"
+	"encoding/gob"
+	"errors"
+	"io"
+	stdfs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/awnumar/memguard/core"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/inode"
+)
+
+const (
+	exportMagic   = "pandorasbox-vfs"
+	exportVersion = 1
+)
+
+var errBadArchive = errors.New("not a VFS archive")
+
+// exportHeader is the first value in an exported VFS.
+type exportHeader struct {
+	Magic   string
+	Version int
+}
+
+// exportEntry is a single file in an exported VFS. Entries are written
+// in the order the tree is walked, so a directory always precedes the
+// files in it.
+type exportEntry struct {
+	Path  string
+	Mode  stdfs.FileMode
+	Ctime time.Time
+	Atime time.Time
+	Mtime time.Time
+
+	// Data is the contents of a regular file, or the target of a
+	// symbolic link.
+	Data []byte
+	// Link is the path of an earlier entry this entry is a hard link
+	// to. Only Path is set on hard link entries.
+	Link string
+	// Xattrs holds the extended attributes of the file.
+	Xattrs map[string][]byte
+}
+
+// Export writes a snapshot of the entire VFS to w, so that it can later
+// be restored with Import. The snapshot is a gob stream made up of an
+// exportHeader followed by an exportEntry for every file, directory and
+// symbolic link, starting with the root directory. File contents are
+// decrypted so the snapshot is portable, and so must be protected by
+// the caller.
+func (fs *pbFS) Export(w io.Writer) error {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(exportHeader{Magic: exportMagic, Version: exportVersion}); err != nil {
+		return err
+	}
+
+	var err error
+	linked := make(map[uint64]string)
+	walkInodes("/", fs.root, func(name string, node *inode.Inode) bool {
+		if first, ok := linked[node.Ino]; ok {
+			err = enc.Encode(exportEntry{Path: name, Link: first})
+			return err == nil
+		}
+		if !node.IsDir() {
+			linked[node.Ino] = name
+		}
+
+		node.RLock()
+		entry := exportEntry{
+			Path:   name,
+			Mode:   node.Mode,
+			Ctime:  node.Ctime,
+			Atime:  node.Atime,
+			Mtime:  node.Mtime,
+			Xattrs: copyXattrs(node.Xattrs),
+		}
+		node.RUnlock()
+		if !node.IsDir() {
+			if entry.Data, err = fs.data[int(node.Ino)].decrypt(); err != nil {
+				return false
+			}
+		}
+		err = enc.Encode(entry)
+		core.Wipe(entry.Data)
+
+		return err == nil
+	})
+
+	return err
+}
+
+// Import returns a new VFS restored from a snapshot written by Export.
+func Import(r io.Reader) (absfs.FileSystem, error) {
+	dec := gob.NewDecoder(r)
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Magic != exportMagic || header.Version != exportVersion {
+		return nil, errBadArchive
+	}
+
+	fs := newFS(Options{})
+	var entries []exportEntry
+	for {
+		var entry exportEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = fs.importEntry(&entry)
+		core.Wipe(entry.Data)
+		entry.Data = nil
+		if err != nil {
+			return nil, err
+		}
+		if entry.Link == "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	// set metadata last, as creating the files beneath a directory
+	// changes its times
+	for _, entry := range entries {
+		node, err := fs.lookup("import", entry.Path, false)
+		if err != nil {
+			return nil, err
+		}
+		node.Mode = entry.Mode
+		node.Ctime = entry.Ctime
+		node.Atime = entry.Atime
+		node.Mtime = entry.Mtime
+		node.Xattrs = entry.Xattrs
+	}
+
+	return fs, nil
+}
+
+// Clone returns an independent deep copy of the VFS, configured the same
+// way. The copy has its own inodes, and file contents are re-sealed under
+// new keys, so changes to either VFS never affect the other.
+func (fs *pbFS) Clone() (absfs.FileSystem, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	opts := Options{
+		KeyFunc:     fs.keyFunc,
+		MaxBytes:    fs.quota.max,
+		MaxInodes:   fs.maxInodes,
+		Compression: fs.compression,
+		Dedup:       fs.dedup != nil,
+
+		NoEncryption: fs.keyFunc == nil,
+		NoTimestamps: !fs.fixedTime.IsZero(),
+	}
+	if fs.spill != nil {
+		opts.SpillDir, opts.SpillThreshold = fs.spill.dir, fs.spill.threshold
+	}
+	if fs.trash != nil {
+		opts.TrashDir = fs.trash.dir
+	}
+	clone := newFS(opts)
+	if fs.trash != nil {
+		clone.trash.seq = fs.trash.seq
+		clone.trash.entries = append([]trashEntry(nil), fs.trash.entries...)
+	}
+
+	var err error
+	linked := make(map[uint64]string)
+	var nodes []*inode.Inode
+	var names []string
+	walkInodes("/", fs.root, func(name string, node *inode.Inode) bool {
+		if first, ok := linked[node.Ino]; ok {
+			err = clone.Link(first, name)
+			return err == nil
+		}
+		if !node.IsDir() {
+			linked[node.Ino] = name
+		}
+		nodes = append(nodes, node)
+		names = append(names, name)
+
+		err = fs.cloneEntry(clone, name, node)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// set metadata last, as creating the files beneath a directory
+	// changes its times
+	for i, node := range nodes {
+		c, err := clone.lookup("clone", names[i], false)
+		if err != nil {
+			return nil, err
+		}
+		node.RLock()
+		c.Mode = node.Mode
+		c.Ctime = node.Ctime
+		c.Atime = node.Atime
+		c.Mtime = node.Mtime
+		c.Xattrs = copyXattrs(node.Xattrs)
+		node.RUnlock()
+		c.SetFlag(inode.FlagImmutable, node.IsImmutable())
+	}
+	clone.cwd = fs.cwd
+	if clone.dir, err = clone.lookup("clone", fs.cwd, true); err != nil {
+		return nil, err
+	}
+	clone.umask = atomic.LoadUint32(&fs.umask)
+
+	return clone, nil
+}
+
+// cloneEntry creates a copy of the file node at name in clone. The
+// caller must hold fs.mtx for reading.
+func (fs *pbFS) cloneEntry(clone *pbFS, name string, node *inode.Inode) error {
+	switch {
+	case node == fs.root:
+		return nil
+	case node.IsDir():
+		return clone.Mkdir(name, node.Mode)
+	case node.Mode&stdfs.ModeSymlink != 0:
+		target, err := fs.readlink(node)
+		if err != nil {
+			return err
+		}
+		return clone.Symlink(target, name)
+	}
+
+	f, err := clone.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, node.Mode)
+	if err != nil {
+		return err
+	}
+	// stream the contents a block at a time
+	if err := fs.data[int(node.Ino)].writeTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(atomic.LoadInt64(&node.Size)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (fs *pbFS) importEntry(entry *exportEntry) error {
+	switch {
+	case entry.Link != "":
+		return fs.Link(entry.Link, entry.Path)
+	case entry.Path == "/" && entry.Mode.IsDir():
+		// the root directory always exists
+		return nil
+	case entry.Mode.IsDir():
+		return fs.Mkdir(entry.Path, entry.Mode)
+	case entry.Mode&stdfs.ModeSymlink != 0:
+		return fs.Symlink(string(entry.Data), entry.Path)
+	case entry.Mode.IsRegular():
+		f, err := fs.OpenFile(entry.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, entry.Mode)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(entry.Data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	return &stdfs.PathError{Op: "import", Path: entry.Path, Err: errBadArchive}
+}
+
+// WriteTar writes the file tree rooted at root to w as a tar archive,
+// with paths relative to root. Symbolic links are written as symlink
+// entries, and files with multiple hard links within the tree are
+// written once, with later links written as hard link entries. As with
+// Export, file contents are written decrypted.
+func (fs *pbFS) WriteTar(w io.Writer, root string) error {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	r, err := fs.resolve(root, true)
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return &stdfs.PathError{Op: "writetar", Path: root, Err: err}
+	}
+
+	tw := tar.NewWriter(w)
+	linked := make(map[uint64]string)
+	walkInodes(r.path, r.node, func(name string, node *inode.Inode) bool {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, r.path), "/")
+		if rel == "" {
+			// the root itself is only written if it is a file
+			if node.IsDir() {
+				return true
+			}
+			rel = r.name
+		}
+
+		var hdr *tar.Header
+		if first, ok := linked[node.Ino]; ok {
+			hdr = &tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     rel,
+				Linkname: first,
+				ModTime:  node.Mtime,
+			}
+			err = tw.WriteHeader(hdr)
+			return err == nil
+		}
+		if !node.IsDir() {
+			linked[node.Ino] = rel
+		}
+
+		var target string
+		if node.Mode&stdfs.ModeSymlink != 0 {
+			if target, err = fs.readlink(node); err != nil {
+				return false
+			}
+		}
+		if hdr, err = tar.FileInfoHeader(&FileInfo{path.Base(name), node}, target); err != nil {
+			return false
+		}
+		hdr.Name = rel
+		if node.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.AccessTime = node.Atime
+		hdr.ChangeTime = node.Ctime
+		if err = tw.WriteHeader(hdr); err != nil {
+			return false
+		}
+
+		if node.Mode.IsRegular() {
+			err = fs.data[int(node.Ino)].writeTo(tw)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// ReadTar extracts the tar archive read from r into the VFS, with paths
+// in the archive relative to the root directory. Parent directories are
+// created as needed if they are not in the archive before the files in
+// them. Existing files are replaced, rather than written through, so an
+// entry never changes the target of a symbolic link or the other links
+// to a file already at its path. Entries other than regular files,
+// directories, symbolic links and hard links are skipped.
+func (fs *pbFS) ReadTar(r io.Reader) error {
+	type times struct {
+		name         string
+		atime, mtime time.Time
+	}
+	var fileTimes []times
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Join("/", hdr.Name)
+		if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.removeForTar(name); err != nil {
+				return err
+			}
+			if err := fs.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			// the directory may have been created before its entry
+			// was read, so set its mode explicitly
+			node, err := fs.lookup("mkdir", name, false)
+			if err != nil {
+				return err
+			}
+			fs.mtx.Lock()
+			node.Lock()
+			node.Mode = stdfs.ModeDir | fs.createMode(mode)
+			node.Unlock()
+			fs.mtx.Unlock()
+		case tar.TypeSymlink:
+			if err := fs.removeForTar(name); err != nil {
+				return err
+			}
+			if err := fs.Symlink(hdr.Linkname, name); err != nil {
+				return err
+			}
+			// times can't be set on the link itself
+			continue
+		case tar.TypeLink:
+			target := path.Join("/", hdr.Linkname)
+			if target == name {
+				continue
+			}
+			if err := fs.removeForTar(name); err != nil {
+				return err
+			}
+			if err := fs.Link(target, name); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			if err := fs.removeForTar(name); err != nil {
+				return err
+			}
+			f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		fileTimes = append(fileTimes, times{name, hdr.AccessTime, hdr.ModTime})
+	}
+
+	// creating files changes the times of their parent directories,
+	// so times are only set once every file exists
+	for _, t := range fileTimes {
+		if err := fs.Chtimes(t.name, t.atime, t.mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeForTar removes the file at name so that an entry can be
+// extracted there. A symbolic link is removed rather than followed, even
+// if it points to a directory. Directories are left in place, so
+// extracting a non-directory over one fails.
+func (fs *pbFS) removeForTar(name string) error {
+	fi, err := fs.Lstat(name)
+	if errors.Is(err, stdfs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+
+	return fs.Remove(name)
+}
@@ -0,0 +1,577 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/inode"
+	"github.com/capnspacehook/pandorasbox/ioutil"
+)
+
+func TestExportImport(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0750); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.Mkdir("/sticky", 0777|os.ModeSticky); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	large := make([]byte, 2*blockSize+10)
+	rand.Read(large)
+	files := map[string][]byte{
+		"/file":      []byte(dots),
+		"/a/empty":   nil,
+		"/a/b/large": large,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(vfs, name, data, 0640); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	if err := vfs.Symlink("a/b/large", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Link("/file", "/a/hardlink"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := vfs.Export(&buf); err != nil {
+		t.Fatalf("Export error: %s", err)
+	}
+	imported, err := Import(&buf)
+	if err != nil {
+		t.Fatalf("Import error: %s", err)
+	}
+
+	var count int
+	err = vfs.WalkDir("/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		count++
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ifi, err := imported.Lstat(name)
+		if err != nil {
+			t.Errorf("Lstat of imported %q error: %s", name, err)
+			return nil
+		}
+		if fi.Mode() != ifi.Mode() || fi.Size() != ifi.Size() || !fi.ModTime().Equal(ifi.ModTime()) {
+			t.Errorf("%s: imported mode, size, modtime = %v, %d, %v; want %v, %d, %v",
+				name, ifi.Mode(), ifi.Size(), ifi.ModTime(), fi.Mode(), fi.Size(), fi.ModTime())
+		}
+
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := imported.(*pbFS).Readlink(name)
+			if err != nil || target != "a/b/large" {
+				t.Errorf("Readlink of imported %q = %q, %v", name, target, err)
+			}
+		case fi.Mode().IsRegular():
+			b, err := imported.ReadFile(name)
+			if err != nil {
+				t.Errorf("ReadFile of imported %q error: %s", name, err)
+			} else if want, _ := vfs.ReadFile(name); !bytes.Equal(b, want) {
+				t.Errorf("%s: imported contents differ", name)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %s", err)
+	}
+	if count != 9 {
+		t.Errorf("walked %d files, want 9", count)
+	}
+
+	// hard links must be restored as links to the same file
+	if links, err := imported.(*pbFS).LinksTo("/file"); err != nil || len(links) != 2 {
+		t.Errorf("LinksTo of imported file = %v, %v", links, err)
+	}
+
+	if _, err := Import(bytes.NewReader([]byte("not an archive"))); err == nil {
+		t.Errorf("Import of invalid archive: expected error")
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/root/a/b", 0750); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	large := make([]byte, blockSize+10)
+	rand.Read(large)
+	files := map[string][]byte{
+		"/root/file":      []byte(dots),
+		"/root/a/b/large": large,
+		"/outside":        []byte(abc),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(vfs, name, data, 0640); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	if err := vfs.Symlink("a/b/large", "/root/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Link("/root/file", "/root/a/hardlink"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := vfs.WriteTar(&buf, "/root"); err != nil {
+		t.Fatalf("WriteTar error: %s", err)
+	}
+
+	type entry struct {
+		typeflag byte
+		mode     int64
+		data     []byte
+		linkname string
+	}
+	want := map[string]entry{
+		"a/":         {tar.TypeDir, 0750, nil, ""},
+		"a/b/":       {tar.TypeDir, 0750, nil, ""},
+		"a/b/large":  {tar.TypeReg, 0640, large, ""},
+		"a/hardlink": {tar.TypeReg, 0640, []byte(dots), ""},
+		"file":       {tar.TypeLink, 0, nil, "a/hardlink"},
+		"link":       {tar.TypeSymlink, 0777, nil, "a/b/large"},
+	}
+
+	tr := tar.NewReader(&buf)
+	got := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar Next error: %s", err)
+		}
+		got[hdr.Name] = true
+
+		w, ok := want[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected tar entry %q", hdr.Name)
+			continue
+		}
+		if hdr.Typeflag != w.typeflag || hdr.Linkname != w.linkname {
+			t.Errorf("%s: typeflag, linkname = %c, %q; want %c, %q", hdr.Name, hdr.Typeflag, hdr.Linkname, w.typeflag, w.linkname)
+		}
+		if w.typeflag != tar.TypeLink && hdr.Mode != w.mode {
+			t.Errorf("%s: mode = %#o, want %#o", hdr.Name, hdr.Mode, w.mode)
+		}
+
+		fi, err := vfs.Lstat(path.Join("/root", hdr.Name))
+		if err != nil {
+			t.Fatalf("Lstat error: %s", err)
+		}
+		if d := hdr.ModTime.Sub(fi.ModTime()); d < -time.Second || d > time.Second {
+			t.Errorf("%s: modtime = %v, want %v", hdr.Name, hdr.ModTime, fi.ModTime())
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("tar Read error: %s", err)
+		}
+		if !bytes.Equal(data, w.data) {
+			t.Errorf("%s: contents differ", hdr.Name)
+		}
+	}
+	for name := range want {
+		if !got[name] {
+			t.Errorf("missing tar entry %q", name)
+		}
+	}
+
+	if err := vfs.WriteTar(io.Discard, "/nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WriteTar of nonexistent root: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	src := NewFS().(*pbFS)
+	if err := src.MkdirAll("/a/b", 0750); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	large := make([]byte, blockSize+10)
+	rand.Read(large)
+	files := map[string][]byte{
+		"/file":      []byte(dots),
+		"/a/b/large": large,
+		"/a/empty":   nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(src, name, data, 0640|os.ModeSetgid); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	if err := src.Symlink("a/b/large", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := src.Link("/file", "/a/hardlink"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	mtime := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	for _, name := range []string{"/a", "/a/b", "/a/b/large"} {
+		if err := src.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatalf("Chtimes error: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := src.WriteTar(&buf, "/"); err != nil {
+		t.Fatalf("WriteTar error: %s", err)
+	}
+	dst := NewFS().(*pbFS)
+	if err := dst.ReadTar(&buf); err != nil {
+		t.Fatalf("ReadTar error: %s", err)
+	}
+
+	err := src.WalkDir("/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := src.Lstat(name)
+		if err != nil {
+			return err
+		}
+		dfi, err := dst.Lstat(name)
+		if err != nil {
+			t.Errorf("Lstat of extracted %q error: %s", name, err)
+			return nil
+		}
+		if fi.Mode() != dfi.Mode() || fi.Size() != dfi.Size() {
+			t.Errorf("%s: extracted mode, size = %v, %d; want %v, %d", name, dfi.Mode(), dfi.Size(), fi.Mode(), fi.Size())
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 && name != "/" {
+			if d := dfi.ModTime().Sub(fi.ModTime()); d < -time.Second || d > time.Second {
+				t.Errorf("%s: extracted modtime = %v, want %v", name, dfi.ModTime(), fi.ModTime())
+			}
+		}
+		if fi.Mode().IsRegular() {
+			want, _ := src.ReadFile(name)
+			if b, err := dst.ReadFile(name); err != nil || !bytes.Equal(b, want) {
+				t.Errorf("%s: extracted contents differ (%v)", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %s", err)
+	}
+
+	if target, err := dst.Readlink("/link"); err != nil || target != "a/b/large" {
+		t.Errorf("Readlink of extracted link = %q, %v", target, err)
+	}
+	if links, err := dst.LinksTo("/file"); err != nil || len(links) != 2 {
+		t.Errorf("LinksTo of extracted file = %v, %v", links, err)
+	}
+
+	// entries may arrive before their parent directories
+	buf.Reset()
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "x/y/file", Mode: 0600, Size: int64(len(abc))})
+	tw.Write([]byte(abc))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "x/", Mode: 0700})
+	tw.Close()
+	if err := dst.ReadTar(&buf); err != nil {
+		t.Fatalf("ReadTar error: %s", err)
+	}
+	if b, err := dst.ReadFile("/x/y/file"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile of extracted file = %q, %v", b, err)
+	}
+	if fi, err := dst.Stat("/x"); err != nil || fi.Mode() != fs.ModeDir|0700 {
+		t.Errorf("Stat of extracted directory = %v, %v", fi, err)
+	}
+}
+
+func TestReadTarReplace(t *testing.T) {
+	dst := NewFS().(*pbFS)
+	for name, data := range map[string]string{
+		"/target":   "target",
+		"/file":     "file",
+		"/linked":   "linked",
+		"/existing": "existing",
+	} {
+		if err := ioutil.WriteFile(dst, name, []byte(data), 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	if err := dst.Symlink("target", "/symlink"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := dst.Link("/linked", "/other"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "symlink", Mode: 0600, Size: int64(len(abc))},
+		{Typeflag: tar.TypeReg, Name: "linked", Mode: 0600, Size: int64(len(abc))},
+		{Typeflag: tar.TypeSymlink, Name: "file", Linkname: "target"},
+		{Typeflag: tar.TypeLink, Name: "existing", Linkname: "linked"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader error: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(abc))
+		}
+	}
+	tw.Close()
+	if err := dst.ReadTar(&buf); err != nil {
+		t.Fatalf("ReadTar error: %s", err)
+	}
+
+	// a file replaces a symbolic link instead of writing to its target
+	if fi, err := dst.Lstat("/symlink"); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("Lstat of file extracted over a symlink = %v, %v", fi, err)
+	}
+	if b, err := dst.ReadFile("/target"); err != nil || string(b) != "target" {
+		t.Errorf("target of replaced symlink = %q, %v; want %q", b, err, "target")
+	}
+	// a file replaces one link to a file, leaving the others
+	if b, err := dst.ReadFile("/linked"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile of file extracted over a hard link = %q, %v; want %q", b, err, abc)
+	}
+	if b, err := dst.ReadFile("/other"); err != nil || string(b) != "linked" {
+		t.Errorf("other link to replaced file = %q, %v; want %q", b, err, "linked")
+	}
+	// links replace existing files
+	if target, err := dst.Readlink("/file"); err != nil || target != "target" {
+		t.Errorf("Readlink of symlink extracted over a file = %q, %v; want %q", target, err, "target")
+	}
+	if links, err := dst.LinksTo("/linked"); err != nil || len(links) != 2 {
+		t.Errorf("LinksTo of hard link extracted over a file = %v, %v", links, err)
+	}
+	if b, err := dst.ReadFile("/existing"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile of hard link extracted over a file = %q, %v; want %q", b, err, abc)
+	}
+}
+
+func TestReadTarDirOverSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "real/", Mode: 0750},
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "real"},
+		{Typeflag: tar.TypeDir, Name: "link/", Mode: 0700},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader error: %s", err)
+		}
+	}
+	tw.Close()
+
+	dst := NewFS().(*pbFS)
+	if err := dst.ReadTar(&buf); err != nil {
+		t.Fatalf("ReadTar error: %s", err)
+	}
+
+	// a directory replaces a symbolic link to a directory instead of
+	// changing the mode of the link or its target
+	if fi, err := dst.Lstat("/link"); err != nil || fi.Mode() != fs.ModeDir|0700 {
+		t.Errorf("Lstat of directory extracted over a symlink = %v, %v", fi, err)
+	}
+	if fi, err := dst.Lstat("/real"); err != nil || fi.Mode() != fs.ModeDir|0750 {
+		t.Errorf("Lstat of symlink target = %v, %v", fi, err)
+	}
+	// unlike a symlink given a directory's mode, a real directory has
+	// an entry for its parent
+	if _, err := dst.Stat("/link/.."); err != nil {
+		t.Errorf("Stat of parent of extracted directory: %s", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0750); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	large := make([]byte, 2*blockSize+10)
+	rand.Read(large)
+	if err := ioutil.WriteFile(vfs, "/a/b/large", large, 0640); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/file", []byte(dots), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Link("/file", "/a/hardlink"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	if err := vfs.Symlink("a/b/large", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Chdir("/a"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+
+	c, err := vfs.Clone()
+	if err != nil {
+		t.Fatalf("Clone error: %s", err)
+	}
+	clone := c.(*pbFS)
+
+	if b, err := clone.ReadFile("b/large"); err != nil || !bytes.Equal(b, large) {
+		t.Errorf("ReadFile of cloned file relative to cwd failed: %v", err)
+	}
+	if b, err := clone.ReadFile("/link"); err != nil || !bytes.Equal(b, large) {
+		t.Errorf("ReadFile of cloned symlink failed: %v", err)
+	}
+	fi, err := clone.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	if fi.Mode() != 0600 {
+		t.Errorf("cloned file has mode %v, want %v", fi.Mode(), fs.FileMode(0600))
+	}
+	if nlink := fi.Sys().(*inode.Inode).Nlink; nlink != 2 {
+		t.Errorf("cloned file has %d links, want 2", nlink)
+	}
+	if clone.root == vfs.root {
+		t.Error("clone shares its root inode with the source")
+	}
+
+	// writes to the clone don't affect the source and vice versa
+	if err := ioutil.WriteFile(clone, "/file", []byte("clone"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/a/b/large", []byte("source"), 0640); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/a/hardlink"); err != nil || string(b) != dots {
+		t.Errorf("source file changed after writing to clone: %q, %v", b, err)
+	}
+	if b, err := clone.ReadFile("/a/hardlink"); err != nil || string(b) != "clone" {
+		t.Errorf("hard link in clone = %q, %v; want %q", b, err, "clone")
+	}
+	if b, err := clone.ReadFile("/a/b/large"); err != nil || !bytes.Equal(b, large) {
+		t.Errorf("cloned file changed after writing to source: %v", err)
+	}
+}
+
+func TestCloneNoEncryption(t *testing.T) {
+	vfs, err := NewFSWithOptions(Options{NoEncryption: true})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/file", []byte(abc), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	clone, err := vfs.(*pbFS).Clone()
+	if err != nil {
+		t.Fatalf("Clone error: %s", err)
+	}
+	if err := ioutil.WriteFile(clone, "/new", []byte(abc), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	for _, name := range []string{"/file", "/new"} {
+		if b := sealedData(t, clone, name).blocks[0]; b.key != nil {
+			t.Errorf("%s is encrypted in a clone of a VFS without encryption", name)
+		}
+	}
+}
+
+func TestXattrRoundTrip(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/file", []byte(dots), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	xattrs := map[string]string{
+		"/dir":      "user.dir",
+		"/dir/file": "user.file",
+	}
+	for name, key := range xattrs {
+		if err := vfs.Setxattr(name, key, []byte(name)); err != nil {
+			t.Fatalf("Setxattr error: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := vfs.Export(&buf); err != nil {
+		t.Fatalf("Export error: %s", err)
+	}
+	imported, err := Import(&buf)
+	if err != nil {
+		t.Fatalf("Import error: %s", err)
+	}
+	cloned, err := vfs.Clone()
+	if err != nil {
+		t.Fatalf("Clone error: %s", err)
+	}
+
+	for _, fsys := range []*pbFS{imported.(*pbFS), cloned.(*pbFS)} {
+		for name, key := range xattrs {
+			if value, err := fsys.Getxattr(name, key); err != nil || string(value) != name {
+				t.Errorf("Getxattr(%q, %q) = %q, %v; want %q", name, key, value, err, name)
+			}
+			if keys, err := fsys.Listxattr(name); err != nil || len(keys) != 1 {
+				t.Errorf("Listxattr(%q) = %q, %v; want [%q]", name, keys, err, key)
+			}
+		}
+	}
+
+	// the clone's attributes are its own
+	if err := cloned.(*pbFS).Setxattr("/dir/file", "user.file", []byte("clone")); err != nil {
+		t.Fatalf("Setxattr error: %s", err)
+	}
+	if value, err := vfs.Getxattr("/dir/file", "user.file"); err != nil || string(value) != "/dir/file" {
+		t.Errorf("source attribute changed after setting it in clone: %q, %v", value, err)
+	}
+}
+
+func TestCloneTrash(t *testing.T) {
+	fsys, err := NewFSWithOptions(Options{TrashDir: "/.trash"})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	vfs := fsys.(*pbFS)
+	if err := ioutil.WriteFile(vfs, "/file", []byte(dots), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+
+	c, err := vfs.Clone()
+	if err != nil {
+		t.Fatalf("Clone error: %s", err)
+	}
+	clone := c.(*pbFS)
+	if err := clone.Restore("/file"); err != nil {
+		t.Fatalf("Restore in clone error: %s", err)
+	}
+	if b, err := clone.ReadFile("/file"); err != nil || string(b) != dots {
+		t.Errorf("ReadFile of restored file = %q, %v; want %q", b, err, dots)
+	}
+	if _, err := vfs.Stat("/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat in source after restoring in clone: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	// removing from the clone moves files to its trash too
+	if err := clone.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if err := clone.Restore("/file"); err != nil {
+		t.Errorf("Restore of file removed in clone error: %s", err)
+	}
+}
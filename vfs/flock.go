@@ -0,0 +1,113 @@
+package vfs
+
+import (
+	"io/fs"
+	"sync"
+	"syscall"
+
+	"github.com/capnspacehook/pandorasbox/inode"
+)
+
+// flocks holds the advisory locks of the files in a VFS, keyed by their
+// inodes, so every name and handle of a file shares the same lock.
+type flocks struct {
+	mtx  sync.Mutex
+	held map[*inode.Inode]*flock
+}
+
+// flock is an advisory lock held by an open file.
+type flock struct {
+	owner    *file
+	released chan struct{} // closed once the lock is released
+}
+
+// acquire locks node for f, waiting until it's released by any other
+// file holding it if wait is true. It reports whether f holds the lock.
+func (l *flocks) acquire(node *inode.Inode, f *file, wait bool) bool {
+	for {
+		l.mtx.Lock()
+		lk, ok := l.held[node]
+		if !ok {
+			if l.held == nil {
+				l.held = make(map[*inode.Inode]*flock)
+			}
+			l.held[node] = &flock{owner: f, released: make(chan struct{})}
+			l.mtx.Unlock()
+			return true
+		}
+		l.mtx.Unlock()
+
+		if lk.owner == f {
+			return true
+		}
+		if !wait {
+			return false
+		}
+		<-lk.released
+	}
+}
+
+// release unlocks node if f holds its lock.
+func (l *flocks) release(node *inode.Inode, f *file) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if lk, ok := l.held[node]; ok && lk.owner == f {
+		delete(l.held, node)
+		close(lk.released)
+	}
+}
+
+// Lock places an advisory exclusive lock on the file, as flock(2) with
+// LOCK_EX does, waiting until no other handle holds it. The lock belongs
+// to this handle and is shared by every name of the file. It only
+// excludes others that lock the file too, and is released by Unlock or
+// when the handle is closed. Locking a file the handle already holds a
+// lock on does nothing.
+func (f *file) Lock() error {
+	node, err := f.lockNode("lock")
+	if err != nil {
+		return err
+	}
+	f.fs.flocks.acquire(node, f, true)
+
+	return nil
+}
+
+// TryLock is like Lock, but fails with EWOULDBLOCK instead of waiting if
+// another handle holds the lock.
+func (f *file) TryLock() error {
+	node, err := f.lockNode("trylock")
+	if err != nil {
+		return err
+	}
+	if !f.fs.flocks.acquire(node, f, false) {
+		return &fs.PathError{Op: "trylock", Path: f.name, Err: syscall.EWOULDBLOCK}
+	}
+
+	return nil
+}
+
+// Unlock releases the advisory lock the handle holds on the file, if
+// any.
+func (f *file) Unlock() error {
+	node, err := f.lockNode("unlock")
+	if err != nil {
+		return err
+	}
+	f.fs.flocks.release(node, f)
+
+	return nil
+}
+
+func (f *file) lockNode(op string) (*inode.Inode, error) {
+	f.mtx.RLock()
+	node := f.node
+	f.mtx.RUnlock()
+
+	if node == nil {
+		return nil, &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return node, nil
+}
@@ -0,0 +1,193 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/osfs"
+)
+
+// fuzzNames are the names operations are applied to by FuzzVFSvsOS.
+var fuzzNames = []string{"a", "b", "a/b", "a/c", "b/a", "a/b/c"}
+
+// errClass returns the kind of error err is, so that errors from
+// different filesystems can be compared.
+func errClass(err error) string {
+	if err == nil {
+		return "nil"
+	}
+	for _, target := range []error{
+		syscall.ENOTDIR,
+		syscall.EISDIR,
+		syscall.ENOTEMPTY,
+		syscall.EINVAL,
+		fs.ErrNotExist,
+		fs.ErrExist,
+		fs.ErrPermission,
+	} {
+		if errors.Is(err, target) {
+			return target.Error()
+		}
+	}
+
+	return "other"
+}
+
+// fuzzOp applies the operation encoded by op and args to fsys, with every
+// name prefixed by root, and returns its result.
+func fuzzOp(fsys absfs.FileSystem, root string, op, arg1, arg2 byte) string {
+	name := path.Join(root, fuzzNames[int(arg1)%len(fuzzNames)])
+	other := path.Join(root, fuzzNames[int(arg2)%len(fuzzNames)])
+
+	var err error
+	switch op % 7 {
+	case 0:
+		err = fsys.WriteFile(name, bytes.Repeat([]byte{arg2}, int(arg2%16)), 0644)
+	case 1:
+		err = fsys.Mkdir(name, 0755)
+	case 2:
+		err = fsys.MkdirAll(name, 0755)
+	case 3:
+		err = fsys.Remove(name)
+	case 4:
+		err = fsys.RemoveAll(name)
+	case 5:
+		if name == other {
+			// os.Rename refuses to rename a directory to itself, while
+			// the VFS treats it as a no-op like any other self-rename
+			return "skip"
+		}
+		err = fsys.Rename(name, other)
+	case 6:
+		err = fsys.Truncate(name, int64(arg2%32))
+	}
+
+	return errClass(err)
+}
+
+// fuzzState describes the files in fsys named by fuzzNames, with every
+// name prefixed by root.
+func fuzzState(fsys absfs.FileSystem, root string) string {
+	var b bytes.Buffer
+	for _, name := range fuzzNames {
+		full := path.Join(root, name)
+		fi, err := fsys.Stat(full)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %s\n", name, errClass(err))
+			continue
+		}
+		if !fi.IsDir() {
+			data, err := fsys.ReadFile(full)
+			fmt.Fprintf(&b, "%s: file %d %q %s\n", name, fi.Size(), data, errClass(err))
+			continue
+		}
+		entries, err := fsys.ReadDir(full)
+		fmt.Fprintf(&b, "%s: dir", name)
+		for _, e := range entries {
+			fmt.Fprintf(&b, " %s", e.Name())
+		}
+		fmt.Fprintf(&b, " %s\n", errClass(err))
+	}
+
+	return b.String()
+}
+
+func FuzzVFSvsOS(f *testing.F) {
+	f.Add([]byte{0, 0, 0})
+	f.Add([]byte{1, 0, 0, 0, 2, 5})
+	f.Add([]byte{2, 5, 0, 3, 0, 0, 4, 0, 0})
+	f.Add([]byte{1, 0, 0, 0, 2, 9, 5, 0, 1, 6, 1, 20})
+	f.Add([]byte{1, 0, 0, 1, 1, 0, 5, 0, 1, 5, 1, 2})
+	f.Add([]byte{0, 1, 3, 1, 0, 0, 3, 0, 0, 5, 1, 0})
+	f.Add([]byte("200110Y010"))
+	f.Add([]byte("100A00"))
+	f.Add([]byte("100Y12"))
+	f.Add([]byte("000200120Y02"))
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		// bound the number of operations to keep runs fast
+		const maxOps = 16
+		if len(ops) > 3*maxOps {
+			ops = ops[:3*maxOps]
+		}
+
+		vfs := NewFS()
+		host := osfs.NewFS()
+		dir := t.TempDir()
+		for i := 0; i+2 < len(ops); i += 3 {
+			op, arg1, arg2 := ops[i], ops[i+1], ops[i+2]
+			got := fuzzOp(vfs, "/", op, arg1, arg2)
+			want := fuzzOp(host, dir, op, arg1, arg2)
+			if got != want {
+				t.Fatalf("op %d (%d %d %d): VFS returned %s, OS returned %s", i/3, op%7, arg1, arg2, got, want)
+			}
+
+			if got, want := fuzzState(vfs, "/"), fuzzState(host, dir); got != want {
+				t.Fatalf("after op %d (%d %d %d):\nVFS:\n%s\nOS:\n%s", i/3, op%7, arg1, arg2, got, want)
+			}
+		}
+	})
+}
+
+// fuzzFileOp applies the operation encoded by op and off to f. Its errors
+// are ignored, only panics matter.
+func fuzzFileOp(f absfs.File, op byte, off int64) {
+	buf := make([]byte, int(op>>3)%64)
+	switch op % 8 {
+	case 0:
+		f.Seek(off, int(op>>3)%4)
+	case 1:
+		f.Read(buf)
+	case 2:
+		f.ReadAt(buf, off)
+	case 3:
+		f.Write(buf)
+	case 4:
+		f.WriteAt(buf, off)
+	case 5:
+		f.Truncate(off)
+	case 6:
+		f.Stat()
+	case 7:
+		f.ReadDir(int(off))
+	}
+}
+
+// FuzzFileNoPanic checks that no sequence of calls to the methods of an
+// open file panics, whatever offsets and sizes are passed to them.
+func FuzzFileNoPanic(f *testing.F) {
+	f.Add([]byte{0}, int64(-1))
+	f.Add([]byte{8, 3}, int64(math.MaxInt64))
+	f.Add([]byte{4}, int64(math.MaxInt64-1))
+	f.Add([]byte{5, 1}, int64(-1))
+	f.Add([]byte{2, 4}, int64(math.MinInt64))
+	f.Add([]byte{0, 3, 24, 1}, int64(maxFileSize))
+
+	f.Fuzz(func(t *testing.T, ops []byte, off int64) {
+		const maxOps = 32
+		if len(ops) > maxOps {
+			ops = ops[:maxOps]
+		}
+
+		vfs := NewFS()
+		file, err := vfs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		for i, op := range ops {
+			// vary the offset between operations so sequences can
+			// reach offsets near it from both sides
+			fuzzFileOp(file, op, off+int64(i)-maxOps/2)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether name matches the shell pattern, as path.Match
+// does. Paths in the VFS always use forward slashes, so unlike
+// filepath.Match it behaves the same on every OS.
+func Match(pattern, name string) (bool, error) {
+	return path.Match(pattern, name)
+}
+
+// Glob returns the names of all files in the VFS matching pattern, or nil
+// if there is no matching file. The syntax of patterns is the same as in
+// Match. Relative patterns are matched from the working directory, and
+// return relative names.
+//
+// The tree is searched one directory at a time: elements of the pattern
+// without any special characters are looked up directly, and only the
+// directories matching the preceding elements are read. Symbolic links to
+// directories are followed. The only possible returned error is
+// path.ErrBadPattern, when pattern is malformed.
+func (fs *pbFS) Glob(pattern string) ([]string, error) {
+	// check the pattern is well-formed
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	elems := splitPath(pattern)
+	if len(elems) == 0 {
+		if path.IsAbs(pattern) {
+			return []string{"/"}, nil
+		}
+		return nil, nil
+	}
+
+	var matches []string
+	if path.IsAbs(pattern) {
+		fs.glob("/", fs.root, elems, &matches)
+	} else {
+		fs.glob("", fs.dir, elems, &matches)
+	}
+
+	return matches, nil
+}
+
+// Glob returns the names of all files in the scope matching pattern, as
+// (*pbFS).Glob does. ".." elements of the pattern can't refer to files
+// outside of the scope.
+func (fs *scopedFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		return nil, nil
+	}
+
+	cwd, _ := fs.Getwd()
+	abs := path.IsAbs(pattern)
+	base, up := "/", ""
+	if !abs {
+		// leading ".." elements are kept in the matches as they were
+		// given, as long as they don't climb above the scope
+		base = cwd
+		for strings.HasPrefix(pattern, "../") || pattern == ".." {
+			if base != "/" {
+				base = path.Dir(base)
+				up = path.Join(up, "..")
+			}
+			pattern = strings.TrimPrefix(pattern[2:], "/")
+		}
+	}
+	// join the pattern to its base before the scope's directory, so that
+	// any other ".." elements can't climb above the scope either
+	pattern = path.Join(escapeMeta(base), pattern)
+	matches, err := fs.fs.Glob(path.Join(escapeMeta(fs.dir), pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	// make the matches relative to the scope, and for relative patterns
+	// to the working directory
+	for i, m := range matches {
+		m = path.Join("/", strings.TrimPrefix(m, fs.dir))
+		if !abs {
+			m = path.Join(up, relPath(base, m))
+		}
+		matches[i] = m
+	}
+
+	return matches, nil
+}
+
+// relPath returns target relative to base. Both must be clean absolute
+// paths.
+func relPath(base, target string) string {
+	belems, telems := splitPath(base), splitPath(target)
+	i := 0
+	for i < len(belems) && i < len(telems) && belems[i] == telems[i] {
+		i++
+	}
+
+	elems := make([]string, 0, len(belems)-i+len(telems)-i)
+	for range belems[i:] {
+		elems = append(elems, "..")
+	}
+	elems = append(elems, telems[i:]...)
+	if len(elems) == 0 {
+		return "."
+	}
+
+	return path.Join(elems...)
+}
@@ -0,0 +1,91 @@
+package vfs
+
+import (
+	stdfs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"testing/fstest"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+)
+
+// A MapFile describes a single file in a map passed to FromMap.
+type MapFile struct {
+	Data    []byte         // file contents, or the target of a symbolic link
+	Mode    stdfs.FileMode // file mode, including type bits
+	ModTime time.Time      // modification time, left as the time of creation if zero
+}
+
+// FromMap returns a new VFS populated with files, which maps slash
+// separated paths to the files to create at them, similar to an
+// fstest.MapFS. Parent directories that are not in the map are created
+// with mode 0755.
+func FromMap(files map[string]MapFile) (absfs.FileSystem, error) {
+	fs := newFS(Options{})
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	// parent directories sort before the files in them
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := fs.createMapFile(path.Join("/", name), files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	// creating files changes the times of their parent directories,
+	// so times are only set once every file exists
+	for _, name := range names {
+		if mtime := files[name].ModTime; !mtime.IsZero() {
+			if err := fs.Chtimes(path.Join("/", name), mtime, mtime); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return fs, nil
+}
+
+// FromMapFS returns a new VFS populated with the files in m. Parent
+// directories that are not in m are created with mode 0755.
+func FromMapFS(m fstest.MapFS) (absfs.FileSystem, error) {
+	files := make(map[string]MapFile, len(m))
+	for name, file := range m {
+		files[name] = MapFile{
+			Data:    file.Data,
+			Mode:    file.Mode,
+			ModTime: file.ModTime,
+		}
+	}
+
+	return FromMap(files)
+}
+
+func (fs *pbFS) createMapFile(name string, file MapFile) error {
+	if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case file.Mode.IsDir():
+		return fs.Mkdir(name, file.Mode.Perm())
+	case file.Mode&stdfs.ModeSymlink != 0:
+		return fs.Symlink(string(file.Data), name)
+	}
+
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.Mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(file.Data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
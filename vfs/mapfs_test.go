@@ -0,0 +1,124 @@
+package vfs
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/vfs/vfstest"
+)
+
+func TestFromMap(t *testing.T) {
+	mtime := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	files := map[string]MapFile{
+		"readme.txt":     {Data: []byte(dots), Mode: 0644, ModTime: mtime},
+		"bin/run":        {Data: []byte(abc), Mode: 0755 | fs.ModeSetuid, ModTime: mtime.Add(time.Hour)},
+		"data/empty.txt": {Mode: 0600},
+		"data":           {Mode: fs.ModeDir | 0700, ModTime: mtime.Add(-time.Hour)},
+	}
+	vfs, err := FromMap(files)
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+
+	for name, file := range files {
+		fi, err := vfs.Stat("/" + name)
+		if err != nil {
+			t.Fatalf("Stat error: %s", err)
+		}
+		if fi.Mode() != file.Mode {
+			t.Errorf("%s: mode = %v, want %v", name, fi.Mode(), file.Mode)
+		}
+		if !file.ModTime.IsZero() && !fi.ModTime().Equal(file.ModTime) {
+			t.Errorf("%s: modtime = %v, want %v", name, fi.ModTime(), file.ModTime)
+		}
+		if fi.IsDir() {
+			continue
+		}
+
+		b, err := vfs.ReadFile("/" + name)
+		if err != nil {
+			t.Fatalf("ReadFile error: %s", err)
+		}
+		if string(b) != string(file.Data) {
+			t.Errorf("%s: contents = %q, want %q", name, b, file.Data)
+		}
+	}
+
+	// parent directories are created implicitly
+	if fi, err := vfs.Stat("/bin"); err != nil {
+		t.Errorf("Stat error: %s", err)
+	} else if fi.Mode() != fs.ModeDir|0755 {
+		t.Errorf("bin: mode = %v, want %v", fi.Mode(), fs.ModeDir|0755)
+	}
+
+	vfstest.AssertManifest(t, vfs, map[string]vfstest.ManifestEntry{
+		"readme.txt":     {Size: int64(len(dots)), Mode: 0644, Hash: vfstest.Hash([]byte(dots))},
+		"bin":            {Mode: fs.ModeDir | 0755},
+		"bin/run":        {Size: int64(len(abc)), Mode: 0755 | fs.ModeSetuid, Hash: vfstest.Hash([]byte(abc))},
+		"data":           {Mode: fs.ModeDir | 0700},
+		"data/empty.txt": {Mode: 0600, Hash: vfstest.Hash(nil)},
+	})
+
+	if _, err := FromMap(map[string]MapFile{"file": {}, "file/child": {}}); err == nil {
+		t.Errorf("FromMap with file as parent: expected error")
+	}
+}
+
+func TestFromMapFS(t *testing.T) {
+	m := fstest.MapFS{
+		"hello.txt":           {Data: []byte("hello, world\n"), Mode: 0644},
+		"sub/dir/nested.txt":  {Data: []byte(abc), Mode: 0600},
+		"sub/empty":           {Mode: fs.ModeDir | 0700},
+		"sub/dir/another.txt": {Data: []byte(dots), Mode: 0640},
+	}
+	vfs, err := FromMapFS(m)
+	if err != nil {
+		t.Fatalf("FromMapFS error: %s", err)
+	}
+
+	want := []string{
+		".",
+		"hello.txt",
+		"sub",
+		"sub/dir",
+		"sub/dir/another.txt",
+		"sub/dir/nested.txt",
+		"sub/empty",
+	}
+	var walked []string
+	err = fs.WalkDir(vfs.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, name)
+
+		if file, ok := m[name]; ok {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if fi.Mode() != file.Mode {
+				t.Errorf("%s: mode = %v, want %v", name, fi.Mode(), file.Mode)
+			}
+			if !d.IsDir() {
+				b, err := fs.ReadFile(vfs.FS(), name)
+				if err != nil {
+					return err
+				}
+				if string(b) != string(file.Data) {
+					t.Errorf("%s: contents = %q, want %q", name, b, file.Data)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %s", err)
+	}
+	if strings.Join(walked, ",") != strings.Join(want, ",") {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+}
@@ -0,0 +1,77 @@
+package vfs
+
+import (
+	"io"
+	stdfs "io/fs"
+)
+
+// redactByte is what every byte of a redacted file reads as.
+const redactByte = 'X'
+
+// redactedFS is an io/fs view of a VFS whose regular files read as a
+// run of redactByte as long as the file, instead of their contents.
+type redactedFS struct {
+	fsys stdFS
+}
+
+var (
+	_ stdfs.ReadDirFS = redactedFS{}
+	_ stdfs.StatFS    = redactedFS{}
+)
+
+// RedactedFS returns an io/fs view of the VFS that is safe to dump to
+// logs. Names, sizes, modes and the structure of the tree are preserved,
+// but every byte of a regular file reads as 'X', and file contents are
+// never decrypted.
+func (fs *pbFS) RedactedFS() stdfs.FS {
+	return redactedFS{fsys: stdFS{pbFS: fs}}
+}
+
+func (fs redactedFS) Open(name string) (stdfs.File, error) {
+	f, err := fs.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return f, nil
+	}
+
+	return &redactedFile{File: f, size: fi.Size()}, nil
+}
+
+func (fs redactedFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
+	return fs.fsys.ReadDir(name)
+}
+
+func (fs redactedFS) Stat(name string) (stdfs.FileInfo, error) {
+	return fs.fsys.Stat(name)
+}
+
+// redactedFile is a file opened from a redactedFS. Only Stat and Close
+// are passed through to the underlying file.
+type redactedFile struct {
+	stdfs.File
+
+	size   int64
+	offset int64
+}
+
+func (f *redactedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.size-f.offset {
+		p = p[:f.size-f.offset]
+	}
+	for i := range p {
+		p[i] = redactByte
+	}
+	f.offset += int64(len(p))
+
+	return len(p), nil
+}
@@ -0,0 +1,415 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	stdfs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/inode"
+)
+
+// scopedFS is a view of the subtree of a VFS rooted at dir. Names are
+// resolved relative to the scope's own working directory and then
+// prefixed with dir, so that ".." elements can't refer to files outside
+// of it.
+type scopedFS struct {
+	fs  *pbFS
+	dir string
+
+	mtx sync.RWMutex
+	cwd string
+}
+
+var _ absfs.FileSystem = (*scopedFS)(nil)
+
+// Sub returns a view of the directory dir as a filesystem of its own,
+// sharing the files of the VFS. Its root is dir and its working
+// directory starts out there. Symbolic links created through the view
+// are confined to dir, but links are still resolved in the whole VFS, so
+// a link created outside of the view may refer to files outside of dir.
+func (fs *pbFS) Sub(dir string) (absfs.FileSystem, error) {
+	fs.mtx.RLock()
+	r, err := fs.resolve(dir, true)
+	fs.mtx.RUnlock()
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "sub", Path: dir, Err: err}
+	}
+	if !r.node.IsDir() {
+		return nil, &stdfs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	return &scopedFS{fs: fs, dir: r.path, cwd: "/"}, nil
+}
+
+// abs returns the absolute form of name within the scope.
+func (fs *scopedFS) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	return path.Join(fs.cwd, name)
+}
+
+// full returns the path in the VFS of the file name refers to.
+func (fs *scopedFS) full(name string) string {
+	return path.Join(fs.dir, fs.abs(name))
+}
+
+// isRoot reports whether name refers to the root of the scope.
+func (fs *scopedFS) isRoot(name string) bool {
+	return fs.abs(name) == "/"
+}
+
+// linkErr replaces the paths of a *os.LinkError in err with oldpath and
+// newpath, so that errors name files as the caller did.
+func linkErr(err error, oldpath, newpath string) error {
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		le.Old, le.New = oldpath, newpath
+	}
+
+	return err
+}
+
+func (fs *scopedFS) FS() stdfs.FS {
+	fsys := stdFS{pbFS: fs.fs}
+	if fs.dir == "/" {
+		return fsys
+	}
+
+	return subFS{fsys: fsys, dir: fs.dir[1:]}
+}
+
+// Root returns the inode of the root of the scope, or nil if it has
+// been removed.
+func (fs *scopedFS) Root() *inode.Inode {
+	node, err := fs.fs.lookup("root", fs.dir, true)
+	if err != nil {
+		return nil
+	}
+
+	return node
+}
+
+// TreeLock returns the lock that guards the structure of the inode tree
+// of the whole VFS.
+func (fs *scopedFS) TreeLock() *sync.RWMutex {
+	return fs.fs.TreeLock()
+}
+
+// Sub returns a view of the directory dir within the scope as a
+// filesystem of its own.
+func (fs *scopedFS) Sub(dir string) (absfs.FileSystem, error) {
+	full := fs.full(dir)
+	node, err := fs.fs.lookup("sub", full, true)
+	if err != nil {
+		return nil, relErr(err, dir)
+	}
+	if !node.IsDir() {
+		return nil, &stdfs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	return &scopedFS{fs: fs.fs, dir: full, cwd: "/"}, nil
+}
+
+func (fs *scopedFS) Open(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *scopedFS) OpenFile(name string, flag int, perm stdfs.FileMode) (absfs.File, error) {
+	f, err := fs.fs.OpenFile(fs.full(name), flag, perm)
+	if err != nil {
+		return nil, relErr(err, name)
+	}
+	f.(*file).name = name
+
+	return f, nil
+}
+
+func (fs *scopedFS) Create(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *scopedFS) ReadFile(name string) ([]byte, error) {
+	data, err := fs.fs.ReadFile(fs.full(name))
+	return data, relErr(err, name)
+}
+
+func (fs *scopedFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
+	dirs, err := fs.fs.ReadDir(fs.full(name))
+	return dirs, relErr(err, name)
+}
+
+func (fs *scopedFS) WriteFile(name string, data []byte, perm stdfs.FileMode) error {
+	return relErr(fs.fs.WriteFile(fs.full(name), data, perm), name)
+}
+
+func (fs *scopedFS) Mkdir(name string, perm stdfs.FileMode) error {
+	return relErr(fs.fs.Mkdir(fs.full(name), perm), name)
+}
+
+func (fs *scopedFS) MkdirAll(name string, perm stdfs.FileMode) error {
+	return relErr(fs.fs.MkdirAll(fs.full(name), perm), name)
+}
+
+func (fs *scopedFS) Stat(name string) (stdfs.FileInfo, error) {
+	fi, err := fs.fs.Stat(fs.full(name))
+	return fi, relErr(err, name)
+}
+
+func (fs *scopedFS) Lstat(name string) (stdfs.FileInfo, error) {
+	fi, err := fs.fs.Lstat(fs.full(name))
+	return fi, relErr(err, name)
+}
+
+func (fs *scopedFS) Rename(oldpath, newpath string) error {
+	if fs.isRoot(oldpath) || fs.isRoot(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+	}
+
+	return linkErr(fs.fs.Rename(fs.full(oldpath), fs.full(newpath)), oldpath, newpath)
+}
+
+func (fs *scopedFS) Remove(name string) error {
+	if fs.isRoot(name) {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	return relErr(fs.fs.Remove(fs.full(name)), name)
+}
+
+func (fs *scopedFS) RemoveInfo(name string) (stdfs.FileInfo, error) {
+	if fs.isRoot(name) {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	fi, err := fs.fs.RemoveInfo(fs.full(name))
+	return fi, relErr(err, name)
+}
+
+func (fs *scopedFS) RemoveAll(name string) error {
+	if fs.isRoot(name) {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	return relErr(fs.fs.RemoveAll(fs.full(name)), name)
+}
+
+func (fs *scopedFS) RemoveAllContext(ctx context.Context, name string) error {
+	if fs.isRoot(name) {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	return relErr(fs.fs.RemoveAllContext(ctx, fs.full(name)), name)
+}
+
+func (fs *scopedFS) Truncate(name string, size int64) error {
+	return relErr(fs.fs.Truncate(fs.full(name), size), name)
+}
+
+func (fs *scopedFS) Chmod(name string, mode stdfs.FileMode) error {
+	return relErr(fs.fs.Chmod(fs.full(name), mode), name)
+}
+
+func (fs *scopedFS) Chtimes(name string, atime, mtime time.Time) error {
+	return relErr(fs.fs.Chtimes(fs.full(name), atime, mtime), name)
+}
+
+func (fs *scopedFS) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	return relErr(fs.fs.SetTimes(fs.full(name), atime, mtime, ctime), name)
+}
+
+func (fs *scopedFS) Chown(name string, uid, gid int) error {
+	return relErr(fs.fs.Chown(fs.full(name), uid, gid), name)
+}
+
+func (fs *scopedFS) Setxattr(name, key string, value []byte) error {
+	return relErr(fs.fs.Setxattr(fs.full(name), key, value), name)
+}
+
+func (fs *scopedFS) Getxattr(name, key string) ([]byte, error) {
+	value, err := fs.fs.Getxattr(fs.full(name), key)
+	return value, relErr(err, name)
+}
+
+func (fs *scopedFS) Listxattr(name string) ([]string, error) {
+	keys, err := fs.fs.Listxattr(fs.full(name))
+	return keys, relErr(err, name)
+}
+
+func (fs *scopedFS) Removexattr(name, key string) error {
+	return relErr(fs.fs.Removexattr(fs.full(name), key), name)
+}
+
+func (fs *scopedFS) EncryptCount(name string) (uint64, error) {
+	n, err := fs.fs.EncryptCount(fs.full(name))
+	return n, relErr(err, name)
+}
+
+// StatFS reports the space available to file contents in the whole VFS.
+func (fs *scopedFS) StatFS() (total, used, free int64) {
+	return fs.fs.StatFS()
+}
+
+// Symlink creates newname as a symbolic link to oldname. An absolute
+// oldname is stored within the scope, and a relative one is cleaned, so
+// that ".." elements are applied to its text rather than to the files
+// they would follow, and mustn't climb above the root of the scope.
+func (fs *scopedFS) Symlink(oldname, newname string) error {
+	target := path.Join(fs.dir, path.Clean(oldname))
+	if !path.IsAbs(oldname) {
+		target = path.Clean(oldname)
+		if !fs.linkWithin(target, newname) {
+			return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: stdfs.ErrPermission}
+		}
+	}
+
+	return linkErr(fs.fs.Symlink(target, fs.full(newname)), oldname, newname)
+}
+
+// linkWithin reports whether the cleaned relative link target resolves
+// to a file within the scope from the directory of the link newname.
+func (fs *scopedFS) linkWithin(target, newname string) bool {
+	var ups int
+	for _, elem := range strings.Split(target, "/") {
+		if elem != ".." {
+			break
+		}
+		ups++
+	}
+	if ups == 0 {
+		return true
+	}
+
+	// ".." elements are followed from the directory the link is really
+	// in, which may differ from the name it's created with
+	dir, err := fs.fs.Realpath(path.Dir(fs.full(newname)))
+	if err != nil {
+		// the link can't be created anyway, let Symlink say why
+		return true
+	}
+	rel, ok := fs.rel(dir)
+	if !ok {
+		return false
+	}
+
+	return ups <= len(splitPath(rel))
+}
+
+// rel returns the path of the file in the VFS at p relative to the root
+// of the scope, and whether p is within the scope at all.
+func (fs *scopedFS) rel(p string) (string, bool) {
+	if fs.dir == "/" {
+		return p, true
+	}
+	if p == fs.dir {
+		return "/", true
+	}
+	if !strings.HasPrefix(p, fs.dir+"/") {
+		return "", false
+	}
+
+	return p[len(fs.dir):], true
+}
+
+// Readlink returns the destination of the named symbolic link. Absolute
+// destinations within the scope are returned relative to its root.
+func (fs *scopedFS) Readlink(name string) (string, error) {
+	target, err := fs.fs.Readlink(fs.full(name))
+	if err != nil {
+		return "", relErr(err, name)
+	}
+	if path.IsAbs(target) {
+		if rel, ok := fs.rel(path.Clean(target)); ok {
+			target = rel
+		}
+	}
+
+	return target, nil
+}
+
+func (fs *scopedFS) WalkDir(root string, fn stdfs.WalkDirFunc) error {
+	fsys := fs.FS()
+	if path.IsAbs(root) {
+		if root == "/" {
+			root = "."
+		} else {
+			root = root[1:]
+		}
+	} else if cwd, _ := fs.Getwd(); cwd != "/" {
+		// relative roots are walked from the working directory, as
+		// names in the io/fs view are relative to the root
+		var err error
+		if fsys, err = stdfs.Sub(fsys, cwd[1:]); err != nil {
+			return err
+		}
+	}
+
+	return stdfs.WalkDir(fsys, root, fn)
+}
+
+func (fs *scopedFS) WalkDirContext(ctx context.Context, root string, fn stdfs.WalkDirFunc) error {
+	return fs.WalkDir(root, walkDirFuncContext(ctx, fn))
+}
+
+func (fs *scopedFS) Abs(p string) (string, error) {
+	if strings.HasPrefix(p, string(PathSeparator)) {
+		return path.Clean(p), nil
+	}
+
+	wd, err := fs.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(wd, p), nil
+}
+
+func (fs *scopedFS) Separator() uint8 {
+	return PathSeparator
+}
+
+func (fs *scopedFS) ListSeparator() uint8 {
+	return PathListSeparator
+}
+
+func (fs *scopedFS) Chdir(name string) error {
+	node, err := fs.fs.lookup("chdir", fs.full(name), true)
+	if err != nil {
+		return relErr(err, name)
+	}
+	if !node.IsDir() {
+		return &stdfs.PathError{Op: "chdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	cwd := fs.abs(name)
+	fs.mtx.Lock()
+	fs.cwd = cwd
+	fs.mtx.Unlock()
+
+	return nil
+}
+
+func (fs *scopedFS) Getwd() (dir string, err error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	return fs.cwd, nil
+}
+
+func (fs *scopedFS) TempDir() string {
+	return tempDir
+}
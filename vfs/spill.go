@@ -0,0 +1,120 @@
+package vfs
+
+import (
+	"os"
+
+	"github.com/awnumar/memguard/core"
+)
+
+// spillConfig configures moving the sealed contents of large files out
+// of memory and into backing files on disk.
+type spillConfig struct {
+	dir       string
+	threshold int64
+}
+
+// spillSlot is the space reserved in a backing file for every block, so
+// that a block can be replaced without moving any others.
+const spillSlot = int64(blockSize + core.Overhead)
+
+// setBlock replaces the i'th block of the file with b, releasing the
+// previous block. If the file has been spilled to disk, b is written to
+// its backing file.
+func (s *sealedFile) setBlock(i int64, b *sealedBlock) error {
+	if s.backing != nil && b != nil {
+		var err error
+		if b, err = s.spillBlock(i, b); err != nil {
+			return err
+		}
+	}
+	s.release(s.blocks[i])
+	s.blocks[i] = b
+
+	return nil
+}
+
+// spillBlock writes the ciphertext of b to the i'th slot of the file's
+// backing file, and returns a block that reads it from there.
+func (s *sealedFile) spillBlock(i int64, b *sealedBlock) (*sealedBlock, error) {
+	off := i * spillSlot
+	if _, err := s.backing.WriteAt(b.ciphertext, off); err != nil {
+		return nil, err
+	}
+
+	return &sealedBlock{
+		key:        b.key,
+		length:     b.length,
+		compressed: b.compressed,
+		backing:    s.backing,
+		off:        off,
+		clen:       len(b.ciphertext),
+	}, nil
+}
+
+// maybeSpill moves the blocks of the file to a new backing file if the
+// file has grown larger than the spill threshold. Once spilled, a file
+// stays on disk until its contents are freed.
+func (s *sealedFile) maybeSpill() error {
+	if s.spill == nil || s.backing != nil || s.size <= s.spill.threshold {
+		return nil
+	}
+
+	backing, err := os.CreateTemp(s.spill.dir, "pandorasbox-*")
+	if err != nil {
+		return err
+	}
+	s.backing = backing
+
+	for i, b := range s.blocks {
+		if b == nil {
+			continue
+		}
+
+		sb, err := s.spillBlock(int64(i), b)
+		if err != nil {
+			// blocks that were already spilled remain readable from
+			// the backing file
+			return err
+		}
+		s.release(b)
+		s.blocks[i] = sb
+	}
+
+	return nil
+}
+
+// wipeBacking overwrites the file's backing file with zeros, if it has
+// one, so no ciphertext is left on disk once it's removed.
+func (s *sealedFile) wipeBacking() {
+	if s.backing == nil {
+		return
+	}
+	fi, err := s.backing.Stat()
+	if err != nil {
+		return
+	}
+
+	bp := getBuf(spillSlot)
+	defer putBuf(bp)
+	zeros := *bp
+	for off := int64(0); off < fi.Size(); off += spillSlot {
+		n := min64(spillSlot, fi.Size()-off)
+		if _, err := s.backing.WriteAt(zeros[:n], off); err != nil {
+			return
+		}
+	}
+	s.backing.Sync()
+}
+
+// removeBacking wipes, closes and removes the file's backing file, if
+// any.
+func (s *sealedFile) removeBacking() {
+	if s.backing == nil {
+		return
+	}
+
+	s.wipeBacking()
+	s.backing.Close()
+	os.Remove(s.backing.Name())
+	s.backing = nil
+}
@@ -0,0 +1,121 @@
+package vfs
+
+import (
+	stdfs "io/fs"
+	"path"
+	"strings"
+)
+
+// subFS is an io/fs view of the subtree of a VFS rooted at dir. Names
+// are translated to paths in the VFS by prefixing them with dir.
+type subFS struct {
+	fsys stdFS
+	dir  string
+}
+
+var (
+	_ stdfs.GlobFS     = subFS{}
+	_ stdfs.ReadDirFS  = subFS{}
+	_ stdfs.ReadFileFS = subFS{}
+	_ stdfs.StatFS     = subFS{}
+	_ stdfs.SubFS      = subFS{}
+)
+
+// fullName returns the name of the file name refers to in the parent FS.
+func (fs subFS) fullName(op, name string) (string, error) {
+	if err := checkPath(name, op); err != nil {
+		return "", err
+	}
+
+	return path.Join(fs.dir, name), nil
+}
+
+func (fs subFS) Open(name string) (stdfs.File, error) {
+	full, err := fs.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.fsys.Open(full)
+	if err != nil {
+		return nil, relErr(err, name)
+	}
+	f.(*file).name = name
+
+	return f, nil
+}
+
+func (fs subFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
+	full, err := fs.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := fs.fsys.ReadDir(full)
+	return dirs, relErr(err, name)
+}
+
+func (fs subFS) ReadFile(name string) ([]byte, error) {
+	full, err := fs.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fs.fsys.ReadFile(full)
+	return data, relErr(err, name)
+}
+
+func (fs subFS) Stat(name string) (stdfs.FileInfo, error) {
+	full, err := fs.fullName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fs.fsys.Stat(full)
+	return fi, relErr(err, name)
+}
+
+func (fs subFS) Glob(pattern string) ([]string, error) {
+	// check the pattern is well-formed
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if pattern == "." {
+		return []string{"."}, nil
+	}
+
+	// dir may contain characters that are special in patterns, so
+	// they must be escaped to only match dir itself
+	full := escapeMeta(fs.dir) + "/" + pattern
+	matches, err := fs.fsys.Glob(full)
+	for i, name := range matches {
+		matches[i] = strings.TrimPrefix(name, fs.dir+"/")
+	}
+
+	return matches, err
+}
+
+func (fs subFS) Sub(dir string) (stdfs.FS, error) {
+	if !stdfs.ValidPath(dir) {
+		return nil, &stdfs.PathError{Op: "sub", Path: dir, Err: stdfs.ErrInvalid}
+	}
+	if dir == "." {
+		return fs, nil
+	}
+
+	return subFS{fsys: fs.fsys, dir: path.Join(fs.dir, dir)}, nil
+}
+
+// escapeMeta escapes the characters in name that path.Match treats
+// specially.
+func escapeMeta(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
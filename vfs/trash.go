@@ -0,0 +1,187 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	stdfs "io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/capnspacehook/pandorasbox/inode"
+)
+
+// trash records the files that have been moved to the trash directory,
+// so they can be restored.
+type trash struct {
+	dir     string
+	seq     int
+	entries []trashEntry
+}
+
+type trashEntry struct {
+	orig string // path the file was removed from
+	name string // name of the file in the trash directory
+}
+
+// forget drops the entry of the file at name in the trash directory, if
+// there is one.
+func (t *trash) forget(name string) {
+	if t == nil || path.Dir(name) != t.dir {
+		return
+	}
+	for i, e := range t.entries {
+		if e.name == path.Base(name) {
+			t.entries = append(t.entries[:i], t.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// trashes reports whether the file r refers to should be moved to the
+// trash rather than removed. Files already in the trash are removed for
+// good, and the trash directory or a directory containing it can't be
+// removed at all. The caller must hold fs.mtx.
+func (fs *pbFS) trashes(r *resolved) (bool, error) {
+	if fs.trash == nil {
+		return false, nil
+	}
+	dir := fs.trash.dir
+	if r.path == dir || strings.HasPrefix(dir, r.path+"/") {
+		return false, syscall.EBUSY
+	}
+
+	return !strings.HasPrefix(r.path, dir+"/"), nil
+}
+
+// trashDir returns the trash directory, creating it and any missing
+// parents first. The caller must hold fs.mtx for writing.
+func (fs *pbFS) trashDir() (*inode.Inode, error) {
+	node, dir := fs.root, "/"
+	for _, elem := range splitPath(fs.trash.dir) {
+		dir = path.Join(dir, elem)
+		r, err := fs.resolve(dir, false)
+		if err != nil {
+			return nil, err
+		}
+		node = r.node
+		if node == nil {
+			if node, err = fs.mkdir(r, 0700); err != nil {
+				return nil, err
+			}
+		}
+		if !node.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+	}
+
+	return node, nil
+}
+
+// moveToTrash moves the file r refers to into the trash directory under
+// a name that's unique within it. The caller must hold fs.mtx for
+// writing.
+func (fs *pbFS) moveToTrash(r *resolved) error {
+	dir, err := fs.trashDir()
+	if err != nil {
+		return err
+	}
+
+	t := fs.trash
+	var name string
+	for {
+		t.seq++
+		name = r.name + "." + strconv.Itoa(t.seq)
+		// a file may have been created in the trash with this name
+		if _, err := dir.Resolve(name); err != nil {
+			break
+		}
+	}
+	if err := fs.root.Rename(r.path, path.Join(t.dir, name)); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, trashEntry{orig: r.path, name: name})
+
+	return nil
+}
+
+// Restore moves the file most recently removed from originalPath back
+// there from the trash. The parent directory of originalPath must exist,
+// and originalPath itself must not.
+func (fs *pbFS) Restore(originalPath string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	r, err := fs.resolve(originalPath, false)
+	if err == nil && r.node != nil {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &stdfs.PathError{Op: "restore", Path: originalPath, Err: err}
+	}
+
+	i := -1
+	if fs.trash != nil {
+		for j, e := range fs.trash.entries {
+			if e.orig == r.path {
+				i = j
+			}
+		}
+	}
+	if i < 0 {
+		return &stdfs.PathError{Op: "restore", Path: originalPath, Err: syscall.ENOENT}
+	}
+
+	e := fs.trash.entries[i]
+	if err := fs.root.Rename(path.Join(fs.trash.dir, e.name), r.path); err != nil {
+		return &stdfs.PathError{Op: "restore", Path: originalPath, Err: err}
+	}
+	fs.trash.entries = append(fs.trash.entries[:i], fs.trash.entries[i+1:]...)
+
+	return nil
+}
+
+// EmptyTrash removes everything in the trash directory for good, wiping
+// the contents of the files as Remove would without a trash.
+func (fs *pbFS) EmptyTrash() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if fs.trash == nil {
+		return nil
+	}
+	r, err := fs.resolve(fs.trash.dir, false)
+	if err == nil && r.node != nil && !r.node.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		if errors.Is(err, stdfs.ErrNotExist) {
+			return nil
+		}
+		return &stdfs.PathError{Op: "remove", Path: fs.trash.dir, Err: err}
+	}
+	if r.node == nil {
+		// nothing has been moved to the trash yet
+		return nil
+	}
+
+	var names []string
+	for _, e := range r.node.Dir.Entries() {
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	for _, name := range names {
+		name = path.Join(fs.trash.dir, name)
+		cr, err := fs.resolve(name, false)
+		if err == nil {
+			err = fs.removeAll(context.Background(), cr)
+		}
+		if err != nil {
+			return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+		}
+	}
+
+	return nil
+}
@@ -1,18 +1,23 @@
 package vfs
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	stdfs "io/fs"
+	"iter"
 	"os"
 	"path"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/awnumar/fastrand"
-	"github.com/awnumar/memguard"
 	"github.com/awnumar/memguard/core"
 
 	"github.com/capnspacehook/pandorasbox/absfs"
@@ -26,18 +31,51 @@ const (
 	tempDir = "/tmp"
 
 	_O_ACCESS = 0x3 // masks the access mode (os.O_RDONLY, os.O_WRONLY, or os.O_RDWR)
+
+	// permission and special bits that are preserved when creating files
+	modeMask = stdfs.ModePerm | stdfs.ModeSetuid | stdfs.ModeSetgid | stdfs.ModeSticky
+)
+
+// AccessMode is a set of accessibility checks for Access to perform.
+// The values match those used by access(2).
+type AccessMode uint32
+
+const (
+	F_OK AccessMode = 0x0 // test for existence of file
+	X_OK AccessMode = 0x1 // test for execute permission
+	W_OK AccessMode = 0x2 // test for write permission
+	R_OK AccessMode = 0x4 // test for read permission
 )
 
+// stdFS adapts a VFS to the io/fs interfaces. Names are resolved
+// relative to the root of the VFS regardless of its working directory.
 type stdFS struct {
 	*pbFS
 }
 
+var (
+	_ absfs.FileSystem = (*pbFS)(nil)
+	_ absfs.File       = (*file)(nil)
+
+	_ stdfs.GlobFS     = stdFS{}
+	_ stdfs.ReadDirFS  = stdFS{}
+	_ stdfs.ReadFileFS = stdFS{}
+	_ stdfs.StatFS     = stdFS{}
+	_ stdfs.SubFS      = stdFS{}
+)
+
 func (fs stdFS) Open(name string) (stdfs.File, error) {
 	if err := checkPath(name, "open"); err != nil {
 		return nil, err
 	}
 
-	return fs.pbFS.Open(name)
+	f, err := fs.pbFS.Open(abs(name))
+	if err != nil {
+		return nil, relErr(err, name)
+	}
+	f.(*file).name = name
+
+	return f, nil
 }
 
 func (fs stdFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
@@ -45,7 +83,8 @@ func (fs stdFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
 		return nil, err
 	}
 
-	return fs.pbFS.ReadDir(name)
+	dirs, err := fs.pbFS.ReadDir(abs(name))
+	return dirs, relErr(err, name)
 }
 
 func (fs stdFS) ReadFile(name string) ([]byte, error) {
@@ -53,27 +92,142 @@ func (fs stdFS) ReadFile(name string) ([]byte, error) {
 		return nil, err
 	}
 
-	return fs.pbFS.ReadFile(name)
+	data, err := fs.pbFS.ReadFile(abs(name))
+	return data, relErr(err, name)
 }
 
-func (fs stdFS) StatFS(name string) (stdfs.FileInfo, error) {
+func (fs stdFS) Stat(name string) (stdfs.FileInfo, error) {
 	if err := checkPath(name, "stat"); err != nil {
 		return nil, err
 	}
 
-	return fs.pbFS.Stat(name)
+	fi, err := fs.pbFS.Stat(abs(name))
+	return fi, relErr(err, name)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir. The
+// returned FS shares the inodes of the VFS, so changes made through
+// either are visible in both.
+func (fs stdFS) Sub(dir string) (stdfs.FS, error) {
+	if !stdfs.ValidPath(dir) {
+		return nil, &stdfs.PathError{Op: "sub", Path: dir, Err: stdfs.ErrInvalid}
+	}
+	if dir == "." {
+		return fs, nil
+	}
+
+	return subFS{fsys: fs, dir: dir}, nil
+}
+
+// Glob returns the names of all files matching pattern, with the same
+// semantics as fs.Glob. Instead of reading every directory along the way,
+// the inode tree is matched directly, and pattern elements without
+// metacharacters are looked up by name.
+func (fs stdFS) Glob(pattern string) ([]string, error) {
+	// check the pattern is well-formed
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !stdfs.ValidPath(pattern) {
+		return nil, nil
+	}
+	if pattern == "." {
+		return []string{"."}, nil
+	}
+
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	var matches []string
+	fs.glob("/", fs.root, strings.Split(pattern, "/"), &matches)
+	for i, name := range matches {
+		matches[i] = name[1:]
+	}
+
+	return matches, nil
+}
+
+// glob appends the VFS paths of the files beneath the directory dir that
+// match the pattern elements elems to matches. The caller must hold
+// fs.mtx for reading.
+func (fs *pbFS) glob(dir string, node *inode.Inode, elems []string, matches *[]string) {
+	// follow symbolic links to directories
+	if node.Mode&stdfs.ModeSymlink != 0 {
+		r, err := fs.resolve(dir, true)
+		if err != nil || r.node == nil {
+			return
+		}
+		node = r.node
+	}
+	if !node.IsDir() {
+		return
+	}
+
+	elem, rest := elems[0], elems[1:]
+	var children []*inode.DirEntry
+	if !hasMeta(elem) {
+		child, err := node.Resolve(elem)
+		if err != nil {
+			return
+		}
+		children = []*inode.DirEntry{{Name: elem, Inode: child}}
+	} else {
+		node.RLock()
+		children = make([]*inode.DirEntry, 0, node.Dir.Len())
+		for _, e := range node.Dir.Entries() {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			// the pattern has already been validated
+			if ok, _ := path.Match(elem, e.Name); ok {
+				children = append(children, e)
+			}
+		}
+		node.RUnlock()
+	}
+
+	for _, e := range children {
+		name := path.Join(dir, e.Name)
+		if len(rest) == 0 {
+			*matches = append(*matches, name)
+			continue
+		}
+		fs.glob(name, e.Inode, rest, matches)
+	}
+}
+
+// hasMeta reports whether elem contains any of the magic characters
+// recognized by path.Match.
+func hasMeta(elem string) bool {
+	return strings.ContainsAny(elem, `*?[\`)
 }
 
 func checkPath(name, op string) error {
-	if path.IsAbs(name) {
-		// if the name starts with a slash, return an error
-		// to remain compatible with io/fs
+	if !stdfs.ValidPath(name) {
+		// reject names starting with a slash or containing ".."
+		// elements to remain compatible with io/fs
 		return &stdfs.PathError{Op: op, Path: name, Err: stdfs.ErrInvalid}
 	}
 
 	return nil
 }
 
+// abs returns the absolute VFS path of the io/fs path name.
+func abs(name string) string {
+	return path.Join("/", name)
+}
+
+// relErr changes the path of an error returned for the absolute VFS
+// path of name back to name itself.
+func relErr(err error, name string) error {
+	var pathErr *stdfs.PathError
+	if errors.As(err, &pathErr) {
+		pathErr.Path = name
+	}
+
+	return err
+}
+
 type pbFS struct {
 	mtx *sync.RWMutex
 
@@ -83,114 +237,330 @@ type pbFS struct {
 	ino  *inode.Ino
 
 	data []*sealedFile
+
+	keyFunc     func() ([]byte, error) // nil if contents aren't encrypted
+	compression int
+	quota       *quota
+	dedup       *dedupStore
+	spill       *spillConfig
+
+	// if not zero, timestamps aren't tracked and every inode reports
+	// this time
+	fixedTime time.Time
+
+	// number of live inodes other than the root, guarded by mtx
+	inodes    int
+	maxInodes int
+
+	umask uint32 // accessed atomically
+
+	// if not nil, removed files are moved to the trash, guarded by mtx
+	trash *trash
+
+	watchers *watchers
+	flocks   *flocks
+}
+
+// Options configures a VFS created by NewFSWithOptions. The zero value
+// is the configuration used by NewFS.
+type Options struct {
+	// KeyFunc is called to obtain the key material every time file
+	// contents are sealed, and must return 32 bytes. The returned
+	// slice is wiped once it has been moved into protected memory.
+	// If nil, a new random key is generated every time.
+	KeyFunc func() ([]byte, error)
+
+	// NoEncryption disables encrypting file contents, which are instead
+	// held as plaintext in ordinary memory, and written to SpillDir as
+	// plaintext if they are spilled. This removes the cost of sealing
+	// and opening blocks on every write and read, for uses that only
+	// need an in-memory filesystem, but gives up the protection of file
+	// contents that the VFS otherwise provides. KeyFunc is ignored.
+	NoEncryption bool
+
+	// MaxBytes limits the total size of the contents of all files in
+	// the VFS. Writes and truncations that would exceed it fail with
+	// ENOSPC. The space used by a removed file is only reclaimed once
+	// every handle to it has been closed. If zero, there is no limit.
+	MaxBytes int64
+
+	// MaxInodes limits the number of files, directories and symbolic
+	// links in the VFS, not counting the root directory. Creating any
+	// more fails with ENOSPC. If zero, there is no limit.
+	MaxInodes int
+
+	// Umask is the initial file mode creation mask, which can later be
+	// changed with Umask.
+	Umask stdfs.FileMode
+
+	// Dedup enables sharing the sealed contents of files between files
+	// with identical contents, saving locked memory when many files are
+	// the same. Contents are compared a block at a time by a MAC keyed
+	// with a secret random key, and a file's shared blocks are copied
+	// on write. MaxBytes still limits the size of every file's contents,
+	// shared or not.
+	Dedup bool
+
+	// Compression is the compress/flate level file contents are
+	// compressed at before they are sealed, to save locked memory when
+	// contents are compressible. Blocks that wouldn't get any smaller
+	// are sealed uncompressed. If zero, contents aren't compressed.
+	//
+	// Compression reveals how compressible contents are through the
+	// size of the sealed data, and plaintext passes through the
+	// compressor's state, which is held in ordinary memory.
+	Compression int
+
+	// SpillDir is the directory that the sealed contents of files larger
+	// than SpillThreshold bytes are moved to, so that large files don't
+	// have to be held in memory. Every such file gets a backing file
+	// created in SpillDir, which holds its contents encrypted just as
+	// they would be in memory, and is removed along with the contents.
+	// The keys of every file are always kept in memory. If empty, file
+	// contents are never spilled.
+	SpillDir       string
+	SpillThreshold int64
+
+	// NoTimestamps disables updating the access and modification times
+	// of files, which saves some work on every operation. Every file
+	// instead reports the time the VFS was created, unless its times
+	// are explicitly changed with Chtimes.
+	NoTimestamps bool
+
+	// TrashDir is the directory within the VFS that Remove and RemoveAll
+	// move files to instead of removing them, so that they can be put
+	// back with Restore. Files in the trash are given a unique suffix,
+	// keep using space until EmptyTrash is called, and are removed for
+	// good if they are removed from the trash. The directory is created
+	// when it's first needed, and it and the directories containing it
+	// can't be removed. If empty, files are removed immediately.
+	TrashDir string
 }
 
 func NewFS() absfs.FileSystem {
+	return newFS(Options{})
+}
+
+// NewFSWithOptions returns a new VFS configured by opts.
+func NewFSWithOptions(opts Options) (absfs.FileSystem, error) {
+	if opts.Compression < flate.HuffmanOnly || opts.Compression > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level: %d", opts.Compression)
+	}
+	if opts.SpillThreshold < 0 {
+		return nil, fmt.Errorf("invalid spill threshold: %d", opts.SpillThreshold)
+	}
+	if opts.TrashDir != "" && path.Clean("/"+opts.TrashDir) == "/" {
+		return nil, fmt.Errorf("invalid trash directory: %q", opts.TrashDir)
+	}
+	if opts.SpillDir != "" {
+		fi, err := os.Stat(opts.SpillDir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &stdfs.PathError{Op: "stat", Path: opts.SpillDir, Err: syscall.ENOTDIR}
+		}
+	}
+
+	return newFS(opts), nil
+}
+
+func newFS(opts Options) *pbFS {
 	fs := new(pbFS)
 	fs.mtx = new(sync.RWMutex)
 	fs.ino = new(inode.Ino)
+	fs.watchers = new(watchers)
+	fs.flocks = new(flocks)
+	if opts.NoTimestamps {
+		fs.fixedTime = time.Now()
+	}
 
-	fs.root = fs.ino.NewDir(0755)
+	fs.root = fs.stamp(fs.ino.NewDir(0755))
 	fs.cwd = "/"
 	fs.dir = fs.root
 	fs.data = make([]*sealedFile, 2)
 
+	fs.keyFunc = opts.KeyFunc
+	if fs.keyFunc == nil {
+		fs.keyFunc = randomKey
+	}
+	if opts.NoEncryption {
+		fs.keyFunc = nil
+	}
+	fs.compression = opts.Compression
+	fs.quota = &quota{max: opts.MaxBytes}
+	fs.maxInodes = opts.MaxInodes
+	fs.umask = uint32(opts.Umask & stdfs.ModePerm)
+	if opts.Dedup {
+		fs.dedup = newDedupStore()
+	}
+	if opts.SpillDir != "" {
+		fs.spill = &spillConfig{dir: opts.SpillDir, threshold: opts.SpillThreshold}
+	}
+	if opts.TrashDir != "" {
+		fs.trash = &trash{dir: path.Clean("/" + opts.TrashDir)}
+	}
+	fs.data[fs.root.Ino] = fs.newSealedFile()
+
 	return fs
 }
 
-func (fs *pbFS) FS() stdfs.FS {
-	fs.mtx.RLock()
-	defer fs.mtx.RUnlock()
+// stamp sets the timestamps of the new inode node to the fixed time
+// if the VFS doesn't track timestamps, and returns node.
+func (fs *pbFS) stamp(node *inode.Inode) *inode.Inode {
+	if fs.fixedTime.IsZero() {
+		return node
+	}
+	node.Ctime = fs.fixedTime
+	node.Atime = fs.fixedTime
+	node.Mtime = fs.fixedTime
+	node.SetFlag(inode.FlagNoTimes, true)
 
-	// set cwd to root, as paths are not allowed to start with a slash
-	// in io/fs filesystems
-	return stdFS{pbFS: &pbFS{
-		mtx:  fs.mtx,
-		root: fs.root,
-		cwd:  "/",
-		dir:  fs.dir,
-		ino:  fs.ino,
-		data: fs.data,
-	}}
+	return node
 }
 
-func (fs *pbFS) Open(name string) (absfs.File, error) {
-	return fs.OpenFile(name, os.O_RDONLY, 0)
+func (fs *pbFS) newSealedFile() *sealedFile {
+	return &sealedFile{
+		newKey:      fs.keyFunc,
+		compression: fs.compression,
+		quota:       fs.quota,
+		dedup:       fs.dedup,
+		spill:       fs.spill,
+	}
 }
 
-func (fs *pbFS) OpenFile(name string, flag int, perm stdfs.FileMode) (absfs.File, error) {
-	if name == "/" {
-		data := fs.data[int(fs.root.Ino)]
-		return &file{
-			fs:    fs,
-			name:  name,
-			flags: flag,
-			node:  fs.root,
-			data:  data,
-		}, nil
-	}
+// Umask sets the file mode creation mask to newMask and returns the
+// previous mask. The permission bits set in the mask are cleared from
+// the permissions of files and directories created afterwards.
+func (fs *pbFS) Umask(newMask stdfs.FileMode) (old stdfs.FileMode) {
+	return stdfs.FileMode(atomic.SwapUint32(&fs.umask, uint32(newMask&stdfs.ModePerm)))
+}
 
-	// check that the path is valid
-	var validPath bool
-	if len(name) > 1 && name[0] == '/' {
-		// if the path starts with a slash, don't call io/fs.ValidPath
-		// with the leading slash, as we accept that but io/fs doesn't
-		validPath = stdfs.ValidPath(name[1:])
-	} else {
-		validPath = stdfs.ValidPath(name)
+// createMode returns the mode of a new file or directory created with
+// the permissions perm.
+func (fs *pbFS) createMode(perm stdfs.FileMode) stdfs.FileMode {
+	umask := stdfs.FileMode(atomic.LoadUint32(&fs.umask))
+	return perm & modeMask &^ umask
+}
+
+// unlinked releases node if its last link was removed, freeing its
+// contents once no handles to it remain open. The caller must hold
+// fs.mtx for writing.
+func (fs *pbFS) unlinked(node *inode.Inode) {
+	if !node.IsDir() && node.Nlink != 0 {
+		return
 	}
-	if !validPath {
-		return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrInvalid}
+	if fs.data[int(node.Ino)].remove() {
+		fs.inodes--
 	}
+}
 
-	appendFile := flag&os.O_APPEND != 0
-	if name == "." {
-		data := fs.data[int(fs.dir.Ino)]
-		file := &file{
-			fs:    fs,
-			name:  name,
-			flags: flag,
-			node:  fs.dir,
-			data:  data,
-		}
-		if data != nil {
-			if appendFile {
-				file.offset = fs.dir.Size
-			}
-			data.f = file
-		}
+// isRemoved reports whether node has been removed from the tree, which
+// a directory may still be reached from if it is the working directory.
+func (fs *pbFS) isRemoved(node *inode.Inode) bool {
+	data := fs.data[int(node.Ino)]
+	return data != nil && data.isRemoved()
+}
 
-		return file, nil
+// allocInode reserves space for a new inode, failing with ENOSPC if
+// there are already as many inodes as allowed. The caller must hold
+// fs.mtx for writing.
+func (fs *pbFS) allocInode() error {
+	if fs.maxInodes > 0 && fs.inodes >= fs.maxInodes {
+		return syscall.ENOSPC
 	}
+	fs.inodes++
 
-	wd := fs.root
-	if !path.IsAbs(name) {
-		wd = fs.dir
+	return nil
+}
+
+// FS returns an io/fs view of the VFS. Names are resolved relative to
+// the root of the VFS, and files created after FS is called are visible
+// through it.
+func (fs *pbFS) FS() stdfs.FS {
+	return stdFS{pbFS: fs}
+}
+
+// Close wipes and frees the contents of every file in the VFS, leaving
+// it empty. Other VFSs are unaffected. Files that are open when the VFS
+// is closed are left empty, as if they had been removed.
+func (fs *pbFS) Close() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	for _, s := range fs.data {
+		if s != nil {
+			s.wipe()
+		}
 	}
-	var exists bool
-	node, err := wd.Resolve(name)
-	if err == nil {
-		exists = true
+
+	fs.ino = new(inode.Ino)
+	fs.root = fs.stamp(fs.ino.NewDir(0755))
+	fs.cwd = "/"
+	fs.dir = fs.root
+	fs.data = make([]*sealedFile, 2)
+	fs.data[fs.root.Ino] = fs.newSealedFile()
+	fs.inodes = 0
+	if fs.trash != nil {
+		fs.trash.entries = nil
 	}
 
-	dir, filename := path.Split(name)
-	dir = path.Clean(dir)
-	parent, err := wd.Resolve(dir)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// Root returns the root of the inode tree backing the VFS. The tree must
+// only be accessed while holding the lock returned by TreeLock.
+func (fs *pbFS) Root() *inode.Inode {
+	return fs.root
+}
+
+// TreeLock returns the lock that guards the structure of the inode tree.
+// Operations that link or unlink inodes hold it for writing, so holding
+// it for reading keeps the tree stable during a traversal.
+func (fs *pbFS) TreeLock() *sync.RWMutex {
+	return fs.mtx
+}
+
+func (fs *pbFS) Open(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *pbFS) OpenFile(name string, flag int, perm stdfs.FileMode) (absfs.File, error) {
+	// check that the path is valid
+	if name != "/" {
+		var validPath bool
+		if len(name) > 1 && name[0] == '/' {
+			// if the path starts with a slash, don't call io/fs.ValidPath
+			// with the leading slash, as we accept that but io/fs doesn't
+			validPath = stdfs.ValidPath(name[1:])
+		} else {
+			validPath = stdfs.ValidPath(name)
+		}
+		if !validPath {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrInvalid}
+		}
 	}
 
 	access := flag & _O_ACCESS
 	create := flag&os.O_CREATE != 0
+	excl := flag&os.O_EXCL != 0
 	truncate := flag&os.O_TRUNC != 0
+	appendFile := flag&os.O_APPEND != 0
+
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
 
-	// error if it does not exist, and we are not allowed to create it.
-	if !exists && !create {
-		return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	// an exclusive create must fail if the name is a symlink, even
+	// if it is dangling
+	r, err := fs.resolve(name, !(create && excl))
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
 	}
-	if exists {
+	node := r.node
+
+	if node != nil {
 		// err if exclusive create is required
-		if create && flag&os.O_EXCL != 0 {
+		if create && excl {
 			return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrExist}
 		}
 		if node.IsDir() {
@@ -198,45 +568,58 @@ func (fs *pbFS) OpenFile(name string, flag int, perm stdfs.FileMode) (absfs.File
 				return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
 			}
 		}
+		if node.IsImmutable() && (access != os.O_RDONLY || truncate) {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrPermission}
+		}
 
 		// if we must truncate the file
 		if truncate {
-			sfile := fs.data[int(node.Ino)]
-			sfile.ciphertext = nil
-			sfile.key = nil
+			if err := fs.data[int(node.Ino)].truncate(0); err != nil {
+				return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+			}
+			fs.notify(Write, r.path)
 		}
 	} else {
-		// error if we cannot create the file
+		// error if it does not exist, and we are not allowed to create it.
 		if !create {
 			return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
 		}
 
+		if err := fs.allocInode(); err != nil {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+		}
+
 		// Create write-able file
-		node = fs.ino.New(perm)
-		err := parent.Link(filename, node)
+		node = fs.stamp(fs.ino.New(fs.createMode(perm)))
+		err := r.parent.Link(r.name, node)
 		if err != nil {
 			fs.ino.SubIno()
+			fs.inodes--
 			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
 		}
-		fs.data = append(fs.data, new(sealedFile))
+		fs.data = append(fs.data, fs.newSealedFile())
+		fs.notify(Create, r.path)
 	}
 	data := fs.data[int(node.Ino)]
+	if data != nil && !node.IsDir() {
+		data.open()
+	}
 
 	file := &file{
 		fs:    fs,
 		name:  name,
+		path:  r.path,
 		flags: flag,
 		node:  node,
 		data:  data,
 	}
 	if data != nil {
 		if truncate {
-			node.Size = 0
+			atomic.StoreInt64(&node.Size, 0)
 		}
 		if appendFile {
-			file.offset = node.Size
+			file.offset = atomic.LoadInt64(&node.Size)
 		}
-		data.f = file
 	}
 
 	return file, nil
@@ -246,6 +629,86 @@ func (fs *pbFS) Create(name string) (absfs.File, error) {
 	return fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 }
 
+// maxRestoreIno bounds the inode numbers CreateWithIno accepts, as
+// inode numbers index a table that grows to hold the largest of them.
+const maxRestoreIno = 1 << 24
+
+// CreateWithIno creates the named file with the inode number ino and
+// opens it for reading and writing, for restoring snapshots that record
+// inode numbers. If ino already numbers a regular file in the VFS, name
+// is instead added as a hard link to it, so names that shared an inode
+// when the snapshot was taken share one again, and the file is opened
+// without being truncated. Inode numbers that are in use by anything
+// else, and names that already exist, fail with EEXIST. Files created
+// afterwards are numbered after ino. ino must be more than 1, which is
+// the root, and less than 1<<24.
+func (fs *pbFS) CreateWithIno(name string, ino uint64, perm stdfs.FileMode) (absfs.File, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if ino <= fs.root.Ino || ino >= maxRestoreIno {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	r, err := fs.resolve(name, false)
+	if err == nil && r.node != nil {
+		err = stdfs.ErrExist
+	}
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	var node *inode.Inode
+	if ino < uint64(len(fs.data)) && fs.data[ino] != nil {
+		// only a regular file that is still in the tree can be linked
+		// to, which is found by walking it
+		if !fs.data[ino].isRemoved() {
+			walkInodes("/", fs.root, func(_ string, n *inode.Inode) bool {
+				if n.Ino == ino {
+					node = n
+				}
+				return node == nil
+			})
+		}
+		if node == nil || !node.Mode.IsRegular() {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrExist}
+		}
+		if node.IsImmutable() {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: stdfs.ErrPermission}
+		}
+		if err := r.parent.Link(r.name, node); err != nil {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+		}
+	} else {
+		if err := fs.allocInode(); err != nil {
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		node = fs.stamp(fs.ino.NewIno(ino, fs.createMode(perm)))
+		if err := r.parent.Link(r.name, node); err != nil {
+			fs.inodes--
+			return nil, &stdfs.PathError{Op: "open", Path: name, Err: err}
+		}
+		// inode numbers that were skipped are left free in the table
+		for uint64(len(fs.data)) <= ino {
+			fs.data = append(fs.data, nil)
+		}
+		fs.data[ino] = fs.newSealedFile()
+	}
+	fs.notify(Create, r.path)
+
+	data := fs.data[ino]
+	data.open()
+
+	return &file{
+		fs:    fs,
+		name:  name,
+		path:  r.path,
+		flags: os.O_RDWR,
+		node:  node,
+		data:  data,
+	}, nil
+}
+
 func (fs *pbFS) ReadFile(name string) ([]byte, error) {
 	f, err := fs.Open(name)
 	if err != nil {
@@ -255,6 +718,10 @@ func (fs *pbFS) ReadFile(name string) ([]byte, error) {
 
 	// will never error
 	fi, _ := f.Stat()
+	if fi.Size() == 0 {
+		// empty files have no sealed data, so skip reading entirely
+		return []byte{}, f.Close()
+	}
 
 	data := make([]byte, fi.Size())
 	n, err := f.Read(data)
@@ -284,12 +751,52 @@ func (fs *pbFS) ReadDir(name string) ([]stdfs.DirEntry, error) {
 	return dirs, nil
 }
 
+// ReadDirSeq returns an iterator over the entries of the named directory,
+// sorted by filename. The entries are yielded from a snapshot of the
+// directory taken when iteration begins, so callers may stop early
+// without the rest of the entries being materialized. If the directory
+// cannot be read, a single *fs.PathError is yielded.
+func (fs *pbFS) ReadDirSeq(name string) iter.Seq2[stdfs.DirEntry, error] {
+	return func(yield func(stdfs.DirEntry, error) bool) {
+		node, err := fs.lookup("readdir", name, true)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if !node.IsDir() {
+			yield(nil, &stdfs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR})
+			return
+		}
+
+		node.RLock()
+		entries := node.Dir.Entries()
+		node.RUnlock()
+
+		for _, e := range entries {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			if !yield(&DirEntry{e.Name, e.Inode}, nil) {
+				return
+			}
+		}
+	}
+}
+
 func (fs *pbFS) WriteFile(name string, data []byte, perm os.FileMode) error {
 	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
-	n, err := f.Write(data)
+	var n int
+	if rf, ok := f.(io.ReaderFrom); ok {
+		// ReadFrom seals the contents a block at a time
+		var n64 int64
+		n64, err = rf.ReadFrom(bytes.NewReader(data))
+		n = int(n64)
+	} else {
+		n, err = f.Write(data)
+	}
 	if err == nil && n < len(data) {
 		err = io.ErrShortWrite
 	}
@@ -304,33 +811,34 @@ func (fs *pbFS) Mkdir(name string, perm stdfs.FileMode) error {
 	fs.mtx.Lock()
 	defer fs.mtx.Unlock()
 
-	wd := fs.root
-	abs := name
-	if !path.IsAbs(abs) {
-		abs = path.Join(fs.cwd, abs)
-		wd = fs.dir
+	r, err := fs.resolve(name, false)
+	if err != nil {
+		return &stdfs.PathError{Op: "mkdir", Path: name, Err: err}
 	}
-	_, err := wd.Resolve(name)
-	if err == nil {
+	if r.node != nil {
 		return &stdfs.PathError{Op: "mkdir", Path: name, Err: stdfs.ErrExist}
 	}
+	if _, err := fs.mkdir(r, perm); err != nil {
+		return &stdfs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	fs.notify(Create, r.path)
 
-	parent := fs.root
-	dir, filename := path.Split(abs)
-	dir = path.Clean(dir)
-	if dir != "/" {
-		parent, err = fs.root.Resolve(strings.TrimLeft(dir, "/"))
-		if err != nil {
-			return &stdfs.PathError{Op: "mkdir", Path: dir, Err: err}
-		}
+	return nil
+}
+
+// mkdir creates the directory r refers to, which must not exist, and
+// returns it. The caller must hold fs.mtx for writing.
+func (fs *pbFS) mkdir(r *resolved, perm stdfs.FileMode) (*inode.Inode, error) {
+	if err := fs.allocInode(); err != nil {
+		return nil, err
 	}
 
-	child := fs.ino.NewDir(perm)
-	parent.Link(filename, child)
-	child.Link("..", parent)
-	fs.data = append(fs.data, new(sealedFile))
+	child := fs.stamp(fs.ino.NewDir(fs.createMode(perm)))
+	r.parent.Link(r.name, child)
+	child.Link("..", r.parent)
+	fs.data = append(fs.data, fs.newSealedFile())
 
-	return nil
+	return child, nil
 }
 
 func (fs *pbFS) MkdirAll(name string, perm stdfs.FileMode) error {
@@ -349,6 +857,10 @@ func (fs *pbFS) MkdirAll(name string, perm stdfs.FileMode) error {
 			if !errors.Is(err, stdfs.ErrExist) {
 				return err
 			}
+			// an existing file is only fine if it's a directory
+			if fi, serr := fs.Stat(dirpath); serr == nil && !fi.IsDir() {
+				return &stdfs.PathError{Op: "mkdir", Path: dirpath, Err: syscall.ENOTDIR}
+			}
 		}
 	}
 
@@ -356,10 +868,7 @@ func (fs *pbFS) MkdirAll(name string, perm stdfs.FileMode) error {
 }
 
 func (fs *pbFS) Stat(name string) (stdfs.FileInfo, error) {
-	if name == "/" {
-		return &FileInfo{"/", fs.root}, nil
-	}
-	node, err := fs.fileStat(fs.cwd, name)
+	node, err := fs.lookup("stat", name, true)
 	if err != nil {
 		return nil, err
 	}
@@ -367,193 +876,878 @@ func (fs *pbFS) Stat(name string) (stdfs.FileInfo, error) {
 	return &FileInfo{path.Base(name), node}, nil
 }
 
-func (fs *pbFS) fileStat(cwd, name string) (*inode.Inode, error) {
-	name = inode.Abs(cwd, name)
-	if name != "/" {
-		name = strings.TrimLeft(name, "/")
-	}
-	node, err := fs.root.Resolve(name)
+// Lstat returns a FileInfo describing the named file. If the file is a
+// symbolic link, the returned FileInfo describes the symbolic link.
+func (fs *pbFS) Lstat(name string) (stdfs.FileInfo, error) {
+	node, err := fs.lookup("lstat", name, false)
 	if err != nil {
-		return nil, &stdfs.PathError{Op: "stat", Path: name, Err: err}
+		return nil, err
 	}
 
-	return node, nil
-}
-
-func (fs *pbFS) Lstat(name string) (stdfs.FileInfo, error) {
-	return fs.Stat(name)
+	return &FileInfo{path.Base(name), node}, nil
 }
 
-func (fs *pbFS) Rename(oldpath, newpath string) error {
-	linkErr := os.LinkError{
-		Op:  "rename",
-		Old: oldpath,
-		New: newpath,
+// Access checks whether the named file exists and if its mode permits
+// the accesses specified by mode. The owner permission bits of the file
+// are checked, as all files in the VFS are owned by the caller. If there
+// is an error, it will be of type *fs.PathError.
+func (fs *pbFS) Access(name string, mode AccessMode) error {
+	node, err := fs.lookup("access", name, true)
+	if err != nil {
+		return err
 	}
 
-	if oldpath == "/" {
-		linkErr.Err = errors.New("the root folder may not be moved or renamed")
-		return &linkErr
+	perm := node.Mode.Perm()
+	if (mode&R_OK != 0 && perm&0400 == 0) ||
+		(mode&W_OK != 0 && perm&0200 == 0) ||
+		(mode&X_OK != 0 && perm&0100 == 0) {
+		return &stdfs.PathError{Op: "access", Path: name, Err: stdfs.ErrPermission}
 	}
 
-	if !path.IsAbs(oldpath) {
-		oldpath = path.Join(fs.cwd, oldpath)
-	}
+	return nil
+}
 
-	if !path.IsAbs(newpath) {
-		newpath = path.Join(fs.cwd, newpath)
-	}
-	err := fs.root.Rename(oldpath, newpath)
+// Chmod changes the mode of the named file to mode. Only the permission
+// bits and the setuid, setgid and sticky bits are changed. If there is
+// an error, it will be of type *fs.PathError.
+func (fs *pbFS) Chmod(name string, mode stdfs.FileMode) error {
+	node, err := fs.lookup("chmod", name, true)
 	if err != nil {
-		linkErr.Err = err
-		return &linkErr
+		return err
 	}
+	if node.IsImmutable() {
+		return &stdfs.PathError{Op: "chmod", Path: name, Err: stdfs.ErrPermission}
+	}
+
+	// the mode is read while resolving paths under fs.mtx, and by
+	// Snapshot under the inode's lock
+	const chmodBits = stdfs.ModePerm | stdfs.ModeSetuid | stdfs.ModeSetgid | stdfs.ModeSticky
+	fs.mtx.Lock()
+	node.Lock()
+	node.Mode = node.Mode&^chmodBits | mode&chmodBits
+	node.Unlock()
+	fs.mtx.Unlock()
 
 	return nil
 }
 
-func (fs *pbFS) Remove(name string) (err error) {
-	wd := fs.root
-	abs := name
-	if !path.IsAbs(abs) {
-		abs = path.Join(fs.cwd, abs)
-		wd = fs.dir
+// Chown changes the numeric uid and gid of the named file. Files in the
+// VFS have no owners, so it always fails with errors.ErrUnsupported
+// once the file is found.
+func (fs *pbFS) Chown(name string, uid, gid int) error {
+	if _, err := fs.lookup("chown", name, true); err != nil {
+		return err
 	}
 
-	child, err := wd.Resolve(name)
+	return &stdfs.PathError{Op: "chown", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chtimes changes the access and modification times of the named file,
+// similar to the Unix utime() or utimes() functions. A zero time.Time
+// value will leave the corresponding file time unchanged. If there is an
+// error, it will be of type *fs.PathError.
+func (fs *pbFS) Chtimes(name string, atime, mtime time.Time) error {
+	node, err := fs.lookup("chtimes", name, true)
 	if err != nil {
-		return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+		return err
 	}
-
-	if child.IsDir() {
-		if len(child.Dir) > 2 {
-			return &stdfs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
-		}
+	if node.IsImmutable() {
+		return &stdfs.PathError{Op: "chtimes", Path: name, Err: stdfs.ErrPermission}
 	}
 
-	parent := fs.root
-	dir, filename := path.Split(abs)
-	dir = path.Clean(dir)
-	if dir != "/" {
-		parent, err = fs.root.Resolve(strings.TrimLeft(dir, "/"))
-		if err != nil {
-			return &stdfs.PathError{Op: "remove", Path: dir, Err: err}
-		}
+	// times are also changed by tree mutations holding fs.mtx
+	fs.mtx.Lock()
+	node.Lock()
+	if !atime.IsZero() {
+		node.Atime = atime
 	}
+	if !mtime.IsZero() {
+		node.Mtime = mtime
+	}
+	node.Unlock()
+	fs.mtx.Unlock()
 
-	return parent.Unlink(filename)
+	return nil
 }
 
-func (fs *pbFS) RemoveAll(name string) error {
-	wd := fs.root
-	abs := name
-	if !path.IsAbs(abs) {
-		abs = path.Join(fs.cwd, abs)
-		wd = fs.dir
-	}
-
-	child, err := wd.Resolve(name)
+// SetTimes sets the access, modification and creation times of the named
+// file to atime, mtime and ctime with their full precision, which lets
+// archives be restored with their exact timestamps. As with Chtimes, a
+// zero time leaves the time it would set unchanged.
+func (fs *pbFS) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	node, err := fs.lookup("settimes", name, true)
 	if err != nil {
-		return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+		return err
+	}
+	if node.IsImmutable() {
+		return &stdfs.PathError{Op: "settimes", Path: name, Err: stdfs.ErrPermission}
 	}
 
-	parent := fs.root
-	dir, filename := path.Split(abs)
-	dir = path.Clean(dir)
-	if dir != "/" {
-		parent, err = fs.root.Resolve(strings.TrimLeft(dir, "/"))
-		if err != nil {
-			return &stdfs.PathError{Op: "remove", Path: dir, Err: err}
-		}
+	fs.mtx.Lock()
+	node.Lock()
+	if !atime.IsZero() {
+		node.Atime = atime
+	}
+	if !mtime.IsZero() {
+		node.Mtime = mtime
+	}
+	if !ctime.IsZero() {
+		node.Ctime = ctime
 	}
+	node.Unlock()
+	fs.mtx.Unlock()
 
-	child.UnlinkAll()
+	return nil
+}
+
+// SetImmutable sets or clears the immutable flag of the named file,
+// emulating chattr +i. While the flag is set the file may not be written
+// to, truncated, removed, renamed, linked to or have its metadata
+// changed; attempts fail with fs.ErrPermission. If there is an error, it
+// will be of type *fs.PathError.
+func (fs *pbFS) SetImmutable(name string, immutable bool) error {
+	node, err := fs.lookup("setimmutable", name, true)
+	if err != nil {
+		return err
+	}
+	node.SetFlag(inode.FlagImmutable, immutable)
 
-	return parent.Unlink(filename)
+	return nil
 }
 
-func (fs *pbFS) Truncate(name string, size int64) error {
-	if size < 0 {
-		return &stdfs.PathError{Op: "truncate", Path: name, Err: stdfs.ErrClosed}
+// Link creates newname as a hard link to the oldname file. If there is
+// an error, it will be of type *os.LinkError.
+func (fs *pbFS) Link(oldname, newname string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	linkErr := os.LinkError{
+		Op:  "link",
+		Old: oldname,
+		New: newname,
 	}
 
-	path := inode.Abs(fs.cwd, name)
-	child, err := fs.root.Resolve(path)
+	oldr, err := fs.resolve(oldname, false)
+	if err == nil && oldr.node == nil {
+		err = syscall.ENOENT
+	}
 	if err != nil {
-		return err
+		linkErr.Err = err
+		return &linkErr
+	}
+	if oldr.node.IsDir() {
+		linkErr.Err = syscall.EPERM
+		return &linkErr
+	}
+	if oldr.node.IsImmutable() {
+		linkErr.Err = stdfs.ErrPermission
+		return &linkErr
+	}
+
+	newr, err := fs.resolve(newname, false)
+	if err == nil && newr.node != nil {
+		err = stdfs.ErrExist
+	}
+	if err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+
+	if err := newr.parent.Link(newr.name, oldr.node); err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+	fs.notify(Create, newr.path)
+
+	return nil
+}
+
+// LinksTo returns the absolute paths of every hard link to the named
+// file, sorted lexically. The file itself is not dereferenced if it is a
+// symbolic link. If there is an error, it will be of type *fs.PathError.
+func (fs *pbFS) LinksTo(name string) ([]string, error) {
+	node, err := fs.lookup("linksto", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	walkInodes("/", fs.root, func(name string, n *inode.Inode) bool {
+		if n == node {
+			paths = append(paths, name)
+		}
+		return true
+	})
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// Usage returns the number of regular files in the VFS and the number of
+// bytes of sealed data held in memory for all files reachable from the
+// root, which doesn't include data that has been spilled to disk. Files
+// with multiple hard links, and blocks shared between files when
+// deduplication is enabled, are only counted once.
+func (fs *pbFS) Usage() (files int, bytes int64) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	fs.walkUsage(func(_ string, node *inode.Inode, n int64) {
+		if node.Mode.IsRegular() {
+			files++
+		}
+		bytes += n
+	})
+
+	return files, bytes
+}
+
+// EncryptCount returns the number of times a block of the named file's
+// contents has been encrypted, which measures how much work writes to it
+// have caused. Only the blocks a write overlaps are re-encrypted, so
+// appending to a file costs the same however large it is. Blocks shared
+// with other files by Dedup aren't encrypted again, and aren't counted,
+// and nothing is counted if the VFS was created with NoEncryption.
+func (fs *pbFS) EncryptCount(name string) (uint64, error) {
+	node, err := fs.lookup("encryptcount", name, true)
+	if err != nil {
+		return 0, err
+	}
+
+	fs.mtx.RLock()
+	data := fs.data[int(node.Ino)]
+	fs.mtx.RUnlock()
+
+	data.mtx.RLock()
+	defer data.mtx.RUnlock()
+
+	return data.seals, nil
+}
+
+// StatFS reports the space available to file contents in the VFS, like
+// statfs(2) does for a disk. total is the MaxBytes limit the VFS was
+// created with, and used is the total size of the contents of all files
+// counted against it, including removed files that are still open. free
+// is the space left before writes fail with ENOSPC. If there is no limit,
+// total and free are zero.
+func (fs *pbFS) StatFS() (total, used, free int64) {
+	total = fs.quota.max
+	used = atomic.LoadInt64(&fs.quota.used)
+	if total > 0 {
+		free = max64(total-used, 0)
+	}
+
+	return total, used, free
+}
+
+// UsageByType breaks the bytes counted by Usage down by the top-level
+// directory the files are in, to help find what is using memory. Files
+// directly in the root directory are counted under "/". Data shared by
+// files in different directories is counted under the first directory
+// in lexical order.
+func (fs *pbFS) UsageByType() map[string]int64 {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+
+	usage := make(map[string]int64)
+	fs.walkUsage(func(name string, _ *inode.Inode, n int64) {
+		top := "/"
+		if elems := splitPath(name); len(elems) > 1 {
+			top += elems[0]
+		}
+		usage[top] += n
+	})
+
+	return usage
+}
+
+// walkUsage calls fn once with a path and the inode of every file other
+// than directories reachable from the root, along with the number of
+// bytes of sealed data held in memory for it that haven't already been
+// counted. The caller must hold fs.mtx for reading.
+func (fs *pbFS) walkUsage(fn func(name string, node *inode.Inode, bytes int64)) {
+	seen := make(map[uint64]bool)
+	blocks := make(map[*sealedBlock]bool)
+	walkInodes("/", fs.root, func(name string, node *inode.Inode) bool {
+		if node.IsDir() || seen[node.Ino] {
+			return true
+		}
+		seen[node.Ino] = true
+
+		fn(name, node, fs.data[int(node.Ino)].sealedSize(blocks))
+
+		return true
+	})
+}
+
+// walkInodes calls fn with the path and inode of node and of every file
+// beneath it, in lexical order. The entries of each directory are
+// snapshotted before they are visited, so fn may modify the tree.
+// Symbolic links are not followed. The walk stops early, returning
+// false, if fn returns false.
+func walkInodes(name string, node *inode.Inode, fn func(name string, node *inode.Inode) bool) bool {
+	if !fn(name, node) {
+		return false
+	}
+	if !node.IsDir() {
+		return true
+	}
+
+	node.RLock()
+	entries := node.Dir.Entries()
+	node.RUnlock()
+
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		if !walkInodes(path.Join(name, e.Name), e.Inode, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Symlink creates newname as a symbolic link to oldname. If there is an
+// error, it will be of type *os.LinkError.
+func (fs *pbFS) Symlink(oldname, newname string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	linkErr := os.LinkError{
+		Op:  "symlink",
+		Old: oldname,
+		New: newname,
 	}
 
+	r, err := fs.resolve(newname, false)
+	if err == nil && r.node != nil {
+		err = stdfs.ErrExist
+	}
+	if err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+
+	if err := fs.allocInode(); err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+
+	node := fs.stamp(fs.ino.New(stdfs.ModeSymlink | stdfs.ModePerm))
+	sfile := fs.newSealedFile()
+	target := []byte(oldname)
+	err = sfile.encrypt(target)
+	core.Wipe(target)
+	if err != nil {
+		fs.ino.SubIno()
+		fs.inodes--
+		sfile.remove()
+		linkErr.Err = err
+		return &linkErr
+	}
+	node.Size = int64(len(oldname))
+
+	if err := r.parent.Link(r.name, node); err != nil {
+		fs.ino.SubIno()
+		fs.inodes--
+		sfile.remove()
+		linkErr.Err = err
+		return &linkErr
+	}
+	fs.data = append(fs.data, sfile)
+	fs.notify(Create, r.path)
+
+	return nil
+}
+
+// Readlink returns the destination of the named symbolic link. If there
+// is an error, it will be of type *fs.PathError.
+func (fs *pbFS) Readlink(name string) (string, error) {
+	node, err := fs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.Mode&stdfs.ModeSymlink == 0 {
+		return "", &stdfs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+
+	target, err := fs.readlink(node)
+	if err != nil {
+		return "", &stdfs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+func (fs *pbFS) readlink(node *inode.Inode) (string, error) {
+	target, err := fs.data[int(node.Ino)].decrypt()
+	if err != nil {
+		return "", err
+	}
+	defer core.Wipe(target)
+
+	return string(target), nil
+}
+
+// Realpath returns the canonical absolute form of name, with all symbolic
+// links resolved and all "." and ".." elements removed. The named file
+// must exist. It is the VFS analogue of realpath(3). If there is an error,
+// it will be of type *fs.PathError.
+func (fs *pbFS) Realpath(name string) (string, error) {
+	return fs.realpath("realpath", name)
+}
+
+// EvalSymlinks returns the absolute path of the named file after
+// following every symbolic link in it, like filepath.EvalSymlinks except
+// that the result is always absolute. At most 40 symbolic links are
+// followed, so loops fail with syscall.ELOOP. The named file must exist.
+// If there is an error, it will be of type *fs.PathError.
+func (fs *pbFS) EvalSymlinks(name string) (string, error) {
+	return fs.realpath("evalsymlinks", name)
+}
+
+func (fs *pbFS) realpath(op, name string) (string, error) {
 	fs.mtx.RLock()
-	file := fs.data[child.Ino]
+	r, err := fs.resolve(name, true)
 	fs.mtx.RUnlock()
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return "", &stdfs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return r.path, nil
+}
+
+// maxSymlinks is the maximum number of symbolic links that will be
+// followed while resolving a single path.
+const maxSymlinks = 40
+
+// resolved is the result of resolving a path in the VFS.
+type resolved struct {
+	path   string       // absolute path of the final element, free of symlinks
+	parent *inode.Inode // directory containing the final element
+	name   string       // name of the final element in parent
+	node   *inode.Inode // final element, nil if it does not exist
+}
+
+// resolve walks name one element at a time, following symbolic links in
+// every directory element, and in the final element as well if follow is
+// true. If only the final element does not exist, resolve returns a result
+// with a nil node so callers may create it.
+func (fs *pbFS) resolve(name string, follow bool) (*resolved, error) {
+	node, cur := fs.root, "/"
+	if !path.IsAbs(name) {
+		node, cur = fs.dir, fs.cwd
+	}
 
-	var plaintext []byte
-	if file.f.node.Size != 0 {
-		file.f.mtx.RLock()
-		key, err := file.key.Open()
+	var links int
+	elems := splitPath(name)
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+
+		if !node.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+
+		switch elem {
+		case ".":
+			continue
+		case "..":
+			// never walk above the root
+			if node != fs.root {
+				parent, err := node.Resolve("..")
+				if err != nil {
+					return nil, err
+				}
+				node, cur = parent, path.Dir(cur)
+			}
+			continue
+		}
+
+		child, err := node.Resolve(elem)
 		if err != nil {
-			return err
+			if len(elems) == 0 && errors.Is(err, stdfs.ErrNotExist) {
+				// a directory that was removed while it was the
+				// working directory must not have files created in it
+				if fs.isRemoved(node) {
+					return nil, syscall.ENOENT
+				}
+				return &resolved{
+					path:   path.Join(cur, elem),
+					parent: node,
+					name:   elem,
+				}, nil
+			}
+			return nil, err
+		}
+
+		if child.Mode&stdfs.ModeSymlink != 0 && (len(elems) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, syscall.ELOOP
+			}
+
+			target, err := fs.readlink(child)
+			if err != nil {
+				return nil, err
+			}
+			if path.IsAbs(target) {
+				node, cur = fs.root, "/"
+			}
+			elems = append(splitPath(target), elems...)
+			continue
 		}
 
-		plaintext = make([]byte, file.f.node.Size)
-		_, err = core.Decrypt(file.ciphertext, key.Bytes(), plaintext)
+		if len(elems) == 0 {
+			return &resolved{
+				path:   path.Join(cur, elem),
+				parent: node,
+				name:   elem,
+				node:   child,
+			}, nil
+		}
+		node, cur = child, path.Join(cur, elem)
+	}
+
+	// the path ended in a directory reached by "." or "..", or
+	// named the starting directory itself
+	parent := fs.root
+	if node != fs.root {
+		var err error
+		parent, err = node.Resolve("..")
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		key.Destroy()
-		file.f.mtx.RUnlock()
-	} else if size == 0 { // data is already nil, no-op
-		return nil
+	return &resolved{
+		path:   cur,
+		parent: parent,
+		name:   path.Base(cur),
+		node:   node,
+	}, nil
+}
+
+// lookup returns the inode of the named file, following symbolic links
+// in the final element if follow is true. If there is an error, it will
+// be of type *fs.PathError.
+func (fs *pbFS) lookup(op, name string, follow bool) (*inode.Inode, error) {
+	fs.mtx.RLock()
+	r, err := fs.resolve(name, follow)
+	fs.mtx.RUnlock()
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return nil, &stdfs.PathError{Op: op, Path: name, Err: err}
 	}
 
-	// TODO: should this be copied in constant time?
-	if size <= file.f.node.Size {
-		plaintext = plaintext[:int(size)]
-		newKey := memguard.NewBufferFromBytes(fastrand.Bytes(keySize))
+	return r.node, nil
+}
 
-		file.f.mtx.Lock()
-		file.ciphertext, err = core.Encrypt(plaintext, newKey.Bytes())
-		file.key = newKey.Seal()
-		file.f.updateSize()
-		file.f.mtx.Unlock()
+// splitPath splits name into its non-empty elements.
+func splitPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool { return r == PathSeparator })
+}
 
-		core.Wipe(plaintext)
-		if err != nil {
-			return err
+func (fs *pbFS) Rename(oldpath, newpath string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	linkErr := os.LinkError{
+		Op:  "rename",
+		Old: oldpath,
+		New: newpath,
+	}
+
+	// resolve both paths to their real locations, so symlinked
+	// parent directories are followed
+	oldr, err := fs.resolve(oldpath, false)
+	if err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+	// as with rename(2), the parent directories of both paths must be
+	// valid before a missing oldpath is reported
+	newr, err := fs.resolve(newpath, false)
+	if err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+	if oldr.node == nil {
+		linkErr.Err = syscall.ENOENT
+		return &linkErr
+	}
+	if oldr.node == fs.root {
+		linkErr.Err = errors.New("the root folder may not be moved or renamed")
+		return &linkErr
+	}
+	if oldr.node.IsImmutable() || (newr.node != nil && newr.node.IsImmutable()) {
+		linkErr.Err = stdfs.ErrPermission
+		return &linkErr
+	}
+
+	err = fs.root.Rename(oldr.path, newr.path)
+	if err != nil {
+		linkErr.Err = err
+		return &linkErr
+	}
+	// the file newpath referred to may have been replaced
+	if newr.node != nil && newr.node != oldr.node {
+		fs.unlinked(newr.node)
+	}
+	if newr.node != oldr.node {
+		fs.notify(Rename, oldr.path)
+		fs.notify(Create, newr.path)
+	}
+
+	return nil
+}
+
+// Remove removes the named file or empty directory. A file that is open
+// when its last link is removed stays usable through the open handles, as
+// on POSIX systems, and its contents are freed once they are all closed.
+func (fs *pbFS) Remove(name string) error {
+	_, err := fs.remove(name)
+	return err
+}
+
+// RemoveInfo removes the named file or empty directory like Remove, and
+// returns a FileInfo describing it, as Lstat would have just before it
+// was removed. This lets callers record what was removed.
+func (fs *pbFS) RemoveInfo(name string) (stdfs.FileInfo, error) {
+	fi, err := fs.remove(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+func (fs *pbFS) remove(name string) (*FileInfo, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	r, err := fs.resolve(name, false)
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if r.node == fs.root {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	if r.node.IsImmutable() {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: stdfs.ErrPermission}
+	}
+
+	if r.node.IsDir() && r.node.HasChildren() {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	trash, err := fs.trashes(r)
+	if err != nil {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if trash {
+		if err := fs.moveToTrash(r); err != nil {
+			return nil, &stdfs.PathError{Op: "remove", Path: name, Err: err}
 		}
-		return nil
+		fs.notify(Remove, r.path)
+		return &FileInfo{r.name, r.node}, nil
 	}
 
-	data := make([]byte, int(size))
-	core.Move(data, plaintext)
+	if err := r.parent.Unlink(r.name); err != nil {
+		return nil, &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	fs.unlinked(r.node)
+	fs.trash.forget(r.path)
+	fs.notify(Remove, r.path)
+
+	return &FileInfo{r.name, r.node}, nil
+}
 
-	newKey := memguard.NewBufferFromBytes(fastrand.Bytes(keySize))
+// RemoveAll removes name and any children it contains. Like Remove, it
+// leaves files that are open usable through their handles, while handles
+// to removed directories see them as empty.
+func (fs *pbFS) RemoveAll(name string) error {
+	return fs.RemoveAllContext(context.Background(), name)
+}
 
-	file.f.mtx.Lock()
-	file.ciphertext, err = core.Encrypt(data, newKey.Bytes())
-	file.key = newKey.Seal()
-	file.f.updateSize()
-	file.f.mtx.Unlock()
+// RemoveAllContext is like RemoveAll, but stops with the error of ctx if
+// it is done before every file in the tree has been visited. Nothing is
+// removed if it stops early.
+func (fs *pbFS) RemoveAllContext(ctx context.Context, name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
 
-	core.Wipe(data)
+	r, err := fs.resolve(name, false)
+	if err != nil {
+		// removing a path that doesn't exist is not an error
+		if errors.Is(err, stdfs.ErrNotExist) {
+			return nil
+		}
+		return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if r.node == nil {
+		return nil
+	}
+	if r.node == fs.root {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if err := fs.removeAll(ctx, r); err != nil {
+		return &stdfs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	fs.notify(Remove, r.path)
+
+	return nil
+}
+
+// removeAll removes the file r refers to and any children it contains,
+// or moves them to the trash. The caller must hold fs.mtx for writing.
+func (fs *pbFS) removeAll(ctx context.Context, r *resolved) error {
+	// collect every file in the tree before it is unlinked, so their
+	// contents can be freed afterwards. Nothing is removed if any of
+	// them are immutable, or if ctx is done first.
+	var (
+		nodes []*inode.Inode
+		err   error
+	)
+	walkInodes(r.path, r.node, func(_ string, node *inode.Inode) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		if node.IsImmutable() {
+			err = stdfs.ErrPermission
+			return false
+		}
+		nodes = append(nodes, node)
+		return true
+	})
 	if err != nil {
 		return err
 	}
 
+	trash, err := fs.trashes(r)
+	if err != nil {
+		return err
+	}
+	if trash {
+		return fs.moveToTrash(r)
+	}
+
+	r.node.UnlinkAll()
+
+	if err := r.parent.Unlink(r.name); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		fs.unlinked(node)
+	}
+	fs.trash.forget(r.path)
+
 	return nil
 }
 
+func (fs *pbFS) Truncate(name string, size int64) error {
+	if size < 0 {
+		return &stdfs.PathError{Op: "truncate", Path: name, Err: syscall.EINVAL}
+	}
+
+	node, err := fs.lookup("truncate", name, true)
+	if err != nil {
+		return err
+	}
+	if node.IsDir() {
+		return &stdfs.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+
+	f, err := fs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+
+	return err
+}
+
+// WalkDir walks the file tree rooted at root, calling fn for each file
+// or directory in the tree, including root, as fs.WalkDir does. Files
+// are always visited in lexical order, as both ReadDir and the ReadDir
+// method of directories return entries sorted by name.
 func (fs *pbFS) WalkDir(root string, fn stdfs.WalkDirFunc) error {
+	fsys := fs.FS()
 	if path.IsAbs(root) {
 		if root == "/" {
 			root = "."
 		} else {
 			root = root[1:]
 		}
+	} else if cwd, _ := fs.Getwd(); cwd != "/" {
+		// relative roots are walked from the working directory, as
+		// names in the io/fs view are relative to the root
+		var err error
+		if fsys, err = fsys.(stdFS).Sub(cwd[1:]); err != nil {
+			return err
+		}
 	}
 
-	return stdfs.WalkDir(fs.FS(), root, fn)
+	return stdfs.WalkDir(fsys, root, fn)
+}
+
+// WalkDirContext is like WalkDir, but stops with the error of ctx if it
+// is done before every file in the tree has been visited.
+func (fs *pbFS) WalkDirContext(ctx context.Context, root string, fn stdfs.WalkDirFunc) error {
+	return fs.WalkDir(root, walkDirFuncContext(ctx, fn))
+}
+
+// walkDirFuncContext returns a WalkDirFunc that calls fn for every file
+// until ctx is done, and returns the error of ctx after that.
+func walkDirFuncContext(ctx context.Context, fn stdfs.WalkDirFunc) stdfs.WalkDirFunc {
+	return func(name string, d stdfs.DirEntry, err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return fn(name, d, err)
+	}
+}
+
+// All returns an iterator over the file tree rooted at root, yielding
+// the path and directory entry of every file and directory in the same
+// lexical order as WalkDir, root included. Each directory's entries are
+// snapshotted when it is reached, so the tree may be changed while
+// iterating. Symbolic links other than root are not followed.
+//
+// Errors are surfaced in-band: if the tree cannot be walked, the final
+// pair yielded has a *WalkError as its entry. As the tree is held in
+// memory, this only happens when root itself cannot be resolved.
+func (fs *pbFS) All(root string) iter.Seq2[string, stdfs.DirEntry] {
+	return func(yield func(string, stdfs.DirEntry) bool) {
+		fs.mtx.RLock()
+		r, err := fs.resolve(root, true)
+		fs.mtx.RUnlock()
+		if err == nil && r.node == nil {
+			err = syscall.ENOENT
+		}
+		if err != nil {
+			yield(root, &WalkError{Path: root, Err: err})
+			return
+		}
+
+		walkInodes(root, r.node, func(name string, node *inode.Inode) bool {
+			return yield(name, &DirEntry{path.Base(name), node})
+		})
+	}
 }
 
 func (fs *pbFS) Abs(p string) (string, error) {
@@ -581,30 +1775,20 @@ func (fs *pbFS) Chdir(name string) (err error) {
 	fs.mtx.Lock()
 	defer fs.mtx.Unlock()
 
-	if name == "/" {
-		fs.cwd = "/"
-		fs.dir = fs.root
-		return nil
+	r, err := fs.resolve(name, true)
+	if err == nil && r.node == nil {
+		err = syscall.ENOENT
 	}
-
-	wd := fs.root
-	cwd := name
-	if !path.IsAbs(name) {
-		cwd = path.Join(fs.cwd, name)
-		wd = fs.dir
-	}
-
-	node, err := wd.Resolve(name)
 	if err != nil {
 		return &stdfs.PathError{Op: "chdir", Path: name, Err: err}
 	}
 
-	if !node.IsDir() {
+	if !r.node.IsDir() {
 		return &stdfs.PathError{Op: "chdir", Path: name, Err: syscall.ENOTDIR}
 	}
 
-	fs.cwd = cwd
-	fs.dir = node
+	fs.cwd = r.path
+	fs.dir = r.node
 
 	return nil
 }
@@ -2,6 +2,9 @@ package vfs
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -10,13 +13,20 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"testing/fstest"
 	"testing/iotest"
 	"time"
 
+	"github.com/awnumar/memguard/core"
+
 	"github.com/capnspacehook/pandorasbox/absfs"
+	"github.com/capnspacehook/pandorasbox/inode"
 	"github.com/capnspacehook/pandorasbox/ioutil"
 )
 
@@ -279,7 +289,31 @@ func TestMkdirTree(t *testing.T) {
 		t.Errorf("Expected error creating directory with non-existing parent")
 	}
 
-	// TODO: Subdir of file
+	err = ioutil.WriteFile(vfs, "/home/file", []byte(abc), 0666)
+	if err != nil {
+		t.Fatalf("Unexpected error creating file /home/file: %s", err)
+	}
+
+	err = vfs.Mkdir("/home/file/subdir", 0)
+	if !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Expected %v creating directory under a file, got %v", syscall.ENOTDIR, err)
+	}
+}
+
+func TestCreateUnderFile(t *testing.T) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/foo", []byte(abc), 0666); err != nil {
+		t.Fatalf("Unexpected error creating file: %s", err)
+	}
+
+	_, err := vfs.OpenFile("/foo/bar", os.O_RDWR|os.O_CREATE, 0666)
+	perr, ok := err.(*fs.PathError)
+	if !ok {
+		t.Fatalf("OpenFile: got %T(%v), want *fs.PathError", err, err)
+	}
+	if perr.Op != "open" || perr.Path != "/foo/bar" || perr.Err != syscall.ENOTDIR {
+		t.Errorf("OpenFile: got %v, want open /foo/bar: %v", perr, syscall.ENOTDIR)
+	}
 }
 
 func TestRemove(t *testing.T) {
@@ -328,6 +362,513 @@ func TestRemove(t *testing.T) {
 	}*/
 }
 
+func TestRemoveDir(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	// remove non empty directory
+	err := vfs.Remove("/dir")
+	if err == nil {
+		t.Fatalf("Expected remove of non empty directory to fail")
+	}
+	if !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Remove: got %v, want %v", err, syscall.ENOTEMPTY)
+	}
+
+	if err := vfs.Remove("/dir/file"); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+
+	// remove empty directory
+	if err := vfs.Remove("/dir"); err != nil {
+		t.Errorf("Remove failed: %s", err)
+	}
+	if _, err := vfs.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of removed directory: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestRemoveReleasesKeys(t *testing.T) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/file", make([]byte, 2*blockSize), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/other", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	blocks := append([]*sealedBlock(nil), sealedData(t, vfs, "/file").blocks...)
+	other := sealedData(t, vfs, "/other")
+
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	for i, b := range blocks {
+		if b.key != nil {
+			t.Errorf("key of block %d still held after Remove", i)
+		}
+		if !bytes.Equal(b.ciphertext, make([]byte, len(b.ciphertext))) {
+			t.Errorf("ciphertext of block %d not wiped after Remove", i)
+		}
+	}
+
+	// other files are left alone
+	if other.blocks[0].key == nil {
+		t.Errorf("key of remaining file dropped by Remove")
+	}
+	if b, err := ioutil.ReadFile(vfs, "/other"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile of remaining file = %q, %v; want %q", b, err, abc)
+	}
+}
+
+func TestRemoveWipes(t *testing.T) {
+	for name, remove := range map[string]func(vfs absfs.FileSystem, file string) error{
+		"Remove": func(vfs absfs.FileSystem, file string) error {
+			return vfs.Remove(file)
+		},
+		"RemoveAll": func(vfs absfs.FileSystem, file string) error {
+			return vfs.RemoveAll(path.Dir(file))
+		},
+		"Rename": func(vfs absfs.FileSystem, file string) error {
+			if err := vfs.WriteFile("/other", []byte(abc), 0666); err != nil {
+				return err
+			}
+			return vfs.Rename("/other", file)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			vfs, err := NewFSWithOptions(Options{SpillDir: t.TempDir(), SpillThreshold: blockSize})
+			if err != nil {
+				t.Fatalf("NewFSWithOptions error: %s", err)
+			}
+			if err := vfs.MkdirAll("/small", 0777); err != nil {
+				t.Fatalf("MkdirAll error: %s", err)
+			}
+			if err := vfs.MkdirAll("/large", 0777); err != nil {
+				t.Fatalf("MkdirAll error: %s", err)
+			}
+
+			if err := vfs.WriteFile("/small/file", []byte(abc), 0666); err != nil {
+				t.Fatalf("WriteFile error: %s", err)
+			}
+			ciphertext := sealedData(t, vfs, "/small/file").blocks[0].ciphertext
+			if err := remove(vfs, "/small/file"); err != nil {
+				t.Fatalf("%s error: %s", name, err)
+			}
+			if !bytes.Equal(ciphertext, make([]byte, len(ciphertext))) {
+				t.Errorf("ciphertext not wiped by %s", name)
+			}
+
+			// keep the backing file of a spilled file open to check what
+			// is left of it once it's removed
+			if err := vfs.WriteFile("/large/file", make([]byte, 2*blockSize), 0666); err != nil {
+				t.Fatalf("WriteFile error: %s", err)
+			}
+			backing, err := os.Open(sealedData(t, vfs, "/large/file").backing.Name())
+			if err != nil {
+				t.Fatalf("Open error: %s", err)
+			}
+			defer backing.Close()
+			if err := remove(vfs, "/large/file"); err != nil {
+				t.Fatalf("%s error: %s", name, err)
+			}
+			spilled, err := io.ReadAll(backing)
+			if err != nil {
+				t.Fatalf("ReadAll error: %s", err)
+			}
+			if len(spilled) == 0 || !bytes.Equal(spilled, make([]byte, len(spilled))) {
+				t.Errorf("backing file not wiped by %s", name)
+			}
+		})
+	}
+}
+
+func TestRemoveOpenFile(t *testing.T) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	data := sealedData(t, vfs, "/readme.txt")
+	ciphertext := data.blocks[0].ciphertext
+
+	f, err := vfs.Open("/readme.txt")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	if err := vfs.Remove("/readme.txt"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if entries, err := vfs.ReadDir("/"); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir after Remove = %v, %v; want no entries", entries, err)
+	}
+
+	// the contents stay readable until the last handle is closed
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read after Remove error: %s", err)
+	}
+	if string(b) != abc {
+		t.Errorf("Read after Remove = %q, want %q", b, abc)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	if data.size != 0 || data.blocks != nil {
+		t.Errorf("contents of removed file not freed after Close")
+	}
+	if !bytes.Equal(ciphertext, make([]byte, len(ciphertext))) {
+		t.Errorf("ciphertext of removed file not wiped after Close")
+	}
+}
+
+func TestUnlinked(t *testing.T) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.(*pbFS).Link("/readme.txt", "/link.txt"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	f, err := vfs.Open("/readme.txt")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	defer f.Close()
+	unlinked := f.(interface{ Unlinked() bool }).Unlinked
+
+	if unlinked() {
+		t.Errorf("Unlinked = true for a file in the tree")
+	}
+	if err := vfs.Remove("/readme.txt"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if unlinked() {
+		t.Errorf("Unlinked = true while another link remains")
+	}
+	if err := vfs.Remove("/link.txt"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if !unlinked() {
+		t.Errorf("Unlinked = false after the last link was removed")
+	}
+}
+
+func TestRemoveAllOpenFile(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.MkdirAll("/dir/sub", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	f, err := vfs.OpenFile("/dir/sub/file", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	defer f.Close()
+	d, err := vfs.Open("/dir/sub")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	defer d.Close()
+
+	if err := vfs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+
+	// like an unlinked file on POSIX systems, the file stays usable
+	// through handles that were open when it was removed
+	if _, err := f.WriteString(abc); err != nil {
+		t.Fatalf("Write after RemoveAll error: %s", err)
+	}
+	b := make([]byte, len(abc))
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("ReadAt after RemoveAll error: %s", err)
+	} else if string(b) != abc {
+		t.Errorf("ReadAt after RemoveAll = %q, want %q", b, abc)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat after RemoveAll error: %s", err)
+	}
+	if nlink := fi.Sys().(*inode.Inode).Nlink; nlink != 0 {
+		t.Errorf("Nlink after RemoveAll = %d, want 0", nlink)
+	}
+	if entries, err := d.ReadDir(-1); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir of removed directory = %v, %v; want no entries", entries, err)
+	}
+
+	// but it can't be reached from the tree any longer
+	if _, err := vfs.Stat("/dir/sub/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of removed file: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if files, _ := vfs.(*pbFS).Usage(); files != 0 {
+		t.Errorf("Usage after RemoveAll = %d files, want 0", files)
+	}
+}
+
+func TestRemoveInfo(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0750); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := vfs.WriteFile("/dir/file", []byte(abc), 0640); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := vfs.Chtimes("/dir/file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes error: %s", err)
+	}
+
+	for _, name := range []string{"/dir/file", "dir"} {
+		want, err := vfs.Lstat(name)
+		if err != nil {
+			t.Fatalf("Lstat error: %s", err)
+		}
+		fi, err := vfs.RemoveInfo(name)
+		if err != nil {
+			t.Fatalf("RemoveInfo(%q) error: %s", name, err)
+		}
+		if fi.Name() != want.Name() || fi.Size() != want.Size() || fi.Mode() != want.Mode() || !fi.ModTime().Equal(want.ModTime()) {
+			t.Errorf("RemoveInfo(%q) = %s %d %v %v; want %s %d %v %v", name,
+				fi.Name(), fi.Size(), fi.Mode(), fi.ModTime(),
+				want.Name(), want.Size(), want.Mode(), want.ModTime())
+		}
+		if _, err := vfs.Lstat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Lstat after RemoveInfo(%q): got %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+
+	if fi, err := vfs.RemoveInfo("/dir"); fi != nil || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("RemoveInfo of nonexistent file = %v, %v; want nil, %v", fi, err, fs.ErrNotExist)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.WriteFile("/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	value := []byte("text/plain")
+	if err := vfs.Setxattr("/file", "user.mime_type", value); err != nil {
+		t.Fatalf("Setxattr error: %s", err)
+	}
+	// the value is copied
+	value[0] = 'T'
+	if err := vfs.Setxattr("/file", "user.checksum", []byte("1234")); err != nil {
+		t.Fatalf("Setxattr error: %s", err)
+	}
+
+	// attributes travel with the inode
+	if err := vfs.Rename("/file", "/renamed"); err != nil {
+		t.Fatalf("Rename error: %s", err)
+	}
+	keys, err := vfs.Listxattr("/renamed")
+	if err != nil {
+		t.Fatalf("Listxattr error: %s", err)
+	}
+	if want := []string{"user.checksum", "user.mime_type"}; !slices.Equal(keys, want) {
+		t.Errorf("Listxattr = %q, want %q", keys, want)
+	}
+	if b, err := vfs.Getxattr("/renamed", "user.mime_type"); err != nil || string(b) != "text/plain" {
+		t.Errorf("Getxattr = %q, %v; want %q", b, err, "text/plain")
+	}
+
+	if err := vfs.Removexattr("/renamed", "user.checksum"); err != nil {
+		t.Fatalf("Removexattr error: %s", err)
+	}
+	if _, err := vfs.Getxattr("/renamed", "user.checksum"); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("Getxattr of removed attribute: got %v, want %v", err, syscall.ENODATA)
+	}
+	if err := vfs.Removexattr("/renamed", "user.checksum"); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("Removexattr of removed attribute: got %v, want %v", err, syscall.ENODATA)
+	}
+	if _, err := vfs.Listxattr("/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Listxattr of old name: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if err := vfs.SetImmutable("/renamed", true); err != nil {
+		t.Fatalf("SetImmutable error: %s", err)
+	}
+	if err := vfs.Setxattr("/renamed", "user.checksum", nil); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Setxattr of immutable file: got %v, want %v", err, fs.ErrPermission)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	afs, err := NewFSWithOptions(Options{TrashDir: "/.trash"})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	vfs := afs.(*pbFS)
+	if err := vfs.MkdirAll("/dir/sub", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.WriteFile("/dir/sub/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.WriteFile("/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if err := vfs.WriteFile("/file", []byte("new"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if err := vfs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+	for _, name := range []string{"/file", "/dir"} {
+		if _, err := vfs.Lstat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Lstat(%q) after removing: got %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+	entries, err := vfs.ReadDir("/.trash")
+	if err != nil {
+		t.Fatalf("ReadDir error: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d files in the trash, want 3", len(entries))
+	}
+
+	for _, name := range []string{"/.trash", "/"} {
+		if err := vfs.RemoveAll(name); !errors.Is(err, syscall.EBUSY) {
+			t.Errorf("RemoveAll(%q): got %v, want %v", name, err, syscall.EBUSY)
+		}
+	}
+
+	// the most recently removed file is restored first
+	if err := vfs.Restore("/file"); err != nil {
+		t.Fatalf("Restore error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/file"); err != nil || string(b) != "new" {
+		t.Errorf("ReadFile after Restore = %q, %v; want %q", b, err, "new")
+	}
+	if err := vfs.Restore("/file"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Restore over existing file: got %v, want %v", err, fs.ErrExist)
+	}
+	if err := vfs.Restore("/dir"); err != nil {
+		t.Fatalf("Restore error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/dir/sub/file"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile after Restore = %q, %v; want %q", b, err, abc)
+	}
+	if err := vfs.Restore("/dir"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Restore over existing dir: got %v, want %v", err, fs.ErrExist)
+	}
+	if err := vfs.Restore("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Restore of file not in the trash: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	// emptying the trash wipes the files in it
+	entries, err = vfs.ReadDir("/.trash")
+	if err != nil {
+		t.Fatalf("ReadDir error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d files in the trash, want 1", len(entries))
+	}
+	ciphertext := sealedData(t, vfs, path.Join("/.trash", entries[0].Name())).blocks[0].ciphertext
+	if err := vfs.EmptyTrash(); err != nil {
+		t.Fatalf("EmptyTrash error: %s", err)
+	}
+	if !bytes.Equal(ciphertext, make([]byte, len(ciphertext))) {
+		t.Error("ciphertext not wiped by EmptyTrash")
+	}
+	if entries, err := vfs.ReadDir("/.trash"); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir after EmptyTrash = %d entries, %v; want none", len(entries), err)
+	}
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if err := vfs.Restore("/file"); err != nil {
+		t.Errorf("Restore after EmptyTrash error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/file"); err != nil || string(b) != "new" {
+		t.Errorf("ReadFile after Restore = %q, %v; want %q", b, err, "new")
+	}
+	if files, _ := vfs.Usage(); files != 2 {
+		t.Errorf("Usage after EmptyTrash = %d files, want 2", files)
+	}
+}
+
+func TestRemoveAllNonExistent(t *testing.T) {
+	vfs := NewFS()
+
+	if err := vfs.RemoveAll("/does/not/exist"); err != nil {
+		t.Errorf("RemoveAll of nonexistent path: got %v, want nil", err)
+	}
+	if err := vfs.RemoveAll("nonexistent"); err != nil {
+		t.Errorf("RemoveAll of nonexistent relative path: got %v, want nil", err)
+	}
+}
+
+func TestWalkDirContext(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	for i := 0; i < 10; i++ {
+		if err := vfs.MkdirAll(fmt.Sprintf("/dir/%d", i), 0777); err != nil {
+			t.Fatalf("MkdirAll error: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var visited int
+	err := vfs.WalkDirContext(ctx, "/dir", func(_ string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		visited++
+		if visited == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WalkDirContext: got %v, want %v", err, context.Canceled)
+	}
+	if visited != 3 {
+		t.Errorf("WalkDirContext visited %d files after being canceled, want 3", visited)
+	}
+}
+
+func TestRemoveAllContext(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := vfs.WriteFile(fmt.Sprintf("/dir/%d", i), []byte(abc), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := vfs.RemoveAllContext(ctx, "/dir"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RemoveAllContext: got %v, want %v", err, context.Canceled)
+	}
+	// nothing is removed when the walk is canceled
+	if entries, err := vfs.ReadDir("/dir"); err != nil || len(entries) != 10 {
+		t.Errorf("ReadDir after canceled RemoveAllContext = %d entries, %v; want 10", len(entries), err)
+	}
+
+	if err := vfs.RemoveAllContext(context.Background(), "/dir"); err != nil {
+		t.Fatalf("RemoveAllContext error: %s", err)
+	}
+	if _, err := vfs.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after RemoveAllContext: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
 // Read with length 0 should not return EOF.
 func TestRead0(t *testing.T) {
 	vfs := NewFS()
@@ -379,6 +920,46 @@ func TestReadClosed(t *testing.T) {
 	}
 }
 
+// Closing a closed file should return ErrClosed error
+func TestCloseClosed(t *testing.T) {
+	vfs := NewFS()
+	file, err := vfs.Create("testfile")
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	err = file.Close()
+	e, ok := err.(*os.PathError)
+	if !ok {
+		t.Fatalf("Close: %T(%v), want PathError", err, err)
+	}
+	if e.Op != "close" || e.Path != "testfile" || e.Err != os.ErrClosed {
+		t.Errorf("Close: %v, want PathError(close testfile: ErrClosed)", e)
+	}
+}
+
+// Syncing a closed file should return ErrClosed error
+func TestSyncClosed(t *testing.T) {
+	vfs := NewFS()
+	file, err := vfs.Create("testfile")
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	file.Close() // close immediately
+
+	err = file.Sync()
+	e, ok := err.(*os.PathError)
+	if !ok {
+		t.Fatalf("Sync: %T(%v), want PathError", err, err)
+	}
+	if e.Op != "sync" || e.Err != os.ErrClosed {
+		t.Errorf("Sync: %v, want PathError(sync: ErrClosed)", e)
+	}
+}
+
 func TestReadWrite(t *testing.T) {
 	vfs := NewFS()
 	f, err := vfs.OpenFile("/readme.txt", os.O_CREATE|os.O_RDWR, 0666)
@@ -472,17 +1053,92 @@ func TestOpenWO(t *testing.T) {
 	f.Close()
 }
 
-func TestOpenAppend(t *testing.T) {
+func TestOpenSync(t *testing.T) {
 	vfs := NewFS()
-	f, err := vfs.OpenFile("/readme.txt", os.O_CREATE|os.O_RDWR, 0666)
+	f, err := vfs.OpenFile("/readme.txt", os.O_CREATE|os.O_RDWR|os.O_SYNC, 0666)
 	if err != nil {
 		t.Fatalf("Could not open file: %s", err)
 	}
+	defer f.Close()
 
-	// Write first dots
-	if n, err := f.Write([]byte(dots)); err != nil {
+	for i := 0; i < 3; i++ {
+		if n, err := f.Write([]byte(dots)); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		} else if n != len(dots) {
+			t.Errorf("Invalid write count: %d", n)
+		}
+	}
+	if n, err := f.WriteAt([]byte(abc), int64(len(dots))); err != nil {
 		t.Errorf("Unexpected error: %s", err)
-	} else if n != len(dots) {
+	} else if n != len(abc) {
+		t.Errorf("Invalid write count: %d", n)
+	}
+
+	b, err := vfs.ReadFile("/readme.txt")
+	if err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	}
+	if s := string(b); s != dots+abc+dots {
+		t.Errorf("Invalid read: %s", s)
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+
+	for _, name := range []string{"/", ".", "/dir"} {
+		f, err := vfs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q) error: %s", name, err)
+		}
+
+		for op, fn := range map[string]func() error{
+			"Write": func() error {
+				_, err := f.Write([]byte(abc))
+				return err
+			},
+			"WriteAt": func() error {
+				_, err := f.WriteAt([]byte(abc), 0)
+				return err
+			},
+			"ReadFrom": func() error {
+				_, err := f.(io.ReaderFrom).ReadFrom(strings.NewReader(abc))
+				return err
+			},
+			"Truncate": func() error {
+				return f.Truncate(0)
+			},
+			"Read": func() error {
+				_, err := f.Read(make([]byte, 1))
+				return err
+			},
+			"WriteTo": func() error {
+				_, err := f.(io.WriterTo).WriteTo(io.Discard)
+				return err
+			},
+		} {
+			if err := fn(); !errors.Is(err, syscall.EISDIR) {
+				t.Errorf("%s on %q: got %v, want %v", op, name, err, syscall.EISDIR)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestOpenAppend(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.OpenFile("/readme.txt", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Could not open file: %s", err)
+	}
+
+	// Write first dots
+	if n, err := f.Write([]byte(dots)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if n != len(dots) {
 		t.Errorf("Invalid write count: %d", n)
 	}
 	f.Close()
@@ -592,6 +1248,93 @@ func TestTruncateToZero(t *testing.T) {
 	}
 }
 
+func TestTruncateRegrow(t *testing.T) {
+	contents := bytes.Repeat([]byte(dots), (2*blockSize+100)/len(dots))
+	for _, size := range []int64{1, 100, blockSize - 1, blockSize, blockSize + 1, 2 * blockSize} {
+		vfs := NewFS()
+		if err := ioutil.WriteFile(vfs, "/readme.txt", contents, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+		if err := vfs.Truncate("/readme.txt", size); err != nil {
+			t.Fatalf("Truncate(%d) error: %s", size, err)
+		}
+		if err := vfs.Truncate("/readme.txt", int64(len(contents))); err != nil {
+			t.Fatalf("Truncate(%d) error: %s", len(contents), err)
+		}
+
+		// the regrown region must read as zeros, not the old contents
+		b, err := ioutil.ReadFile(vfs, "/readme.txt")
+		if err != nil {
+			t.Fatalf("ReadFile error: %s", err)
+		}
+		if !bytes.Equal(b[:size], contents[:size]) {
+			t.Errorf("Truncate(%d) changed the contents before the new size", size)
+		}
+		if !bytes.Equal(b[size:], make([]byte, len(contents)-int(size))) {
+			t.Errorf("Truncate(%d) then growing the file left stale data", size)
+		}
+	}
+}
+
+func sealedData(t *testing.T, vfs absfs.FileSystem, name string) *sealedFile {
+	fi, err := vfs.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+
+	return vfs.(*pbFS).data[fi.Sys().(*inode.Inode).Ino]
+}
+
+func TestEmptyFile(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.Create("/empty.txt")
+	if err != nil {
+		t.Fatalf("Create error: %s", err)
+	}
+	f.Close()
+
+	b, err := vfs.ReadFile("/empty.txt")
+	if err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	}
+	if b == nil || len(b) != 0 {
+		t.Errorf("ReadFile: got %v, want empty slice", b)
+	}
+	if sfile := sealedData(t, vfs, "/empty.txt"); len(sfile.blocks) != 0 {
+		t.Errorf("empty file has sealed data")
+	}
+
+	// truncating a file to zero should clear all sealed data
+	for _, truncate := range []func() error{
+		func() error {
+			return vfs.Truncate("/empty.txt", 0)
+		},
+		func() error {
+			f, err := vfs.OpenFile("/empty.txt", os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return f.Truncate(0)
+		},
+	} {
+		if err := ioutil.WriteFile(vfs, "/empty.txt", []byte(abc), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+		if err := truncate(); err != nil {
+			t.Fatalf("Truncate error: %s", err)
+		}
+		if sfile := sealedData(t, vfs, "/empty.txt"); len(sfile.blocks) != 0 {
+			t.Errorf("truncated file has sealed data")
+		}
+		if fi, err := vfs.Stat("/empty.txt"); err != nil {
+			t.Errorf("Stat error: %s", err)
+		} else if fi.Size() != 0 {
+			t.Errorf("Filesize should be 0 after truncation")
+		}
+	}
+}
+
 func TestStat(t *testing.T) {
 	vfs := NewFS()
 	f, err := vfs.OpenFile("/readme.txt", os.O_CREATE|os.O_RDWR, 0666)
@@ -634,6 +1377,122 @@ func TestStat(t *testing.T) {
 	}
 }
 
+func TestStatSnapshot(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.WriteFile("/file", []byte(dots), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	fi, err := vfs.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	snap := fi.(*FileInfo).Snapshot()
+	modTime := snap.ModTime()
+
+	f, err := vfs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	if _, err := f.Write([]byte(abc)); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	f.Close()
+
+	if s := fi.Size(); s != int64(len(dots)+len(abc)) {
+		t.Errorf("Live FileInfo has size %d, want %d", s, len(dots)+len(abc))
+	}
+	if s := snap.Size(); s != int64(len(dots)) {
+		t.Errorf("Snapshot has size %d, want %d", s, len(dots))
+	}
+	if !snap.ModTime().Equal(modTime) {
+		t.Errorf("Snapshot ModTime changed from %v to %v", modTime, snap.ModTime())
+	}
+	if snap.Name() != "file" || snap.Mode() != 0644 || snap.IsDir() {
+		t.Errorf("Invalid snapshot: %s %v %t", snap.Name(), snap.Mode(), snap.IsDir())
+	}
+}
+
+func TestStatSpecialModeBits(t *testing.T) {
+	vfs := NewFS()
+
+	tests := []struct {
+		name string
+		dir  bool
+		perm fs.FileMode
+		want fs.FileMode
+	}{
+		{"/setuid", false, os.ModeSetuid | 0755, os.ModeSetuid | 0755},
+		{"/setgid", false, os.ModeSetgid | 0750, os.ModeSetgid | 0750},
+		{"/all", false, os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777, os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777},
+		{"/typebits", false, os.ModeSymlink | os.ModeDevice | 0644, 0644},
+		{"/sticky", true, os.ModeSticky | 0777, os.ModeDir | os.ModeSticky | 0777},
+	}
+	for _, test := range tests {
+		if test.dir {
+			if err := vfs.Mkdir(test.name, test.perm); err != nil {
+				t.Fatalf("Mkdir %s: %v", test.name, err)
+			}
+		} else {
+			f, err := vfs.OpenFile(test.name, os.O_CREATE|os.O_RDWR, test.perm)
+			if err != nil {
+				t.Fatalf("OpenFile %s: %v", test.name, err)
+			}
+			f.Close()
+		}
+
+		fi, err := vfs.Stat(test.name)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", test.name, err)
+		}
+		if fi.Mode() != test.want {
+			t.Errorf("%s: mode %v, want %v", test.name, fi.Mode(), test.want)
+		}
+	}
+}
+
+func TestUmask(t *testing.T) {
+	vfs, err := NewFSWithOptions(Options{Umask: 022})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	pbfs := vfs.(*pbFS)
+
+	if err := ioutil.WriteFile(vfs, "/file", nil, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if old := pbfs.Umask(077); old != 022 {
+		t.Errorf("Umask returned %#o, want %#o", old, 022)
+	}
+	if err := ioutil.WriteFile(vfs, "/private", nil, 0666|os.ModeSetuid); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if old := pbfs.Umask(0); old != 077 {
+		t.Errorf("Umask returned %#o, want %#o", old, 077)
+	}
+	if err := vfs.Mkdir("/open", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+
+	for name, want := range map[string]fs.FileMode{
+		"/file":    0644,
+		"/private": 0600 | os.ModeSetuid,
+		"/dir":     0700 | fs.ModeDir,
+		"/open":    0777 | fs.ModeDir,
+	} {
+		fi, err := vfs.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat error: %s", err)
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s: mode = %v, want %v", name, fi.Mode(), want)
+		}
+	}
+}
+
 func TestStatError(t *testing.T) {
 	vfs := NewFS()
 	path := "no-such-file"
@@ -650,6 +1509,67 @@ func TestStatError(t *testing.T) {
 	}
 }
 
+func TestAccess(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+
+	files := map[string]fs.FileMode{
+		"/none":  0000,
+		"/ro":    0444,
+		"/rw":    0644,
+		"/wo":    0200,
+		"/rx":    0555,
+		"/rwx":   0700,
+		"/group": 0077,
+	}
+	for name, perm := range files {
+		f, err := vfs.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+		if err != nil {
+			t.Fatalf("OpenFile %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	tests := []struct {
+		name string
+		mode AccessMode
+		err  error
+	}{
+		{"/none", F_OK, nil},
+		{"/none", R_OK, fs.ErrPermission},
+		{"/none", W_OK, fs.ErrPermission},
+		{"/none", X_OK, fs.ErrPermission},
+		{"/ro", R_OK, nil},
+		{"/ro", W_OK, fs.ErrPermission},
+		{"/ro", R_OK | W_OK, fs.ErrPermission},
+		{"/rw", R_OK | W_OK, nil},
+		{"/rw", X_OK, fs.ErrPermission},
+		{"/wo", W_OK, nil},
+		{"/wo", R_OK, fs.ErrPermission},
+		{"/rx", R_OK | X_OK, nil},
+		{"/rx", W_OK, fs.ErrPermission},
+		{"/rwx", R_OK | W_OK | X_OK, nil},
+		{"/group", R_OK, fs.ErrPermission},
+		{"/", R_OK | X_OK, nil},
+		{"/missing", F_OK, fs.ErrNotExist},
+		{"/missing", R_OK, fs.ErrNotExist},
+	}
+	for _, test := range tests {
+		err := vfs.Access(test.name, test.mode)
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("Access(%s, %#x): unexpected error: %v", test.name, test.mode, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("Access(%s, %#x): got %v, want %v", test.name, test.mode, err, test.err)
+		}
+		if _, ok := err.(*fs.PathError); !ok {
+			t.Errorf("Access(%s, %#x): got %T, want *fs.PathError", test.name, test.mode, err)
+		}
+	}
+}
+
 func TestFstat(t *testing.T) {
 	vfs := NewFS()
 	filename := "testfile"
@@ -678,142 +1598,949 @@ func TestFstat(t *testing.T) {
 	}
 }
 
-func TestRename(t *testing.T) {
-	const content = "read me"
+func TestSync(t *testing.T) {
 	vfs := NewFS()
-	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(content), 0666); err != nil {
-		t.Errorf("Unexpected error writing file: %s", err)
-	}
-
-	if err := vfs.Rename("/readme.txt", "/README.txt"); err != nil {
-		t.Errorf("Unexpected error renaming file: %s", err)
+	f, err := vfs.Create("/readme.txt")
+	if err != nil {
+		t.Fatalf("Create error: %s", err)
 	}
+	defer f.Close()
 
-	if _, err := vfs.Stat("/readme.txt"); err == nil {
-		t.Errorf("Old file still exists")
+	if _, err := f.WriteString(dots + abc); err != nil {
+		t.Fatalf("WriteString error: %s", err)
 	}
 
-	if _, err := vfs.Stat("/README.txt"); err != nil {
-		t.Errorf("Error stat newfile: %s", err)
+	sfile := sealedData(t, vfs, "/readme.txt")
+	block := sfile.blocks[0]
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync error: %s", err)
 	}
-	if b, err := ioutil.ReadFile(vfs, "/README.txt"); err != nil {
-		t.Errorf("Error reading file: %s", err)
-	} else if s := string(b); s != content {
-		t.Errorf("Invalid content: %s", s)
+	if sfile.blocks[0].key == block.key || bytes.Equal(sfile.blocks[0].ciphertext, block.ciphertext) {
+		t.Errorf("Sync did not re-seal file contents")
 	}
 
-	// Rename unknown file
-	if err := vfs.Rename("/nonexisting.txt", "/goodtarget.txt"); err == nil {
-		t.Errorf("Expected error renaming file")
+	b, err := vfs.ReadFile("/readme.txt")
+	if err != nil {
+		t.Fatalf("ReadFile error: %s", err)
 	}
-
-	// Rename unknown file in nonexisting directory
-	if err := vfs.Rename("/nonexisting/nonexisting.txt", "/goodtarget.txt"); err == nil {
-		t.Errorf("Expected error renaming file")
+	if s := string(b); s != dots+abc {
+		t.Errorf("Invalid read after Sync: %s", s)
 	}
+}
 
-	// Rename existing file to nonexisting directory
-	if err := vfs.Rename("/README.txt", "/nonexisting/nonexisting.txt"); err == nil {
-		t.Errorf("Expected error renaming file")
+func TestBlocks(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.Create("/blocks")
+	if err != nil {
+		t.Fatalf("Create error: %s", err)
 	}
+	defer f.Close()
 
-	if err := vfs.Mkdir("/newdirectory", 0777); err != nil {
-		t.Errorf("Error creating directory: %s", err)
+	want := make([]byte, 3*blockSize+100)
+	rand.Read(want)
+	if _, err := f.Write(want); err != nil {
+		t.Fatalf("Write error: %s", err)
 	}
-
-	if err := vfs.Rename("/README.txt", "/newdirectory/README.txt"); err != nil {
-		t.Errorf("Error renaming file: %s", err)
+	sfile := sealedData(t, vfs, "/blocks")
+	if n := len(sfile.blocks); n != 4 {
+		t.Fatalf("file has %d blocks, want 4", n)
 	}
+	blocks := append([]*sealedBlock(nil), sfile.blocks...)
 
-	// Create the same file again at root
-	if err := ioutil.WriteFile(vfs, "/README.txt", []byte(content), 0666); err != nil {
-		t.Errorf("Unexpected error writing file: %s", err)
+	// a write spanning a block boundary should only re-seal the
+	// blocks it overlaps
+	p := []byte(abc)
+	off := int64(2*blockSize - 10)
+	if _, err := f.WriteAt(p, off); err != nil {
+		t.Fatalf("WriteAt error: %s", err)
 	}
-
-	// Overwrite existing file
-	if err := vfs.Rename("/newdirectory/README.txt", "/README.txt"); err != nil {
-		t.Errorf("Unexpected error renaming file")
+	copy(want[off:], p)
+	for i, b := range sfile.blocks {
+		if changed := b != blocks[i]; changed != (i == 1 || i == 2) {
+			t.Errorf("block %d changed = %t", i, changed)
+		}
 	}
-}
-
-func TestRenameOverwriteDest(t *testing.T) {
-	vfs := NewFS()
-	from, to := "renamefrom", "renameto"
 
-	toData := []byte("to")
-	fromData := []byte("from")
-
-	err := ioutil.WriteFile(vfs, to, toData, 0777)
-	if err != nil {
-		t.Fatalf("write file %q failed: %v", to, err)
+	buf := make([]byte, 3*blockSize)
+	if n, err := f.ReadAt(buf, blockSize/2); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt error: %s", err)
+	} else if !bytes.Equal(buf[:n], want[blockSize/2:blockSize/2+n]) {
+		t.Errorf("ReadAt across blocks returned invalid content")
 	}
 
-	err = ioutil.WriteFile(vfs, from, fromData, 0777)
-	if err != nil {
-		t.Fatalf("write file %q failed: %v", from, err)
+	// writing past the end of the file should leave a zeroed hole
+	// that does not need to be sealed
+	off = 6*blockSize + 1
+	if _, err := f.WriteAt(p, off); err != nil {
+		t.Fatalf("WriteAt error: %s", err)
 	}
-	err = vfs.Rename(from, to)
-	if err != nil {
-		t.Fatalf("rename %q, %q failed: %v", to, from, err)
+	want = append(want, make([]byte, off-int64(len(want)))...)
+	want = append(want, p...)
+	if sfile.blocks[4] != nil || sfile.blocks[5] != nil {
+		t.Errorf("hole in file was sealed")
 	}
 
-	_, err = vfs.Stat(from)
-	if err == nil {
-		t.Errorf("from file %q still exists", from)
+	// shrinking and growing the file should zero the truncated bytes
+	size := int64(blockSize + 5)
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Truncate error: %s", err)
 	}
-	if err != nil && !os.IsNotExist(err) {
-		t.Fatalf("stat from: %v", err)
+	if n := len(sfile.blocks); n != 2 {
+		t.Errorf("truncated file has %d blocks, want 2", n)
 	}
-	toFi, err := vfs.Stat(to)
+	if err := f.Truncate(2 * blockSize); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	want = append(want[:size], make([]byte, 2*blockSize-size)...)
+
+	b, err := vfs.ReadFile("/blocks")
 	if err != nil {
-		t.Fatalf("stat %q failed: %v", to, err)
+		t.Fatalf("ReadFile error: %s", err)
 	}
-	if toFi.Size() != int64(len(fromData)) {
-		t.Errorf(`"to" size = %d; want %d (old "from" size)`, toFi.Size(), len(fromData))
+	if !bytes.Equal(b, want) {
+		t.Errorf("Invalid content after writes and truncation")
 	}
 }
 
-func TestRenameFailed(t *testing.T) {
-	vfs := NewFS()
-	from, to := "renamefrom", "renameto"
-
-	err := vfs.Rename(from, to)
-	switch err := err.(type) {
-	case *os.LinkError:
-		if err.Op != "rename" {
-			t.Errorf("rename %q, %q: err.Op: want %q, got %q", from, to, "rename", err.Op)
+func TestBufPool(t *testing.T) {
+	for _, size := range []int64{1, 2, 3, 100, 4096, blockSize - 1, blockSize} {
+		bp := getBuf(size)
+		buf := *bp
+		if int64(len(buf)) < size || len(buf)&(len(buf)-1) != 0 {
+			t.Fatalf("getBuf(%d) returned buffer of length %d", size, len(buf))
 		}
-		if err.Old != from {
-			t.Errorf("rename %q, %q: err.Old: want %q, got %q", from, to, from, err.Old)
+		for i := range buf {
+			buf[i] = 0xff
 		}
-		if err.New != to {
-			t.Errorf("rename %q, %q: err.New: want %q, got %q", from, to, to, err.New)
+		putBuf(bp)
+
+		// pooled buffers must never contain old plaintext
+		bp = getBuf(size)
+		for _, b := range *bp {
+			if b != 0 {
+				t.Fatalf("getBuf(%d) returned buffer that was not wiped", size)
+			}
 		}
-	case nil:
-		t.Errorf("rename %q, %q: expected error, got nil", from, to)
-	default:
-		t.Errorf("rename %q, %q: expected %T, got %T %v", from, to, new(os.LinkError), err, err)
+		putBuf(bp)
 	}
 }
 
-func TestRenameToDirFailed(t *testing.T) {
+func TestBufPoolReuse(t *testing.T) {
 	vfs := NewFS()
-	from, to := "renamefrom", "renameto"
-
-	vfs.Mkdir(from, 0777)
-	vfs.Mkdir(to, 0777)
+	secret := bytes.Repeat([]byte{0xa5}, 3*blockSize/2)
+	if err := vfs.WriteFile("/secret", secret, 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if _, err := vfs.ReadFile("/secret"); err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	}
+	if err := vfs.Truncate("/secret", blockSize/2); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
 
-	err := vfs.Rename(from, to)
-	switch err := err.(type) {
-	case *os.LinkError:
-		if err.Op != "rename" {
-			t.Errorf("rename %q, %q: err.Op: want %q, got %q", from, to, "rename", err.Op)
+	// buffers the operations above put back in the pool must not hold
+	// any of the plaintext they handled
+	for size := int64(1); size <= 2*blockSize; size *= 2 {
+		var bps []*[]byte
+		for i := 0; i < 4; i++ {
+			bp := getBuf(size)
+			if i := bytes.IndexByte(*bp, 0xa5); i >= 0 {
+				t.Fatalf("getBuf(%d) returned buffer holding plaintext at %d", size, i)
+			}
+			bps = append(bps, bp)
 		}
-		if err.Old != from {
-			t.Errorf("rename %q, %q: err.Old: want %q, got %q", from, to, from, err.Old)
+		for _, bp := range bps {
+			putBuf(bp)
 		}
-		if err.New != to {
-			t.Errorf("rename %q, %q: err.New: want %q, got %q", from, to, to, err.New)
+	}
+}
+
+func TestNoEncryption(t *testing.T) {
+	for _, opts := range []Options{
+		{NoEncryption: true},
+		{NoEncryption: true, Dedup: true},
+		{NoEncryption: true, Compression: flate.BestSpeed},
+		{NoEncryption: true, SpillDir: t.TempDir(), SpillThreshold: blockSize},
+	} {
+		fsys, err := NewFSWithOptions(opts)
+		if err != nil {
+			t.Fatalf("NewFSWithOptions error: %s", err)
+		}
+
+		contents := bytes.Repeat([]byte(dots), blockSize/len(dots)+1)
+		if err := fsys.WriteFile("/file", contents, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+		f, err := fsys.OpenFile("/file", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile error: %s", err)
+		}
+		if _, err := f.WriteAt([]byte(abc), 10); err != nil {
+			t.Fatalf("WriteAt error: %s", err)
+		}
+		f.Close()
+		copy(contents[10:], abc)
+
+		data, err := fsys.ReadFile("/file")
+		if err != nil {
+			t.Fatalf("ReadFile error: %s", err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Errorf("%+v: contents do not match", opts)
+		}
+
+		if n, _ := fsys.(*pbFS).EncryptCount("/file"); n != 0 {
+			t.Errorf("%+v: EncryptCount is %d, want 0", opts, n)
+		}
+		b := sealedData(t, fsys, "/file").blocks[0]
+		stored := b.ciphertext
+		if b.backing != nil {
+			stored = make([]byte, b.clen)
+			if _, err := b.backing.ReadAt(stored, b.off); err != nil {
+				t.Fatalf("ReadAt error: %s", err)
+			}
+		}
+		if b.key != nil || !b.compressed && !bytes.Equal(stored, contents[:blockSize]) {
+			t.Errorf("%+v: block is not stored as plaintext", opts)
+		}
+	}
+
+	// NewFS and NewFSWithOptions still encrypt by default
+	fsys, err := NewFSWithOptions(Options{})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	for _, fsys := range []absfs.FileSystem{NewFS(), fsys} {
+		if err := fsys.WriteFile("/file", []byte(abc), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+		if b := sealedData(t, fsys, "/file").blocks[0]; b.key == nil || bytes.Contains(b.ciphertext, []byte(abc)) {
+			t.Errorf("contents are not encrypted by default")
+		}
+	}
+}
+
+func TestReadDirSeq(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	for i := 9; i >= 0; i-- {
+		if err := ioutil.WriteFile(vfs, fmt.Sprintf("/dir/file_%d", i), nil, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	var names []string
+	for entry, err := range vfs.ReadDirSeq("/dir") {
+		if err != nil {
+			t.Fatalf("ReadDirSeq error: %s", err)
+		}
+		names = append(names, entry.Name())
+		break
+	}
+	if len(names) != 1 || names[0] != "file_0" {
+		t.Errorf("ReadDirSeq yielded %v before break, want [file_0]", names)
+	}
+
+	entries, err := vfs.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("ReadDir error: %s", err)
+	}
+	names = nil
+	for entry, err := range vfs.ReadDirSeq("/dir") {
+		if err != nil {
+			t.Fatalf("ReadDirSeq error: %s", err)
+		}
+		names = append(names, entry.Name())
+	}
+	if len(names) != len(entries) {
+		t.Fatalf("ReadDirSeq yielded %d entries, ReadDir returned %d", len(names), len(entries))
+	}
+	for i, entry := range entries {
+		if names[i] != entry.Name() {
+			t.Errorf("entry %d: ReadDirSeq yielded %q, ReadDir returned %q", i, names[i], entry.Name())
+		}
+	}
+
+	for _, name := range []string{"/nonexistent", "/dir/file_0"} {
+		var gotErr error
+		for _, err := range vfs.ReadDirSeq(name) {
+			gotErr = err
+		}
+		if gotErr == nil {
+			t.Errorf("ReadDirSeq(%q): expected error", name)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.Mkdir("/a/c", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	for _, name := range []string{"/a/file", "/a/b/file", "/z"} {
+		if err := ioutil.WriteFile(vfs, name, nil, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	var walked []string
+	err := vfs.WalkDir("a", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %s", err)
+	}
+
+	var paths []string
+	for path, entry := range vfs.All("a") {
+		if werr, ok := entry.(*WalkError); ok {
+			t.Fatalf("All error: %s", werr)
+		}
+		if entry.IsDir() != (path == "a" || path == "a/b" || path == "a/c") {
+			t.Errorf("%s: IsDir = %t", path, entry.IsDir())
+		}
+		paths = append(paths, path)
+	}
+	if strings.Join(paths, ",") != strings.Join(walked, ",") {
+		t.Errorf("All yielded %v, WalkDir visited %v", paths, walked)
+	}
+
+	// stopping early must not yield any more paths
+	paths = nil
+	for path := range vfs.All("/") {
+		paths = append(paths, path)
+		if len(paths) == 2 {
+			break
+		}
+	}
+	if want := "/,/a"; strings.Join(paths, ",") != want {
+		t.Errorf("All yielded %v before break, want %s", paths, want)
+	}
+
+	var werr *WalkError
+	for _, entry := range vfs.All("/nonexistent") {
+		if e, ok := entry.(*WalkError); ok {
+			werr = e
+		}
+	}
+	if werr == nil || !errors.Is(werr, fs.ErrNotExist) {
+		t.Errorf("All of nonexistent root: got %v, want %v", werr, fs.ErrNotExist)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, keySize)
+	vfs, err := NewFSWithOptions(Options{
+		KeyFunc: func() ([]byte, error) {
+			return append([]byte(nil), key...), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+
+	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(dots+abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/readme.txt"); err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	} else if s := string(b); s != dots+abc {
+		t.Errorf("Invalid content: %s", s)
+	}
+
+	// the contents must have been sealed with the supplied key
+	block := sealedData(t, vfs, "/readme.txt").blocks[0]
+	plaintext := make([]byte, block.len())
+	if _, err := core.Decrypt(block.ciphertext, key, plaintext); err != nil {
+		t.Fatalf("Decrypt with supplied key error: %s", err)
+	}
+	if s := string(plaintext); s != dots+abc {
+		t.Errorf("Invalid decrypted content: %s", s)
+	}
+
+	errKey := errors.New("key source unavailable")
+	for _, tt := range []struct {
+		keyFunc func() ([]byte, error)
+		err     error
+	}{
+		{func() ([]byte, error) { return nil, errKey }, errKey},
+		{func() ([]byte, error) { return make([]byte, keySize-1), nil }, core.ErrInvalidKeyLength},
+	} {
+		vfs, err := NewFSWithOptions(Options{KeyFunc: tt.keyFunc})
+		if err != nil {
+			t.Fatalf("NewFSWithOptions error: %s", err)
+		}
+		f, err := vfs.Create("/readme.txt")
+		if err != nil {
+			t.Fatalf("Create error: %s", err)
+		}
+		_, err = f.Write([]byte(abc))
+		var perr *fs.PathError
+		if !errors.As(err, &perr) || !errors.Is(err, tt.err) {
+			t.Errorf("Write: got %v, want *fs.PathError wrapping %v", err, tt.err)
+		}
+		f.Close()
+	}
+}
+
+func TestFailedWriteRollback(t *testing.T) {
+	errKey := errors.New("key source unavailable")
+	vfs := NewFS().(*pbFS)
+	size := blockSize + 10
+	if err := vfs.WriteFile("/file", bytes.Repeat([]byte{'a'}, size), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	_, used, _ := vfs.StatFS()
+
+	f, err := vfs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	defer f.Close()
+
+	// the write re-seals the last block with part of p, and appends a
+	// block, before sealing the block after it fails
+	s := sealedData(t, vfs, "/file")
+	seals := 0
+	s.newKey = func() ([]byte, error) {
+		if seals++; seals > 2 {
+			return nil, errKey
+		}
+		return randomKey()
+	}
+	p := bytes.Repeat([]byte{'b'}, 2*blockSize)
+	if _, err := f.WriteAt(p, int64(size)); !errors.Is(err, errKey) {
+		t.Fatalf("WriteAt: got %v, want %v", err, errKey)
+	}
+	s.newKey = randomKey
+
+	if n := len(s.blocks); n != 2 {
+		t.Errorf("file has %d blocks after failed write, want 2", n)
+	}
+	if _, got, _ := vfs.StatFS(); got != used {
+		t.Errorf("space used after failed write = %d, want %d", got, used)
+	}
+
+	// growing the file must not bring back what the failed write sealed
+	if err := f.Truncate(int64(4 * blockSize)); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	got, err := vfs.ReadFile("/file")
+	if err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	}
+	if !bytes.Equal(got[size:], make([]byte, len(got)-size)) {
+		t.Errorf("contents past the end of the file before the failed write are not zero")
+	}
+}
+
+func TestStatFSUsage(t *testing.T) {
+	const max = 4 * blockSize
+	fsys, err := NewFSWithOptions(Options{MaxBytes: max})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	vfs := fsys.(*pbFS)
+	if total, used, free := vfs.StatFS(); total != max || used != 0 || free != max {
+		t.Errorf("StatFS of empty VFS = %d, %d, %d; want %d, 0, %d", total, used, free, max, max)
+	}
+
+	if err := vfs.WriteFile("/file", make([]byte, blockSize+1), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if total, used, free := vfs.StatFS(); total != max || used != blockSize+1 || free != max-blockSize-1 {
+		t.Errorf("StatFS after WriteFile = %d, %d, %d; want %d, %d, %d", total, used, free, max, blockSize+1, max-blockSize-1)
+	}
+	if err := vfs.Remove("/file"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if _, used, free := vfs.StatFS(); used != 0 || free != max {
+		t.Errorf("StatFS after Remove = %d used, %d free; want 0, %d", used, free, max)
+	}
+
+	// without a limit only the used space is known
+	vfs = NewFS().(*pbFS)
+	if err := vfs.WriteFile("/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if total, used, free := vfs.StatFS(); total != 0 || used != int64(len(abc)) || free != 0 {
+		t.Errorf("StatFS without limit = %d, %d, %d; want 0, %d, 0", total, used, free, len(abc))
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	const max = 100
+	vfs, err := NewFSWithOptions(Options{MaxBytes: max})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+
+	if err := ioutil.WriteFile(vfs, "/a", make([]byte, 60), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	f, err := vfs.Create("/b")
+	if err != nil {
+		t.Fatalf("Create error: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, max-60)); err != nil {
+		t.Fatalf("Write up to limit error: %s", err)
+	}
+
+	// the VFS is full
+	_, err = f.Write([]byte{0})
+	var perr *fs.PathError
+	if !errors.As(err, &perr) || perr.Op != "write" || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Write past limit: got %v, want write %v", err, syscall.ENOSPC)
+	}
+	if err := vfs.Truncate("/a", 61); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Truncate past limit: got %v, want %v", err, syscall.ENOSPC)
+	}
+	if err := ioutil.WriteFile(vfs, "/c", []byte{0}, 0666); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("WriteFile past limit: got %v, want %v", err, syscall.ENOSPC)
+	}
+	// overwriting existing data doesn't use any more space
+	if _, err := f.WriteAt([]byte(abc), 0); err != nil {
+		t.Errorf("WriteAt within file error: %s", err)
+	}
+
+	// space is reclaimed once a removed file's last handle is closed
+	a, err := vfs.Open("/a")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	if err := vfs.Remove("/a"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if _, err := f.Write([]byte{0}); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Write with removed file open: got %v, want %v", err, syscall.ENOSPC)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if _, err := f.Write(make([]byte, 60)); err != nil {
+		t.Errorf("Write after Remove error: %s", err)
+	}
+
+	if err := vfs.Truncate("/b", 10); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	if err := vfs.MkdirAll("/dir/sub", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/sub/file", make([]byte, max-10), 0666); err != nil {
+		t.Errorf("WriteFile after Truncate error: %s", err)
+	}
+	if err := vfs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/c", make([]byte, max-10), 0666); err != nil {
+		t.Errorf("WriteFile after RemoveAll error: %s", err)
+	}
+}
+
+func TestMaxInodes(t *testing.T) {
+	vfs, err := NewFSWithOptions(Options{MaxInodes: 3})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	pbfs := vfs.(*pbFS)
+
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := pbfs.Symlink("/dir/file", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	// hard links don't use up inodes
+	if err := pbfs.Link("/dir/file", "/dir/hardlink"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	_, err = vfs.Create("/file")
+	var perr *fs.PathError
+	if !errors.As(err, &perr) || perr.Op != "open" || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Create past limit: got %v, want open %v", err, syscall.ENOSPC)
+	}
+	if err := vfs.Mkdir("/dir2", 0777); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Mkdir past limit: got %v, want %v", err, syscall.ENOSPC)
+	}
+	if err := pbfs.Symlink("/dir", "/link2"); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Symlink past limit: got %v, want %v", err, syscall.ENOSPC)
+	}
+	// opening existing files is still allowed
+	if _, err := vfs.ReadFile("/dir/file"); err != nil {
+		t.Errorf("ReadFile at limit error: %s", err)
+	}
+
+	if err := vfs.Remove("/link"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	f, err := vfs.Create("/file")
+	if err != nil {
+		t.Fatalf("Create after Remove error: %s", err)
+	}
+	f.Close()
+
+	if err := vfs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if err := vfs.Mkdir(name, 0777); err != nil {
+			t.Errorf("Mkdir after RemoveAll error: %s", err)
+		}
+	}
+	if err := vfs.Mkdir("/c", 0777); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Mkdir past limit: got %v, want %v", err, syscall.ENOSPC)
+	}
+}
+
+func TestRename(t *testing.T) {
+	const content = "read me"
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(content), 0666); err != nil {
+		t.Errorf("Unexpected error writing file: %s", err)
+	}
+
+	if err := vfs.Rename("/readme.txt", "/README.txt"); err != nil {
+		t.Errorf("Unexpected error renaming file: %s", err)
+	}
+
+	if _, err := vfs.Stat("/readme.txt"); err == nil {
+		t.Errorf("Old file still exists")
+	}
+
+	if _, err := vfs.Stat("/README.txt"); err != nil {
+		t.Errorf("Error stat newfile: %s", err)
+	}
+	if b, err := ioutil.ReadFile(vfs, "/README.txt"); err != nil {
+		t.Errorf("Error reading file: %s", err)
+	} else if s := string(b); s != content {
+		t.Errorf("Invalid content: %s", s)
+	}
+
+	// Rename unknown file
+	if err := vfs.Rename("/nonexisting.txt", "/goodtarget.txt"); err == nil {
+		t.Errorf("Expected error renaming file")
+	}
+
+	// Rename unknown file in nonexisting directory
+	if err := vfs.Rename("/nonexisting/nonexisting.txt", "/goodtarget.txt"); err == nil {
+		t.Errorf("Expected error renaming file")
+	}
+
+	// Rename existing file to nonexisting directory
+	if err := vfs.Rename("/README.txt", "/nonexisting/nonexisting.txt"); err == nil {
+		t.Errorf("Expected error renaming file")
+	}
+
+	if err := vfs.Mkdir("/newdirectory", 0777); err != nil {
+		t.Errorf("Error creating directory: %s", err)
+	}
+
+	if err := vfs.Rename("/README.txt", "/newdirectory/README.txt"); err != nil {
+		t.Errorf("Error renaming file: %s", err)
+	}
+
+	// Create the same file again at root
+	if err := ioutil.WriteFile(vfs, "/README.txt", []byte(content), 0666); err != nil {
+		t.Errorf("Unexpected error writing file: %s", err)
+	}
+
+	// Overwrite existing file
+	if err := vfs.Rename("/newdirectory/README.txt", "/README.txt"); err != nil {
+		t.Errorf("Unexpected error renaming file")
+	}
+}
+
+func TestRenameOverwriteDest(t *testing.T) {
+	vfs := NewFS()
+	from, to := "renamefrom", "renameto"
+
+	toData := []byte("to")
+	fromData := []byte("from")
+
+	err := ioutil.WriteFile(vfs, to, toData, 0777)
+	if err != nil {
+		t.Fatalf("write file %q failed: %v", to, err)
+	}
+
+	err = ioutil.WriteFile(vfs, from, fromData, 0777)
+	if err != nil {
+		t.Fatalf("write file %q failed: %v", from, err)
+	}
+	err = vfs.Rename(from, to)
+	if err != nil {
+		t.Fatalf("rename %q, %q failed: %v", to, from, err)
+	}
+
+	_, err = vfs.Stat(from)
+	if err == nil {
+		t.Errorf("from file %q still exists", from)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("stat from: %v", err)
+	}
+	toFi, err := vfs.Stat(to)
+	if err != nil {
+		t.Fatalf("stat %q failed: %v", to, err)
+	}
+	if toFi.Size() != int64(len(fromData)) {
+		t.Errorf(`"to" size = %d; want %d (old "from" size)`, toFi.Size(), len(fromData))
+	}
+}
+
+func TestRenameOverwriteUsage(t *testing.T) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/large", make([]byte, 4*blockSize), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/small", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	small, err := vfs.Stat("/small")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	want := sealedData(t, vfs, "/small").sealedSize(make(map[*sealedBlock]bool))
+	overwritten := sealedData(t, vfs, "/large")
+
+	if err := vfs.Rename("/small", "/large"); err != nil {
+		t.Fatalf("Rename error: %s", err)
+	}
+
+	// the renamed file keeps its inode, while the one it replaced is freed
+	fi, err := vfs.Stat("/large")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	if !SameFile(fi.(*FileInfo), small.(*FileInfo)) {
+		t.Errorf("renamed file has Ino %d, want %d", fi.Sys().(*inode.Inode).Ino, small.Sys().(*inode.Inode).Ino)
+	}
+	if overwritten.size != 0 || overwritten.blocks != nil {
+		t.Errorf("contents of overwritten file not freed")
+	}
+	if files, bytes := vfs.(*pbFS).Usage(); files != 1 || bytes != want {
+		t.Errorf("Usage after Rename = %d files, %d bytes; want 1 file, %d bytes", files, bytes, want)
+	}
+}
+
+// checkConsistency verifies the structure of the inode tree of vfs: that
+// every directory's "." and ".." entries point to itself and its parent,
+// that directories are only reachable once, that link counts match the
+// entries referring to every inode, and that every inode still has its
+// sealed file.
+func checkConsistency(vfs *pbFS) error {
+	vfs.mtx.RLock()
+	defer vfs.mtx.RUnlock()
+
+	refs := make(map[*inode.Inode]uint64)
+	seen := make(map[*inode.Inode]string)
+	var check func(name string, dir, parent *inode.Inode) error
+	check = func(name string, dir, parent *inode.Inode) error {
+		if prev, ok := seen[dir]; ok {
+			return fmt.Errorf("directory %s is also reachable as %s", name, prev)
+		}
+		seen[dir] = name
+
+		dir.RLock()
+		entries := dir.Dir.Entries()
+		dir.RUnlock()
+
+		var dot, dotdot *inode.Inode
+		for _, e := range entries {
+			refs[e.Inode]++
+			switch e.Name {
+			case ".":
+				dot = e.Inode
+				continue
+			case "..":
+				dotdot = e.Inode
+				continue
+			}
+
+			child := path.Join(name, e.Name)
+			if data := vfs.data[int(e.Inode.Ino)]; data == nil || data.isRemoved() {
+				return fmt.Errorf("%s has no sealed file", child)
+			}
+			if !e.Inode.IsDir() {
+				seen[e.Inode] = child
+				continue
+			}
+			if err := check(child, e.Inode, dir); err != nil {
+				return err
+			}
+		}
+		if dot != dir {
+			return fmt.Errorf(`"." of %s does not refer to itself`, name)
+		}
+		if dotdot != parent {
+			return fmt.Errorf(`".." of %s does not refer to its parent`, name)
+		}
+
+		return nil
+	}
+	if err := check("/", vfs.root, vfs.root); err != nil {
+		return err
+	}
+
+	for node, name := range seen {
+		if node.Nlink != refs[node] {
+			return fmt.Errorf("%s has link count %d, but %d entries refer to it", name, node.Nlink, refs[node])
+		}
+	}
+	if len(seen)-1 != vfs.inodes {
+		return fmt.Errorf("%d inodes are reachable, but %d are allocated", len(seen)-1, vfs.inodes)
+	}
+
+	return nil
+}
+
+func TestRenameStress(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	dirs := []string{"/a", "/b", "/a/c", "/b/d", "/a/c/e"}
+	for _, dir := range dirs {
+		if err := vfs.Mkdir(dir, 0777); err != nil {
+			t.Fatalf("Mkdir error: %s", err)
+		}
+	}
+	names := append(dirs, "/f", "/a/f", "/b/g", "/a/c/h", "/b/d/f", "/a/c/e/g")
+
+	const (
+		workers = 8
+		ops     = 500
+	)
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		go func(seed int64) {
+			defer func() { done <- struct{}{} }()
+
+			// errors are expected, as workers race to move the same
+			// files around; only the final tree is checked
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < ops; i++ {
+				name := names[rnd.Intn(len(names))]
+				other := names[rnd.Intn(len(names))]
+				switch rnd.Intn(6) {
+				case 0, 1:
+					vfs.Rename(name, other)
+				case 2:
+					vfs.WriteFile(name, []byte(abc), 0666)
+				case 3:
+					vfs.Mkdir(name, 0777)
+				case 4:
+					vfs.ReadFile(name)
+				case 5:
+					vfs.ReadDir(name)
+				}
+			}
+		}(int64(w))
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	if err := checkConsistency(vfs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenameDirParent(t *testing.T) {
+	vfs := NewFS()
+	for _, dir := range []string{"/a", "/b", "/a/dir"} {
+		if err := vfs.Mkdir(dir, 0777); err != nil {
+			t.Fatalf("Mkdir %s: %v", dir, err)
+		}
+	}
+
+	if err := vfs.Rename("/a/dir", "/b/dir"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	parent, err := vfs.Stat("/b")
+	if err != nil {
+		t.Fatalf("Stat /b: %v", err)
+	}
+	dotdot, err := vfs.Stat("/b/dir/..")
+	if err != nil {
+		t.Fatalf("Stat /b/dir/..: %v", err)
+	}
+	if !SameFile(parent.(*FileInfo), dotdot.(*FileInfo)) {
+		t.Errorf("/b/dir/.. does not resolve to /b after move")
+	}
+
+	// the moved directory's parent must also be correct when
+	// walking up from inside it
+	if err := vfs.Chdir("/b/dir"); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	if err := vfs.Chdir(".."); err != nil {
+		t.Fatalf("Chdir ..: %v", err)
+	}
+	f, err := vfs.Open(".")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !SameFile(parent.(*FileInfo), fi.(*FileInfo)) {
+		t.Errorf("parent of moved directory is not /b")
+	}
+}
+
+func TestRenameFailed(t *testing.T) {
+	vfs := NewFS()
+	from, to := "renamefrom", "renameto"
+
+	err := vfs.Rename(from, to)
+	switch err := err.(type) {
+	case *os.LinkError:
+		if err.Op != "rename" {
+			t.Errorf("rename %q, %q: err.Op: want %q, got %q", from, to, "rename", err.Op)
+		}
+		if err.Old != from {
+			t.Errorf("rename %q, %q: err.Old: want %q, got %q", from, to, from, err.Old)
+		}
+		if err.New != to {
+			t.Errorf("rename %q, %q: err.New: want %q, got %q", from, to, to, err.New)
+		}
+	case nil:
+		t.Errorf("rename %q, %q: expected error, got nil", from, to)
+	default:
+		t.Errorf("rename %q, %q: expected %T, got %T %v", from, to, new(os.LinkError), err, err)
+	}
+}
+
+func TestRenameToDirFailed(t *testing.T) {
+	vfs := NewFS()
+	from, to := "renamefrom", "renameto"
+
+	vfs.Mkdir(from, 0777)
+	vfs.Mkdir(to, 0777)
+
+	err := vfs.Rename(from, to)
+	switch err := err.(type) {
+	case *os.LinkError:
+		if err.Op != "rename" {
+			t.Errorf("rename %q, %q: err.Op: want %q, got %q", from, to, "rename", err.Op)
+		}
+		if err.Old != from {
+			t.Errorf("rename %q, %q: err.Old: want %q, got %q", from, to, from, err.Old)
+		}
+		if err.New != to {
+			t.Errorf("rename %q, %q: err.New: want %q, got %q", from, to, to, err.New)
 		}
 	case nil:
 		t.Errorf("rename %q, %q: expected error, got nil", from, to)
@@ -822,336 +2549,2622 @@ func TestRenameToDirFailed(t *testing.T) {
 	}
 }
 
-func checkSize(t *testing.T, f absfs.File, size int64) {
-	dir, err := f.Stat()
+func TestCreateWithIno(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	ino := func(name string) *inode.Inode {
+		t.Helper()
+		fi, err := vfs.Lstat(name)
+		if err != nil {
+			t.Fatalf("Lstat error: %s", err)
+		}
+		return fi.Sys().(*inode.Inode)
+	}
+
+	// restore two names that shared inode 10
+	f, err := vfs.CreateWithIno("/a", 10, 0644)
+	if err != nil {
+		t.Fatalf("CreateWithIno error: %s", err)
+	}
+	if _, err := f.Write([]byte(abc)); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	f.Close()
+	f, err = vfs.CreateWithIno("/b", 10, 0600)
+	if err != nil {
+		t.Fatalf("CreateWithIno error: %s", err)
+	}
+	f.Close()
+
+	a, b := ino("/a"), ino("/b")
+	if a != b || a.Ino != 10 || a.Nlink != 2 {
+		t.Errorf("restored names have inodes %d and %d with %d links, want the same inode 10 with 2 links", a.Ino, b.Ino, a.Nlink)
+	}
+	if data, err := vfs.ReadFile("/b"); err != nil || string(data) != abc {
+		t.Errorf("ReadFile of link = %q, %v; want %q", data, err, abc)
+	}
+
+	// inode numbers that were skipped can be used, and new files are
+	// numbered after the highest one
+	f, err = vfs.CreateWithIno("/c", 5, 0644)
+	if err != nil {
+		t.Fatalf("CreateWithIno error: %s", err)
+	}
+	f.Close()
+	if n := ino("/c").Ino; n != 5 {
+		t.Errorf("inode of file restored in a gap = %d, want 5", n)
+	}
+	if err := vfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if n := ino("/dir").Ino; n != 11 {
+		t.Errorf("inode of new directory = %d, want 11", n)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ino  uint64
+		err  error
+	}{
+		{"/d", 11, fs.ErrExist},         // in use by a directory
+		{"/a", 12, fs.ErrExist},         // name exists
+		{"/d", 1, syscall.EINVAL},       // the root
+		{"/d", 1 << 40, syscall.EINVAL}, // too large
+	} {
+		if _, err := vfs.CreateWithIno(tt.name, tt.ino, 0644); !errors.Is(err, tt.err) {
+			t.Errorf("CreateWithIno(%q, %d): got %v, want %v", tt.name, tt.ino, err, tt.err)
+		}
+	}
+	if err := checkConsistency(vfs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLinksTo(t *testing.T) {
+	const content = "read me"
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/file", []byte(content), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/other", []byte(content), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	if err := vfs.Link("/file", "/a/link1"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	if err := vfs.Link("/a/link1", "/a/b/link2"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	if err := vfs.Link("/file", "/other"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Link over existing file: got %v, want %v", err, fs.ErrExist)
+	}
+	if err := vfs.Link("/a", "/dirlink"); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("Link of directory: got %v, want %v", err, syscall.EPERM)
+	}
+
+	// writes through one link are visible through the others
+	if err := ioutil.WriteFile(vfs, "/a/b/link2", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if b, err := ioutil.ReadFile(vfs, "/file"); err != nil {
+		t.Errorf("Error reading file: %s", err)
+	} else if s := string(b); s != abc {
+		t.Errorf("Invalid content: %s", s)
+	}
+
+	want := []string{"/a/b/link2", "/a/link1", "/file"}
+	for _, name := range append(want, "a/link1") {
+		links, err := vfs.LinksTo(name)
+		if err != nil {
+			t.Fatalf("LinksTo(%q) error: %s", name, err)
+		}
+		if strings.Join(links, ",") != strings.Join(want, ",") {
+			t.Errorf("LinksTo(%q) = %v, want %v", name, links, want)
+		}
+	}
+	fi, err := vfs.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	if nlink := fi.Sys().(*inode.Inode).Nlink; nlink != uint64(len(want)) {
+		t.Errorf("Nlink = %d, want %d", nlink, len(want))
+	}
+
+	if err := vfs.Remove("/a/link1"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	links, err := vfs.LinksTo("/file")
+	if err != nil {
+		t.Fatalf("LinksTo error: %s", err)
+	}
+	if want := "/a/b/link2,/file"; strings.Join(links, ",") != want {
+		t.Errorf("LinksTo after remove = %v, want %v", links, want)
+	}
+
+	if _, err := vfs.LinksTo("/nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LinksTo of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if files, bytes := vfs.Usage(); files != 0 || bytes != 0 {
+		t.Errorf("Usage of empty VFS = %d, %d", files, bytes)
+	}
+
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	sizes := map[string]int{
+		"/file":     100,
+		"/a/file":   blockSize + 1,
+		"/a/b/file": 0,
+	}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(vfs, name, make([]byte, size), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+	// a hard link must not be counted twice
+	if err := vfs.Link("/file", "/a/b/link"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	// every non-empty block carries the encryption overhead
+	want := int64(100+core.Overhead) + int64(blockSize+core.Overhead) + int64(1+core.Overhead)
+	if files, bytes := vfs.Usage(); files != len(sizes) || bytes != want {
+		t.Errorf("Usage = %d, %d, want %d, %d", files, bytes, len(sizes), want)
+	}
+
+	if err := vfs.RemoveAll("/a"); err != nil {
+		t.Fatalf("RemoveAll error: %s", err)
+	}
+	want = int64(100 + core.Overhead)
+	if files, bytes := vfs.Usage(); files != 1 || bytes != want {
+		t.Errorf("Usage after RemoveAll = %d, %d, want %d, %d", files, bytes, 1, want)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	const content = "read me"
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/file", []byte(content), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	if err := vfs.Symlink("/dir", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Symlink("file", "/dir/rel"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Symlink("/dir", "/link"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Symlink over existing file: got %v, want %v", err, fs.ErrExist)
+	}
+
+	if target, err := vfs.Readlink("/link"); err != nil {
+		t.Errorf("Readlink error: %s", err)
+	} else if target != "/dir" {
+		t.Errorf("Readlink: got %q, want %q", target, "/dir")
+	}
+	if _, err := vfs.Readlink("/dir/file"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Readlink of regular file: got %v, want %v", err, syscall.EINVAL)
+	}
+
+	if fi, err := vfs.Lstat("/link"); err != nil {
+		t.Errorf("Lstat error: %s", err)
+	} else if fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat: mode %v is not a symlink", fi.Mode())
+	}
+	if fi, err := vfs.Stat("/link"); err != nil {
+		t.Errorf("Stat error: %s", err)
+	} else if !fi.IsDir() {
+		t.Errorf("Stat: mode %v is not a directory", fi.Mode())
+	}
+
+	for _, name := range []string{"/link/file", "/link/rel", "/dir/rel"} {
+		if b, err := ioutil.ReadFile(vfs, name); err != nil {
+			t.Errorf("Error reading %s: %s", name, err)
+		} else if s := string(b); s != content {
+			t.Errorf("Invalid content reading %s: %s", name, s)
+		}
+	}
+
+	// creating a file through a symlinked directory
+	if err := ioutil.WriteFile(vfs, "/link/new", []byte(content), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if _, err := vfs.Stat("/dir/new"); err != nil {
+		t.Errorf("Stat error: %s", err)
+	}
+
+	// creating a file through a dangling symlink creates the target
+	if err := vfs.Symlink("/dir/target", "/dangling"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if _, err := vfs.Stat("/dangling"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of dangling symlink: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := ioutil.WriteFile(vfs, "/dangling", []byte(content), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if _, err := vfs.Stat("/dir/target"); err != nil {
+		t.Errorf("Stat error: %s", err)
+	}
+
+	// removing a symlink removes the link, not the target
+	if err := vfs.Remove("/link"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if _, err := vfs.Stat("/dir/file"); err != nil {
+		t.Errorf("Stat error: %s", err)
+	}
+}
+
+func TestRealpath(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/a/b/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Symlink("/a", "/l"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Symlink("..", "/a/b/up"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Symlink("b/file", "/a/f"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/l/b", "/a/b"},
+		{"/l/./b/../b/", "/a/b"},
+		{"/l/b/up", "/a"},
+		{"/l/b/up/b/up/f", "/a/b/file"},
+		{"/../../l", "/a"},
+		{"l/f", "/a/b/file"},
+	}
+	for _, test := range tests {
+		p, err := vfs.Realpath(test.name)
+		if err != nil {
+			t.Errorf("Realpath(%q) error: %s", test.name, err)
+		} else if p != test.want {
+			t.Errorf("Realpath(%q) = %q, want %q", test.name, p, test.want)
+		}
+	}
+
+	if err := vfs.Chdir("/l/b"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+	if p, err := vfs.Realpath("up/f"); err != nil {
+		t.Errorf("Realpath error: %s", err)
+	} else if p != "/a/b/file" {
+		t.Errorf("Realpath(%q) = %q, want %q", "up/f", p, "/a/b/file")
+	}
+
+	for _, name := range []string{"/nonexistent", "/l/nonexistent", "/nonexistent/b"} {
+		if _, err := vfs.Realpath(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Realpath(%q): got %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+}
+
+func TestEvalSymlinks(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/a/b/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	links := []struct {
+		target, name string
+	}{
+		// a chain of links
+		{"/a/b/file", "/l1"},
+		{"l1", "/l2"},
+		{"a/../l2", "/l3"},
+		// a loop
+		{"loop2", "/loop1"},
+		{"loop1", "/loop2"},
+		{"/self/x", "/self"},
+		// links to nonexistent files
+		{"/nonexistent", "/dangling"},
+		{"dangling", "/to-dangling"},
+	}
+	for _, l := range links {
+		if err := vfs.Symlink(l.target, l.name); err != nil {
+			t.Fatalf("Symlink error: %s", err)
+		}
+	}
+
+	for _, name := range []string{"/l1", "/l2", "l3", "/a/../l3"} {
+		if p, err := vfs.EvalSymlinks(name); err != nil || p != "/a/b/file" {
+			t.Errorf("EvalSymlinks(%q) = %q, %v; want %q", name, p, err, "/a/b/file")
+		}
+	}
+	for _, name := range []string{"/loop1", "/loop2/x", "/self"} {
+		if _, err := vfs.EvalSymlinks(name); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("EvalSymlinks(%q): got %v, want %v", name, err, syscall.ELOOP)
+		}
+	}
+	for _, name := range []string{"/dangling", "/to-dangling", "/a/nonexistent/file"} {
+		_, err := vfs.EvalSymlinks(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("EvalSymlinks(%q): got %v, want %v", name, err, fs.ErrNotExist)
+		}
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) || pathErr.Op != "evalsymlinks" {
+			t.Errorf("EvalSymlinks(%q): error %v is not a *fs.PathError for evalsymlinks", name, err)
+		}
+	}
+}
+
+func checkSize(t *testing.T, f absfs.File, size int64) {
+	dir, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat %q (looking for size %d): %s", f.Name(), size, err)
+	}
+	if dir.Size() != size {
+		t.Errorf("Stat %q: size %d want %d", f.Name(), dir.Size(), size)
+	}
+}
+
+func TestFTruncate(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.Create("testfile")
+	if err != nil {
+		t.Fatal("create failed:", err)
+	}
+	defer f.Close()
+
+	checkSize(t, f, 0)
+	f.Write([]byte("hello, world\n"))
+	checkSize(t, f, 13)
+	f.Truncate(10)
+	checkSize(t, f, 10)
+	f.Truncate(1024)
+	checkSize(t, f, 1024)
+	f.Truncate(0)
+	checkSize(t, f, 0)
+	_, err = f.Write([]byte("surprise!"))
+	if err == nil {
+		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.Create("testfile")
+	if err != nil {
+		t.Fatal("create failed:", err)
+	}
+	defer f.Close()
+
+	checkSize(t, f, 0)
+	f.Write([]byte("hello, world\n"))
+	checkSize(t, f, 13)
+	vfs.Truncate(f.Name(), 10)
+	checkSize(t, f, 10)
+	vfs.Truncate(f.Name(), 1024)
+	checkSize(t, f, 1024)
+	vfs.Truncate(f.Name(), 0)
+	checkSize(t, f, 0)
+	_, err = f.Write([]byte("surprise!"))
+	if err == nil {
+		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	}
+}
+
+func TestTruncateDir(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+
+	for _, name := range []string{"/dir", "/"} {
+		err := vfs.Truncate(name, 0)
+		var perr *fs.PathError
+		if !errors.As(err, &perr) || perr.Op != "truncate" || !errors.Is(err, syscall.EISDIR) {
+			t.Errorf("Truncate(%q): got %v, want truncate %v", name, err, syscall.EISDIR)
+		}
+	}
+}
+
+func TestChdir(t *testing.T) {
+	vfs := NewFS()
+	const N = 10
+	c := make(chan bool)
+	cpwd := make(chan string)
+	for i := 0; i < N; i++ {
+		go func(i int) {
+			// Lock half the goroutines in their own operating system
+			// thread to exercise more scheduler possibilities.
+			if i%2 == 1 {
+				runtime.LockOSThread()
+			}
+			<-c
+			pwd, err := vfs.Getwd()
+			if err != nil {
+				t.Errorf("Getwd on goroutine %d: %v", i, err)
+				return
+			}
+			cpwd <- pwd
+		}(i)
+	}
+	d, err := ioutil.TempDir(vfs, "", "test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	if err := vfs.Chdir(d); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	d, err = vfs.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	close(c)
+	for i := 0; i < N; i++ {
+		pwd := <-cpwd
+		if pwd != d {
+			t.Errorf("Getwd returned %q; want %q", pwd, d)
+		}
+	}
+}
+
+func TestCreateInRemovedDir(t *testing.T) {
+	for _, remove := range []func(absfs.FileSystem, string) error{
+		absfs.FileSystem.Remove,
+		absfs.FileSystem.RemoveAll,
+	} {
+		vfs := NewFS()
+		if err := vfs.Mkdir("/dir", 0777); err != nil {
+			t.Fatalf("Mkdir error: %s", err)
+		}
+		if err := vfs.Chdir("/dir"); err != nil {
+			t.Fatalf("Chdir error: %s", err)
+		}
+		if err := remove(vfs, "/dir"); err != nil {
+			t.Fatalf("remove error: %s", err)
+		}
+
+		if f, err := vfs.OpenFile("file", os.O_RDWR|os.O_CREATE, 0666); !errors.Is(err, fs.ErrNotExist) {
+			if err == nil {
+				f.Close()
+			}
+			t.Errorf("OpenFile in removed directory: got %v, want %v", err, fs.ErrNotExist)
+		}
+		if err := vfs.Mkdir("sub", 0777); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Mkdir in removed directory: got %v, want %v", err, fs.ErrNotExist)
+		}
+		if err := vfs.Mkdir("/dir", 0777); err != nil {
+			t.Errorf("Mkdir of removed directory error: %s", err)
+		}
+		if entries, err := vfs.ReadDir("/"); err != nil || len(entries) != 1 {
+			t.Errorf("ReadDir(/) = %v, %v; want only dir", entries, err)
+		}
+	}
+}
+
+func newFile(testName string, fs absfs.FileSystem, t *testing.T) (f absfs.File) {
+	f, err := ioutil.TempFile(fs, "/", "_Go_"+testName)
+	if err != nil {
+		t.Fatalf("TempFile %s: %s", testName, err)
+	}
+	return
+}
+
+func TestSeek(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestSeek", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	type test struct {
+		in     int64
+		whence int
+		out    int64
+		err    error
+	}
+	tests := []test{
+		{0, io.SeekCurrent, int64(len(data)), nil},
+		{0, io.SeekStart, 0, nil},
+		{5, io.SeekStart, 5, nil},
+		{0, io.SeekEnd, int64(len(data)), nil},
+		{0, io.SeekStart, 0, nil},
+		{-1, io.SeekEnd, int64(len(data)) - 1, nil},
+		{1 << 33, io.SeekStart, 1 << 33, nil},
+		{1 << 33, io.SeekEnd, 1<<33 + int64(len(data)), nil},
+
+		// Issue 21681, Windows 4G-1, etc:
+		{1<<32 - 1, io.SeekStart, 1<<32 - 1, nil},
+		{0, io.SeekCurrent, 1<<32 - 1, nil},
+		{2<<32 - 1, io.SeekStart, 2<<32 - 1, nil},
+		{0, io.SeekCurrent, 2<<32 - 1, nil},
+
+		// seeking before the start fails and keeps the offset
+		{-100, io.SeekEnd, 0, fs.ErrInvalid},
+		{-(2<<32 - 1) - 1, io.SeekCurrent, 0, fs.ErrInvalid},
+		{-1, io.SeekStart, 0, fs.ErrInvalid},
+		{0, io.SeekCurrent, 2<<32 - 1, nil},
+		{0, 3, 0, fs.ErrInvalid},
+	}
+	for i, tt := range tests {
+		off, err := f.Seek(tt.in, tt.whence)
+		if off != tt.out || !errors.Is(err, tt.err) {
+			t.Errorf("#%d: Seek(%v, %v) = %v, %v want %v, %v", i, tt.in, tt.whence, off, err, tt.out, tt.err)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestReadAt", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	b := make([]byte, 5)
+	n, err := f.ReadAt(b, 7)
+	if err != nil || n != len(b) {
+		t.Fatalf("ReadAt 7: %d, %v", n, err)
+	}
+	if string(b) != "world" {
+		t.Fatalf("ReadAt 7: have %q want %q", string(b), "world")
+	}
+}
+
+// Verify that ReadAt doesn't affect seek offset.
+func TestReadAtOffset(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestReadAtOffset", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	f.Seek(0, 0)
+	b := make([]byte, 5)
+
+	n, err := f.ReadAt(b, 7)
+	if err != nil || n != len(b) {
+		t.Fatalf("ReadAt 7: %d, %v", n, err)
+	}
+	if string(b) != "world" {
+		t.Fatalf("ReadAt 7: have %q want %q", string(b), "world")
+	}
+
+	n, err = f.Read(b)
+	if err != nil || n != len(b) {
+		t.Fatalf("Read: %d, %v", n, err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("Read: have %q want %q", string(b), "hello")
+	}
+}
+
+// Verify that ReadAt doesn't allow negative offset.
+func TestReadAtEOF(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestReadAtEOF", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	// a read ending exactly at the end of the file is satisfied in full
+	b := make([]byte, 6)
+	n, err := f.ReadAt(b, int64(len(data)-len(b)))
+	if err != nil || n != len(b) {
+		t.Fatalf("ReadAt at EOF: %d, %v", n, err)
+	}
+	if string(b) != "world\n" {
+		t.Fatalf("ReadAt at EOF: have %q want %q", string(b), "world\n")
+	}
+
+	n, err = f.ReadAt(b, int64(len(data)))
+	if err != io.EOF || n != 0 {
+		t.Fatalf("ReadAt past EOF: %d, %v", n, err)
+	}
+
+	n, err = f.ReadAt(b, int64(len(data)-1))
+	if err != io.EOF || n != 1 {
+		t.Fatalf("short ReadAt: %d, %v", n, err)
+	}
+
+	f.Seek(int64(len(data)-len(b)), io.SeekStart)
+	n, err = f.Read(b)
+	if err != nil || n != len(b) {
+		t.Fatalf("Read at EOF: %d, %v", n, err)
+	}
+	n, err = f.Read(b)
+	if err != io.EOF || n != 0 {
+		t.Fatalf("Read past EOF: %d, %v", n, err)
+	}
+}
+
+func TestReadAtNegativeOffset(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestReadAtNegativeOffset", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	f.Seek(0, 0)
+	b := make([]byte, 5)
+
+	n, err := f.ReadAt(b, -10)
+
+	const wantsub = "negative offset"
+	if !strings.Contains(fmt.Sprint(err), wantsub) || n != 0 {
+		t.Errorf("ReadAt(-10) = %v, %v; want 0, ...%q...", n, err, wantsub)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestWriteAt", vfs, t)
+	defer f.Close()
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	n, err := f.WriteAt([]byte("WORLD"), 7)
+	if err != nil || n != 5 {
+		t.Fatalf("WriteAt 7: %d, %v", n, err)
+	}
+
+	b, err := ioutil.ReadFile(vfs, f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", f.Name(), err)
+	}
+	if string(b) != "hello, WORLD\n" {
+		t.Fatalf("after write: have %q want %q", string(b), "hello, WORLD\n")
+	}
+}
+
+// Verify that WriteAt doesn't allow negative offset.
+func TestWriteAtNegativeOffset(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestWriteAtNegativeOffset", vfs, t)
+	defer f.Close()
+
+	n, err := f.WriteAt([]byte("WORLD"), -10)
+
+	const wantsub = "negative offset"
+	if !strings.Contains(fmt.Sprint(err), wantsub) || n != 0 {
+		t.Errorf("WriteAt(-10) = %v, %v; want 0, ...%q...", n, err, wantsub)
+	}
+}
+
+// Verify that WriteAt doesn't work in append mode.
+func TestWriteAtInAppendMode(t *testing.T) {
+	vfs := NewFS()
+	f, err := vfs.OpenFile("write_at_in_append_mode.txt", os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte(""), 1)
+	if err != os.ErrPermission {
+		t.Fatalf("f.WriteAt returned %v, expected %v", err, os.ErrPermission)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestReadFrom", vfs, t)
+	defer f.Close()
+
+	if _, ok := f.(io.ReaderFrom); !ok {
+		t.Fatalf("%T does not implement io.ReaderFrom", f)
+	}
+
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+
+	contents := make([]byte, 100000)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+
+	f.Seek(7, io.SeekStart)
+	// hide bytes.Reader's WriteTo so io.Copy uses ReadFrom
+	n, err := io.Copy(f, struct{ io.Reader }{iotest.HalfReader(bytes.NewReader(contents))})
+	if err != nil || n != int64(len(contents)) {
+		t.Fatalf("Copy: %d, %v", n, err)
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != int64(7+len(contents)) {
+		t.Errorf("offset after Copy: %d, %v want %d", off, err, 7+len(contents))
+	}
+
+	b, err := ioutil.ReadFile(vfs, f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", f.Name(), err)
+	}
+	if want := append([]byte(data[:7]), contents...); !bytes.Equal(b, want) {
+		t.Errorf("after copy: contents do not match")
+	}
+}
+
+func TestReadWhileAppending(t *testing.T) {
+	vfs := NewFS()
+	w, err := vfs.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	r, err := vfs.Open("/file")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	defer r.Close()
+
+	contents := make([]byte, 3*blockSize+123)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// appends of odd sizes straddle block boundaries
+		for p := contents; len(p) > 0; {
+			n := min(len(p), 1000+rand.Intn(5000))
+			if _, err := w.Write(p[:n]); err != nil {
+				done <- err
+				return
+			}
+			p = p[n:]
+		}
+		done <- w.Close()
+	}()
+
+	var (
+		got      []byte
+		finished bool
+	)
+	buf := make([]byte, 4096)
+	for len(got) < len(contents) {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil && err != io.EOF {
+			t.Fatalf("Read error: %s", err)
+		}
+		if n == 0 {
+			if finished {
+				break
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Write error: %s", err)
+				}
+				finished = true
+			default:
+				runtime.Gosched()
+			}
+		}
+	}
+
+	if !bytes.Equal(got, contents) {
+		t.Errorf("read %d bytes while appending, which do not match the %d written", len(got), len(contents))
+	}
+	if !finished {
+		if err := <-done; err != nil {
+			t.Fatalf("Write error: %s", err)
+		}
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.WriteFile("/log", nil, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	const writes = 100
+	markers := []string{"<first>", "[second]"}
+
+	var wg sync.WaitGroup
+	for _, marker := range markers {
+		f, err := vfs.OpenFile("/log", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("OpenFile error: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.Close()
+			for i := 0; i < writes; i++ {
+				if _, err := f.Write([]byte(marker)); err != nil {
+					t.Errorf("Write error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := vfs.ReadFile("/log")
+	if err != nil {
+		t.Fatalf("ReadFile error: %s", err)
+	}
+	size := 0
+	for _, marker := range markers {
+		if n := strings.Count(string(data), marker); n != writes {
+			t.Errorf("Found %d writes of %q, want %d", n, marker, writes)
+		}
+		size += writes * len(marker)
+	}
+	if len(data) != size {
+		t.Errorf("File has size %d, want %d", len(data), size)
+	}
+}
+
+func TestFlock(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.WriteFile("/counter", []byte("0"), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Link("/counter", "/link"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	open := func(name string) *file {
+		t.Helper()
+		f, err := vfs.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile error: %s", err)
+		}
+		return f.(*file)
+	}
+
+	// the lock is shared by every name of the file
+	f1, f2 := open("/counter"), open("/link")
+	if err := f1.Lock(); err != nil {
+		t.Fatalf("Lock error: %s", err)
+	}
+	if err := f1.TryLock(); err != nil {
+		t.Errorf("TryLock of held lock by its holder error: %s", err)
+	}
+	if err := f2.TryLock(); !errors.Is(err, syscall.EWOULDBLOCK) {
+		t.Errorf("TryLock of held lock: got %v, want %v", err, syscall.EWOULDBLOCK)
+	}
+	// closing the handle releases its lock
+	f1.Close()
+	if err := f2.TryLock(); err != nil {
+		t.Errorf("TryLock after holder closed error: %s", err)
+	}
+	if err := f2.Unlock(); err != nil {
+		t.Errorf("Unlock error: %s", err)
+	}
+	f2.Close()
+	if err := f2.Lock(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Lock of closed file: got %v, want %v", err, fs.ErrClosed)
+	}
+
+	// goroutines incrementing the counter under the lock never lose an
+	// increment
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		f := open("/counter")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.Close()
+
+			buf := make([]byte, 16)
+			for j := 0; j < increments; j++ {
+				if err := f.Lock(); err != nil {
+					t.Errorf("Lock error: %s", err)
+					return
+				}
+				n, err := f.ReadAt(buf, 0)
+				if err != nil && err != io.EOF {
+					t.Errorf("ReadAt error: %s", err)
+				}
+				count, _ := strconv.Atoi(string(buf[:n]))
+				runtime.Gosched()
+				if err := f.Truncate(0); err != nil {
+					t.Errorf("Truncate error: %s", err)
+				}
+				if _, err := f.WriteAt([]byte(strconv.Itoa(count+1)), 0); err != nil {
+					t.Errorf("WriteAt error: %s", err)
+				}
+				if err := f.Unlock(); err != nil {
+					t.Errorf("Unlock error: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if b, err := vfs.ReadFile("/counter"); err != nil || string(b) != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %q, %v; want %d", b, err, workers*increments)
+	}
+}
+
+func TestEncryptCount(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.WriteFile("/file", make([]byte, 4*blockSize), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if n, err := vfs.EncryptCount("/file"); err != nil || n != 4 {
+		t.Fatalf("EncryptCount after WriteFile = %d, %v; want 4", n, err)
+	}
+
+	f, err := vfs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	defer f.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write([]byte(abc)); err != nil {
+			t.Fatalf("Write error: %s", err)
+		}
+	}
+
+	// every append only seals the block it extends, not the whole file
+	if n, err := vfs.EncryptCount("/file"); err != nil || n != 14 {
+		t.Errorf("EncryptCount after 10 appends = %d, %v; want 14", n, err)
+	}
+	if _, err := vfs.EncryptCount("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("EncryptCount of missing file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestWriteFileBlocks(t *testing.T) {
+	vfs := NewFS()
+	for _, size := range []int{0, 1, blockSize - 1, blockSize, blockSize + 1, 3*blockSize + 5, 1} {
+		contents := make([]byte, size)
+		if _, err := rand.Read(contents); err != nil {
+			t.Fatalf("error getting random contents: %v", err)
+		}
+		if err := vfs.WriteFile("/file", contents, 0666); err != nil {
+			t.Fatalf("WriteFile of %d bytes error: %s", size, err)
+		}
+		b, err := vfs.ReadFile("/file")
+		if err != nil {
+			t.Fatalf("ReadFile error: %s", err)
+		}
+		if !bytes.Equal(b, contents) {
+			t.Errorf("WriteFile of %d bytes: read back %d bytes that do not match", size, len(b))
+		}
+	}
+}
+
+func BenchmarkWriteFile(b *testing.B) {
+	contents := make([]byte, 10<<20)
+	rand.Read(contents)
+
+	vfs := NewFS()
+	b.SetBytes(int64(len(contents)))
+	for i := 0; i < b.N; i++ {
+		if err := vfs.WriteFile("/bench", contents, 0666); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateLargeDir(b *testing.B) {
+	const files = 100000
+	names := make([]string, files)
+	for i, n := range rand.New(rand.NewSource(1)).Perm(files) {
+		names[i] = fmt.Sprintf("/dir/file%d", n)
+	}
+
+	for i := 0; i < b.N; i++ {
+		vfs := NewFS()
+		if err := vfs.Mkdir("/dir", 0777); err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range names {
+			f, err := vfs.Create(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	contents := make([]byte, 10<<20)
+	rand.Read(contents)
+
+	b.Run("Write", func(b *testing.B) {
+		vfs := NewFS()
+		b.SetBytes(int64(len(contents)))
+		for i := 0; i < b.N; i++ {
+			f, err := vfs.Create("/bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			// hide ReadFrom so io.Copy issues many small writes
+			if _, err := io.Copy(struct{ io.Writer }{f}, struct{ io.Reader }{bytes.NewReader(contents)}); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+	b.Run("ReadFrom", func(b *testing.B) {
+		vfs := NewFS()
+		b.SetBytes(int64(len(contents)))
+		for i := 0; i < b.N; i++ {
+			f, err := vfs.Create("/bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(f, struct{ io.Reader }{bytes.NewReader(contents)}); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+}
+
+func BenchmarkAppend(b *testing.B) {
+	line := []byte(strings.Repeat(".", 79) + "\n")
+	vfs := NewFS()
+	f, err := vfs.Create("/bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Write(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkOpenBlock measures decrypting a single block, which is all
+// the allocation that BenchmarkReadAt should report.
+func BenchmarkOpenBlock(b *testing.B) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/bench", make([]byte, blockSize), 0666); err != nil {
+		b.Fatal(err)
+	}
+	fi, err := vfs.Stat("/bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	block := vfs.(*pbFS).data[fi.Sys().(*inode.Inode).Ino].blocks[0]
+
+	buf := make([]byte, blockSize)
+	b.ReportAllocs()
+	b.SetBytes(blockSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := block.open(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAt(b *testing.B) {
+	vfs := NewFS()
+	if err := ioutil.WriteFile(vfs, "/bench", make([]byte, 4*blockSize), 0666); err != nil {
+		b.Fatal(err)
+	}
+	f, err := vfs.Open("/bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	p := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		if _, err := f.ReadAt(p, int64(i%4)*blockSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteAt(b *testing.B) {
+	vfs := NewFS()
+	f, err := vfs.Create("/bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(4 * blockSize); err != nil {
+		b.Fatal(err)
+	}
+
+	p := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		if _, err := f.WriteAt(p, int64(i%4)*blockSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var bufSink []byte
+
+// BenchmarkBufPool compares taking a transient block buffer from the
+// pool with allocating a new one, as reads and writes would otherwise
+// have to for every call.
+func BenchmarkBufPool(b *testing.B) {
+	b.Run("Pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bp := getBuf(blockSize)
+			bufSink = *bp
+			putBuf(bp)
+		}
+	})
+	b.Run("Make", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bufSink = make([]byte, blockSize)
+			core.Wipe(bufSink)
+		}
+	})
+	bufSink = nil
+}
+
+// BenchmarkEncryption compares writing and reading back a file with and
+// without NoEncryption.
+func BenchmarkEncryption(b *testing.B) {
+	contents := make([]byte, 1<<20)
+	rand.Read(contents)
+
+	for _, bench := range []struct {
+		name string
+		opts Options
+	}{
+		{"Encrypted", Options{}},
+		{"Plaintext", Options{NoEncryption: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			vfs, err := NewFSWithOptions(bench.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(contents)))
+			for i := 0; i < b.N; i++ {
+				if err := vfs.WriteFile("/bench", contents, 0666); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := vfs.ReadFile("/bench"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	vfs := NewFS()
+	f := newFile("TestWriteTo", vfs, t)
+	defer f.Close()
+
+	if _, ok := f.(io.WriterTo); !ok {
+		t.Fatalf("%T does not implement io.WriterTo", f)
+	}
+
+	contents := make([]byte, 100000)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	const offset = 1234
+	f.Seek(offset, io.SeekStart)
+	var buf bytes.Buffer
+	// hide bytes.Buffer's ReadFrom so io.Copy uses WriteTo
+	n, err := io.Copy(struct{ io.Writer }{&buf}, f)
+	if err != nil || n != int64(len(contents)-offset) {
+		t.Fatalf("Copy: %d, %v want %d", n, err, len(contents)-offset)
+	}
+	if !bytes.Equal(buf.Bytes(), contents[offset:]) {
+		t.Errorf("after copy: contents do not match")
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != int64(len(contents)) {
+		t.Errorf("offset after Copy: %d, %v want %d", off, err, len(contents))
+	}
+
+	// at EOF nothing more is written
+	n, err = f.(io.WriterTo).WriteTo(&buf)
+	if err != nil || n != 0 {
+		t.Errorf("WriteTo at EOF: %d, %v want 0, nil", n, err)
+	}
+}
+
+func BenchmarkCopyOut(b *testing.B) {
+	contents := make([]byte, 10<<20)
+	rand.Read(contents)
+
+	vfs := NewFS()
+	if err := vfs.WriteFile("/bench", contents, 0666); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Read", func(b *testing.B) {
+		b.SetBytes(int64(len(contents)))
+		for i := 0; i < b.N; i++ {
+			f, err := vfs.Open("/bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			// hide WriteTo so io.Copy issues many small reads
+			if _, err := io.Copy(ioutil.Discard, struct{ io.Reader }{f}); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+	b.Run("WriteTo", func(b *testing.B) {
+		b.SetBytes(int64(len(contents)))
+		for i := 0; i < b.N; i++ {
+			f, err := vfs.Open("/bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, f); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+}
+
+func writeFile(vfs absfs.FileSystem, t *testing.T, fname string, flag int, text string) string {
+	f, err := vfs.OpenFile(fname, flag, 0666)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	n, err := io.WriteString(f, text)
+	if err != nil {
+		t.Fatalf("WriteString: %d, %v", n, err)
+	}
+	f.Close()
+	data, err := ioutil.ReadFile(vfs, fname)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return string(data)
+}
+
+func TestAppend(t *testing.T) {
+	vfs := NewFS()
+	const f = "append.txt"
+	s := writeFile(vfs, t, f, os.O_CREATE|os.O_TRUNC|os.O_RDWR, "new")
+	if s != "new" {
+		t.Fatalf("writeFile: have %q want %q", s, "new")
+	}
+	s = writeFile(vfs, t, f, os.O_APPEND|os.O_RDWR, "|append")
+	if s != "new|append" {
+		t.Fatalf("writeFile: have %q want %q", s, "new|append")
+	}
+	s = writeFile(vfs, t, f, os.O_CREATE|os.O_APPEND|os.O_RDWR, "|append")
+	if s != "new|append|append" {
+		t.Fatalf("writeFile: have %q want %q", s, "new|append|append")
+	}
+	err := vfs.Remove(f)
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	s = writeFile(vfs, t, f, os.O_CREATE|os.O_APPEND|os.O_RDWR, "new&append")
+	if s != "new&append" {
+		t.Fatalf("writeFile: after append have %q want %q", s, "new&append")
+	}
+	s = writeFile(vfs, t, f, os.O_CREATE|os.O_RDWR, "old")
+	if s != "old&append" {
+		t.Fatalf("writeFile: after create have %q want %q", s, "old&append")
+	}
+	s = writeFile(vfs, t, f, os.O_CREATE|os.O_TRUNC|os.O_RDWR, "new")
+	if s != "new" {
+		t.Fatalf("writeFile: after truncate have %q want %q", s, "new")
+	}
+}
+
+func TestModTime(t *testing.T) {
+	vfs := NewFS()
+
+	tBeforeWrite := time.Now()
+	ioutil.WriteFile(vfs, "/readme.txt", []byte{0, 0, 0}, 0666)
+	fi, _ := vfs.Stat("/readme.txt")
+	mtimeAfterWrite := fi.ModTime()
+
+	if !mtimeAfterWrite.After(tBeforeWrite) {
+		t.Error("Open should modify mtime")
+	}
+
+	f, err := vfs.OpenFile("/readme.txt", os.O_RDONLY, 0666)
+	if err != nil {
+		t.Fatalf("Could not open file: %s", err)
+	}
+	f.Close()
+	tAfterRead := fi.ModTime()
+
+	if tAfterRead != mtimeAfterWrite {
+		t.Error("Open with O_RDONLY should not modify mtime")
+	}
+}
+
+func TestChtimes(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := ioutil.WriteFile(vfs, "/readme.txt", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Symlink("readme.txt", "/link"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+
+	atime := time.Date(2021, time.March, 14, 0, 0, 0, 0, time.UTC)
+	mtime := atime.Add(time.Hour)
+	if err := vfs.Chtimes("/link", atime, mtime); err != nil {
+		t.Fatalf("Chtimes error: %s", err)
+	}
+	fi, err := vfs.Stat("/readme.txt")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	node := fi.Sys().(*inode.Inode)
+	if !node.Atime.Equal(atime) || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Chtimes through symlink: atime, mtime = %v, %v; want %v, %v", node.Atime, fi.ModTime(), atime, mtime)
+	}
+
+	// zero times are left unchanged
+	if err := vfs.Chtimes("/readme.txt", time.Time{}, atime); err != nil {
+		t.Fatalf("Chtimes error: %s", err)
+	}
+	if !node.Atime.Equal(atime) || !fi.ModTime().Equal(atime) {
+		t.Errorf("Chtimes with zero atime: atime, mtime = %v, %v; want %v, %v", node.Atime, fi.ModTime(), atime, atime)
+	}
+
+	if err := vfs.Chtimes("/nonexistent", atime, mtime); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chtimes of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestSetTimes(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.WriteFile("/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	atime := time.Date(2021, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	ctime := time.Date(2019, 12, 31, 23, 59, 59, 1, time.UTC)
+	if err := vfs.SetTimes("/file", atime, mtime, ctime); err != nil {
+		t.Fatalf("SetTimes error: %s", err)
+	}
+
+	fi, err := vfs.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	info := fi.(*FileInfo)
+	if !info.AccessTime().Equal(atime) {
+		t.Errorf("AccessTime = %v, want %v", info.AccessTime(), atime)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("ModTime = %v, want %v", info.ModTime(), mtime)
+	}
+	if !info.CreationTime().Equal(ctime) {
+		t.Errorf("CreationTime = %v, want %v", info.CreationTime(), ctime)
+	}
+
+	// zero times are left unchanged
+	if err := vfs.SetTimes("/file", time.Time{}, time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("SetTimes error: %s", err)
+	}
+	if !info.ModTime().Equal(mtime) || !info.CreationTime().Equal(ctime) {
+		t.Errorf("times after SetTimes with zero times = %v, %v; want %v, %v",
+			info.ModTime(), info.CreationTime(), mtime, ctime)
+	}
+
+	if err := vfs.SetTimes("/missing", atime, mtime, ctime); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("SetTimes of missing file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestSetImmutable(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if err := vfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/dir/readme.txt", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Chdir("/dir"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+	f, err := vfs.OpenFile("/dir/readme.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	defer f.Close()
+
+	if err := vfs.SetImmutable("readme.txt", true); err != nil {
+		t.Fatalf("SetImmutable error: %s", err)
+	}
+
+	errs := map[string]error{}
+	_, errs["Write"] = f.Write([]byte(dots))
+	errs["Truncate"] = f.Truncate(0)
+	errs["FS Truncate"] = vfs.Truncate("readme.txt", 0)
+	errs["WriteFile"] = ioutil.WriteFile(vfs, "readme.txt", []byte(dots), 0666)
+	errs["Chtimes"] = vfs.Chtimes("readme.txt", time.Now(), time.Now())
+	errs["Chmod"] = vfs.Chmod("readme.txt", 0600)
+	errs["Link"] = vfs.Link("readme.txt", "link")
+	errs["Rename"] = vfs.Rename("readme.txt", "renamed.txt")
+	errs["Remove"] = vfs.Remove("readme.txt")
+	errs["RemoveAll"] = vfs.RemoveAll("/dir")
+	for op, err := range errs {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s of immutable file: got %v, want %v", op, err, fs.ErrPermission)
+		}
+	}
+	if b, err := ioutil.ReadFile(vfs, "readme.txt"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile of immutable file = %q, %v; want %q", b, err, abc)
+	}
+
+	if err := vfs.SetImmutable("readme.txt", false); err != nil {
+		t.Fatalf("SetImmutable error: %s", err)
+	}
+	if _, err := f.Write([]byte(dots)); err != nil {
+		t.Errorf("Write after clearing immutable: %s", err)
+	}
+	if err := vfs.Rename("readme.txt", "renamed.txt"); err != nil {
+		t.Errorf("Rename after clearing immutable: %s", err)
+	}
+	if err := vfs.Remove("renamed.txt"); err != nil {
+		t.Errorf("Remove after clearing immutable: %s", err)
+	}
+
+	if err := vfs.SetImmutable("/nonexistent", true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("SetImmutable of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	vfs, err := FromMap(map[string]MapFile{
+		"readme.txt":          {Data: []byte(abc)},
+		"memz/chungus":        {Data: []byte(dots)},
+		"memz/a.txt":          {},
+		"memz/b.txt":          {},
+		"memz/sub/c.txt":      {},
+		"memz/[x].txt":        {},
+		"other/sub/c.txt":     {},
+		"other/sub/d.go":      {},
+		"other/link":          {Data: []byte("../memz"), Mode: fs.ModeSymlink},
+		"other/dangling":      {Data: []byte("nonexistent"), Mode: fs.ModeSymlink},
+		"empty/.hidden":       {},
+		"deep/a/b/c/d/e.txt":  {},
+		"deep/a/x/c/d/e.txt":  {},
+		"deep/a/b/c/d/f.json": {},
+	})
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+	fsys := vfs.FS()
+	if _, ok := fsys.(fs.GlobFS); !ok {
+		t.Fatal("FS does not implement fs.GlobFS")
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"readme.txt", []string{"readme.txt"}},
+		{"re?dme.txt", []string{"readme.txt"}},
+		{"*.txt", []string{"readme.txt"}},
+		{"memz/*.txt", []string{"memz/[x].txt", "memz/a.txt", "memz/b.txt"}},
+		{"memz/[ab].txt", []string{"memz/a.txt", "memz/b.txt"}},
+		{`memz/\[x\].txt`, []string{"memz/[x].txt"}},
+		{"*/sub/c.txt", []string{"memz/sub/c.txt", "other/sub/c.txt"}},
+		{"*/*/*", []string{
+			"deep/a/b", "deep/a/x", "memz/sub/c.txt",
+			"other/link/[x].txt", "other/link/a.txt", "other/link/b.txt", "other/link/chungus", "other/link/sub",
+			"other/sub/c.txt", "other/sub/d.go",
+		}},
+		{"other/link/*.txt", []string{"other/link/[x].txt", "other/link/a.txt", "other/link/b.txt"}},
+		{"other/d*", []string{"other/dangling"}},
+		{"empty/*", []string{"empty/.hidden"}},
+		{"deep/*/*/c/d/*.txt", []string{"deep/a/b/c/d/e.txt", "deep/a/x/c/d/e.txt"}},
+		{"*", []string{"deep", "empty", "memz", "other", "readme.txt"}},
+		{".", []string{"."}},
+		{"nonexistent", nil},
+		{"nonexistent/*", nil},
+		{"readme.txt/*", nil},
+		{"/readme.txt", nil},
+		{"memz/../readme.txt", nil},
+	}
+	for _, tt := range tests {
+		matches, err := fs.Glob(fsys, tt.pattern)
+		if err != nil {
+			t.Errorf("Glob(%q) error: %s", tt.pattern, err)
+			continue
+		}
+		if fmt.Sprint(matches) != fmt.Sprint(tt.want) {
+			t.Errorf("Glob(%q) = %q; want %q", tt.pattern, matches, tt.want)
+		}
+
+		// the matches must be the same as those found by reading
+		// each directory
+		generic, _ := fs.Glob(struct{ fs.FS }{fsys}, tt.pattern)
+		if fmt.Sprint(matches) != fmt.Sprint(generic) {
+			t.Errorf("Glob(%q) = %q; generic Glob returns %q", tt.pattern, matches, generic)
+		}
+	}
+
+	for _, pattern := range []string{"[]", "memz/[", `memz/\`, "*/[a-"} {
+		if _, err := fs.Glob(fsys, pattern); err != path.ErrBadPattern {
+			t.Errorf("Glob(%q): got %v, want %v", pattern, err, path.ErrBadPattern)
+		}
+	}
+}
+
+// matchTests are the tests of path.Match from the standard library.
+var matchTests = []struct {
+	pattern, s string
+	match      bool
+	err        error
+}{
+	{"abc", "abc", true, nil},
+	{"*", "abc", true, nil},
+	{"*c", "abc", true, nil},
+	{"a*", "a", true, nil},
+	{"a*", "abc", true, nil},
+	{"a*", "ab/c", false, nil},
+	{"a*/b", "abc/b", true, nil},
+	{"a*/b", "a/c/b", false, nil},
+	{"a*b*c*d*e*/f", "axbxcxdxe/f", true, nil},
+	{"a*b*c*d*e*/f", "axbxcxdxexxx/f", true, nil},
+	{"a*b*c*d*e*/f", "axbxcxdxe/xxx/f", false, nil},
+	{"a*b*c*d*e*/f", "axbxcxdxexxx/fff", false, nil},
+	{"a*b?c*x", "abxbbxdbxebxczzx", true, nil},
+	{"a*b?c*x", "abxbbxdbxebxczzy", false, nil},
+	{"ab[c]", "abc", true, nil},
+	{"ab[b-d]", "abc", true, nil},
+	{"ab[e-g]", "abc", false, nil},
+	{"ab[^c]", "abc", false, nil},
+	{"ab[^b-d]", "abc", false, nil},
+	{"ab[^e-g]", "abc", true, nil},
+	{"a\\*b", "a*b", true, nil},
+	{"a\\*b", "ab", false, nil},
+	{"a?b", "a☺b", true, nil},
+	{"a[^a]b", "a☺b", true, nil},
+	{"a???b", "a☺b", false, nil},
+	{"a[^a][^a][^a]b", "a☺b", false, nil},
+	{"[a-ζ]*", "α", true, nil},
+	{"*[a-ζ]", "A", false, nil},
+	{"a?b", "a/b", false, nil},
+	{"a*b", "a/b", false, nil},
+	{"[\\]a]", "]", true, nil},
+	{"[\\-]", "-", true, nil},
+	{"[x\\-]", "x", true, nil},
+	{"[x\\-]", "-", true, nil},
+	{"[x\\-]", "z", false, nil},
+	{"[\\-x]", "x", true, nil},
+	{"[\\-x]", "-", true, nil},
+	{"[\\-x]", "a", false, nil},
+	{"[]a]", "]", false, path.ErrBadPattern},
+	{"[-]", "-", false, path.ErrBadPattern},
+	{"[x-]", "x", false, path.ErrBadPattern},
+	{"[x-]", "-", false, path.ErrBadPattern},
+	{"[x-]", "z", false, path.ErrBadPattern},
+	{"[-x]", "x", false, path.ErrBadPattern},
+	{"[-x]", "-", false, path.ErrBadPattern},
+	{"[-x]", "a", false, path.ErrBadPattern},
+	{"\\", "a", false, path.ErrBadPattern},
+	{"[a-b-c]", "a", false, path.ErrBadPattern},
+	{"[", "a", false, path.ErrBadPattern},
+	{"[^", "a", false, path.ErrBadPattern},
+	{"[^bc", "a", false, path.ErrBadPattern},
+	{"a[", "a", false, path.ErrBadPattern},
+	{"a[", "ab", false, path.ErrBadPattern},
+	{"a[", "x", false, path.ErrBadPattern},
+	{"a/b[", "x", false, path.ErrBadPattern},
+	{"*x", "xxx", true, nil},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		ok, err := Match(tt.pattern, tt.s)
+		if ok != tt.match || err != tt.err {
+			t.Errorf("Match(%#q, %#q) = %v, %v want %v, %v", tt.pattern, tt.s, ok, err, tt.match, tt.err)
+		}
+	}
+}
+
+func TestGlobVFS(t *testing.T) {
+	vfs, err := FromMap(map[string]MapFile{
+		"readme.txt":      {Data: []byte(abc)},
+		"memz/a.txt":      {},
+		"memz/b.txt":      {},
+		"memz/sub/c.txt":  {},
+		"other/sub/c.txt": {},
+		"other/link":      {Data: []byte("../memz"), Mode: fs.ModeSymlink},
+		"dir[1]/x.txt":    {},
+	})
 	if err != nil {
-		t.Fatalf("Stat %q (looking for size %d): %s", f.Name(), size, err)
+		t.Fatalf("FromMap error: %s", err)
 	}
-	if dir.Size() != size {
-		t.Errorf("Stat %q: size %d want %d", f.Name(), dir.Size(), size)
+	pbfs := vfs.(*pbFS)
+
+	tests := []struct {
+		cwd     string
+		pattern string
+		want    []string
+	}{
+		{"/", "/", []string{"/"}},
+		{"/", "/*.txt", []string{"/readme.txt"}},
+		{"/", "/*/sub/c.txt", []string{"/memz/sub/c.txt", "/other/sub/c.txt"}},
+		{"/", "/other/link/*.txt", []string{"/other/link/a.txt", "/other/link/b.txt"}},
+		{"/", "*/*.txt", []string{"dir[1]/x.txt", "memz/a.txt", "memz/b.txt"}},
+		{"/memz", "*.txt", []string{"a.txt", "b.txt"}},
+		{"/memz", "../other/*", []string{"../other/link", "../other/sub"}},
+		{"/memz", "/memz/[a]*", []string{"/memz/a.txt"}},
+		{"/dir[1]", "*", []string{"x.txt"}},
+		{"/", "nonexistent/*", nil},
+		{"/", "", nil},
+	}
+	for _, tt := range tests {
+		if err := vfs.Chdir(tt.cwd); err != nil {
+			t.Fatalf("Chdir error: %s", err)
+		}
+		matches, err := pbfs.Glob(tt.pattern)
+		if err != nil {
+			t.Errorf("Glob(%q) error: %s", tt.pattern, err)
+			continue
+		}
+		if fmt.Sprint(matches) != fmt.Sprint(tt.want) {
+			t.Errorf("Glob(%q) in %s = %q; want %q", tt.pattern, tt.cwd, matches, tt.want)
+		}
+	}
+
+	if _, err := pbfs.Glob("memz/["); err != path.ErrBadPattern {
+		t.Errorf("Glob of malformed pattern: got %v, want %v", err, path.ErrBadPattern)
 	}
 }
 
-func TestFTruncate(t *testing.T) {
+func TestGlobScoped(t *testing.T) {
+	vfs, err := FromMap(map[string]MapFile{
+		"readme.txt":       {},
+		"dir[1]/a.txt":     {},
+		"dir[1]/sub/b.txt": {},
+		"dir[1]/sub/c.md":  {},
+	})
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+	sub, err := vfs.(*pbFS).Sub("/dir[1]")
+	if err != nil {
+		t.Fatalf("Sub error: %s", err)
+	}
+	scoped := sub.(*scopedFS)
+
+	tests := []struct {
+		cwd     string
+		pattern string
+		want    []string
+	}{
+		{"/", "/", []string{"/"}},
+		{"/", "/*.txt", []string{"/a.txt"}},
+		{"/", "*/*.txt", []string{"sub/b.txt"}},
+		{"/", "../*.txt", []string{"a.txt"}},
+		{"/sub", "*", []string{"b.txt", "c.md"}},
+		{"/sub", "../*", []string{"../a.txt", "../sub"}},
+		{"/sub", "../../../sub/*.md", []string{"../sub/c.md"}},
+		{"/sub", "/../../*.txt", []string{"/a.txt"}},
+	}
+	for _, tt := range tests {
+		if err := scoped.Chdir(tt.cwd); err != nil {
+			t.Fatalf("Chdir error: %s", err)
+		}
+		matches, err := scoped.Glob(tt.pattern)
+		if err != nil {
+			t.Errorf("Glob(%q) error: %s", tt.pattern, err)
+			continue
+		}
+		if fmt.Sprint(matches) != fmt.Sprint(tt.want) {
+			t.Errorf("Glob(%q) in %s = %q; want %q", tt.pattern, tt.cwd, matches, tt.want)
+		}
+	}
+}
+
+func TestScopedSymlink(t *testing.T) {
+	vfs, err := FromMap(map[string]MapFile{
+		"secret":           {Data: []byte("secret")},
+		"scope/secret":     {Data: []byte("inner")},
+		"scope/dir/a.txt":  {},
+		"scope/dir/sub/.x": {},
+	})
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+	sub, err := vfs.(*pbFS).Sub("/scope")
+	if err != nil {
+		t.Fatalf("Sub error: %s", err)
+	}
+	scoped := sub.(*scopedFS)
+	if err := scoped.Symlink("/", "/root"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if target, err := scoped.Readlink("/root"); err != nil || target != "/" {
+		t.Errorf("Readlink = %q, %v; want %q", target, err, "/")
+	}
+
+	tests := []struct {
+		target, link string
+		err          error
+	}{
+		{"/secret", "/abs", nil},
+		{"/../secret", "/abs-up", nil},
+		{"../secret", "/dir/up", nil},
+		{"../../secret", "/dir/sub/up", nil},
+		{"sub/../../secret", "/dir/down", nil},
+		{"root/../secret", "/through", nil},
+		{"../secret", "/escape", fs.ErrPermission},
+		{"../../../secret", "/dir/sub/escape", fs.ErrPermission},
+		{"root/../../secret", "/escape", fs.ErrPermission},
+		{"sub/../../../secret", "/dir/escape", fs.ErrPermission},
+	}
+	for _, tt := range tests {
+		err := scoped.Symlink(tt.target, tt.link)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Symlink(%q, %q): got %v, want %v", tt.target, tt.link, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data, err := scoped.ReadFile(tt.link); err != nil || string(data) != "inner" {
+			t.Errorf("ReadFile of link to %q = %q, %v; want %q", tt.target, data, err, "inner")
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	vfs, err := NewFSWithOptions(Options{Dedup: true})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	pbfs := vfs.(*pbFS)
+
+	contents := make([]byte, 2*blockSize+100)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if err := ioutil.WriteFile(vfs, name, contents, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	a, b := sealedData(t, vfs, "/a"), sealedData(t, vfs, "/b")
+	for i := range a.blocks {
+		if a.blocks[i] != b.blocks[i] {
+			t.Errorf("block %d of identical files is not shared", i)
+		}
+	}
+	want := int64(len(contents) + 3*core.Overhead)
+	if files, bytes := pbfs.Usage(); files != 2 || bytes != want {
+		t.Errorf("Usage = %d, %d, want %d, %d", files, bytes, 2, want)
+	}
+
+	// writing to a shared block gives the file its own copy
+	f, err := vfs.OpenFile("/a", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
+	}
+	if _, err := f.WriteAt([]byte(abc), blockSize); err != nil {
+		t.Fatalf("WriteAt error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if a.blocks[1] == b.blocks[1] {
+		t.Error("written block is still shared")
+	}
+	if a.blocks[0] != b.blocks[0] || a.blocks[2] != b.blocks[2] {
+		t.Error("unwritten blocks are no longer shared")
+	}
+	want += int64(blockSize + core.Overhead)
+	if _, bytes := pbfs.Usage(); bytes != want {
+		t.Errorf("Usage after write = %d, want %d", bytes, want)
+	}
+	if got, err := ioutil.ReadFile(vfs, "/b"); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadFile of unwritten file: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
+	written := append([]byte(nil), contents...)
+	copy(written[blockSize:], abc)
+	if got, err := ioutil.ReadFile(vfs, "/a"); err != nil || !bytes.Equal(got, written) {
+		t.Errorf("ReadFile of written file: err = %v, contents match = %t", err, bytes.Equal(got, written))
+	}
+
+	// re-sealing a file gives it newly keyed blocks of its own
+	f, err = vfs.Open("/b")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if a.blocks[0] == b.blocks[0] {
+		t.Error("re-sealed block is still shared")
+	}
+	if got, err := ioutil.ReadFile(vfs, "/b"); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadFile of re-sealed file: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
+
+	// blocks are dropped once no file holds them
+	if n := pbfs.dedup.len(); n != 4 {
+		t.Errorf("dedup store holds %d blocks, want %d", n, 4)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if err := vfs.Remove(name); err != nil {
+			t.Fatalf("Remove error: %s", err)
+		}
+	}
+	if n := pbfs.dedup.len(); n != 0 {
+		t.Errorf("dedup store holds %d blocks after removing every file, want 0", n)
+	}
+}
+
+func TestStatFS(t *testing.T) {
 	vfs := NewFS()
-	f, err := vfs.Create("testfile")
+	if err := vfs.Mkdir("memz", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "memz/chungus", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+
+	fsys := vfs.FS()
+	if _, ok := fsys.(fs.StatFS); !ok {
+		t.Fatal("FS does not implement fs.StatFS")
+	}
+	fi, err := fs.Stat(fsys, "memz/chungus")
 	if err != nil {
-		t.Fatal("create failed:", err)
+		t.Fatalf("Stat error: %s", err)
+	}
+	if fi.Name() != "chungus" || fi.Size() != int64(len(abc)) {
+		t.Errorf("Stat = %q, %d; want %q, %d", fi.Name(), fi.Size(), "chungus", len(abc))
+	}
+
+	// fs.Stat falls back to opening the file if fs.StatFS isn't
+	// implemented, which would fail with an "open" error instead
+	var pathErr *fs.PathError
+	_, err = fs.Stat(fsys, "/memz/chungus")
+	if !errors.As(err, &pathErr) || pathErr.Op != "stat" || !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Stat of absolute path: got %v, want stat %v", err, fs.ErrInvalid)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	if _, err := NewFSWithOptions(Options{Compression: flate.BestCompression + 1}); err == nil {
+		t.Error("NewFSWithOptions with invalid compression level succeeded")
+	}
+
+	vfs, err := NewFSWithOptions(Options{Compression: flate.BestSpeed})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+
+	contents := bytes.Repeat([]byte(dots+abc+"\n"), 3*blockSize/33)
+	if err := ioutil.WriteFile(vfs, "/text", contents, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	fi, err := vfs.Stat("/text")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	if fi.Size() != int64(len(contents)) {
+		t.Errorf("Size = %d, want %d", fi.Size(), len(contents))
+	}
+	if _, sealed := vfs.(*pbFS).Usage(); sealed > fi.Size()/10 {
+		t.Errorf("sealed size of compressible file = %d, want at most a tenth of %d", sealed, fi.Size())
+	}
+	if got, err := ioutil.ReadFile(vfs, "/text"); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadFile: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
+
+	// partially overwriting and truncating compressed blocks
+	f, err := vfs.OpenFile("/text", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error: %s", err)
 	}
 	defer f.Close()
+	if _, err := f.WriteAt([]byte(abc), blockSize-8); err != nil {
+		t.Fatalf("WriteAt error: %s", err)
+	}
+	copy(contents[blockSize-8:], abc)
+	if err := f.Truncate(blockSize + 100); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	contents = contents[:blockSize+100]
+	got := make([]byte, len(contents))
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadAt: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
 
-	checkSize(t, f, 0)
-	f.Write([]byte("hello, world\n"))
-	checkSize(t, f, 13)
-	f.Truncate(10)
-	checkSize(t, f, 10)
-	f.Truncate(1024)
-	checkSize(t, f, 1024)
-	f.Truncate(0)
-	checkSize(t, f, 0)
-	_, err = f.Write([]byte("surprise!"))
-	if err == nil {
-		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	// incompressible blocks are sealed as is
+	random := make([]byte, blockSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/random", random, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if sfile := sealedData(t, vfs, "/random"); sfile.blocks[0].compressed {
+		t.Error("incompressible block was compressed")
+	}
+	if got, err := ioutil.ReadFile(vfs, "/random"); err != nil || !bytes.Equal(got, random) {
+		t.Errorf("ReadFile of incompressible file: err = %v, contents match = %t", err, bytes.Equal(got, random))
 	}
 }
 
-func TestTruncate(t *testing.T) {
+func TestSub(t *testing.T) {
 	vfs := NewFS()
-	f, err := vfs.Create("testfile")
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/a/b/c.txt", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	// the working directory must not affect the io/fs view
+	if err := vfs.Chdir("/a"); err != nil {
+		t.Fatalf("Chdir error: %s", err)
+	}
+
+	if _, err := fs.Sub(vfs.FS(), "/a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Sub of absolute path: got %v, want %v", err, fs.ErrInvalid)
+	}
+	sub, err := fs.Sub(vfs.FS(), "a/b")
 	if err != nil {
-		t.Fatal("create failed:", err)
+		t.Fatalf("Sub error: %s", err)
+	}
+	if _, ok := sub.(subFS); !ok {
+		t.Fatalf("Sub returned %T, want subFS", sub)
+	}
+	if b, err := fs.ReadFile(sub, "c.txt"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile = %q, %v; want %q", b, err, abc)
+	}
+	if err := fstest.TestFS(sub, "c.txt"); err != nil {
+		t.Errorf("error testing sub FS: %v", err)
 	}
-	defer f.Close()
 
-	checkSize(t, f, 0)
-	f.Write([]byte("hello, world\n"))
-	checkSize(t, f, 13)
-	vfs.Truncate(f.Name(), 10)
-	checkSize(t, f, 10)
-	vfs.Truncate(f.Name(), 1024)
-	checkSize(t, f, 1024)
-	vfs.Truncate(f.Name(), 0)
-	checkSize(t, f, 0)
-	_, err = f.Write([]byte("surprise!"))
+	// files created afterwards share the same inodes
+	if err := ioutil.WriteFile(vfs, "/a/b/d.txt", []byte(dots), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	fi, err := fs.Stat(sub, "d.txt")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	vfi, err := vfs.Stat("/a/b/d.txt")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	if fi.Sys() != vfi.Sys() {
+		t.Error("sub FS and VFS have different inodes for the same file")
+	}
+	if matches, err := fs.Glob(sub, "*.txt"); err != nil || fmt.Sprint(matches) != "[c.txt d.txt]" {
+		t.Errorf("Glob = %q, %v; want %q", matches, err, []string{"c.txt", "d.txt"})
+	}
+
+	// errors refer to names in the sub FS
+	var pathErr *fs.PathError
+	if _, err := fs.ReadFile(sub, "nonexistent"); !errors.As(err, &pathErr) || pathErr.Path != "nonexistent" {
+		t.Errorf("ReadFile of nonexistent file: got %v, want error for %q", err, "nonexistent")
+	}
+
+	subsub, err := fs.Sub(vfs.FS(), "a")
 	if err == nil {
-		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+		subsub, err = fs.Sub(subsub, "b")
+	}
+	if err != nil {
+		t.Fatalf("Sub error: %s", err)
+	}
+	if b, err := fs.ReadFile(subsub, "c.txt"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile from nested Sub = %q, %v; want %q", b, err, abc)
+	}
+
+	// WalkDir still walks relative roots from the working directory
+	var walked []string
+	err = vfs.WalkDir("b", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if err != nil || strings.Join(walked, ",") != "b,b/c.txt,b/d.txt" {
+		t.Errorf("WalkDir from working directory visited %v, %v", walked, err)
 	}
 }
 
-func TestChdir(t *testing.T) {
-	vfs := NewFS()
-	const N = 10
-	c := make(chan bool)
-	cpwd := make(chan string)
-	for i := 0; i < N; i++ {
-		go func(i int) {
-			// Lock half the goroutines in their own operating system
-			// thread to exercise more scheduler possibilities.
-			if i%2 == 1 {
-				runtime.LockOSThread()
-			}
-			<-c
-			pwd, err := vfs.Getwd()
-			if err != nil {
-				t.Errorf("Getwd on goroutine %d: %v", i, err)
-				return
-			}
-			cpwd <- pwd
-		}(i)
+func TestSpill(t *testing.T) {
+	if _, err := NewFSWithOptions(Options{SpillDir: filepath.Join(t.TempDir(), "nonexistent")}); err == nil {
+		t.Error("NewFSWithOptions with nonexistent spill dir succeeded")
 	}
-	d, err := ioutil.TempDir(vfs, "", "test")
+
+	dir := t.TempDir()
+	vfs, err := NewFSWithOptions(Options{SpillDir: dir, SpillThreshold: blockSize})
 	if err != nil {
-		t.Fatalf("TempDir: %v", err)
+		t.Fatalf("NewFSWithOptions error: %s", err)
 	}
-	if err := vfs.Chdir(d); err != nil {
-		t.Fatalf("Chdir: %v", err)
+	backingFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir error: %s", err)
+		}
+		return len(entries)
 	}
-	d, err = vfs.Getwd()
+
+	if err := ioutil.WriteFile(vfs, "/small", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if n := backingFiles(); n != 0 {
+		t.Errorf("%d backing files exist for a small file, want 0", n)
+	}
+
+	contents := make([]byte, 3*blockSize+5)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("error getting random contents: %v", err)
+	}
+	if err := ioutil.WriteFile(vfs, "/large", contents, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if n := backingFiles(); n != 1 {
+		t.Errorf("%d backing files exist for a large file, want 1", n)
+	}
+	// only the small file is held in memory
+	if _, bytes := vfs.(*pbFS).Usage(); bytes != int64(len(abc)+core.Overhead) {
+		t.Errorf("Usage = %d, want %d", bytes, len(abc)+core.Overhead)
+	}
+	if got, err := ioutil.ReadFile(vfs, "/large"); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadFile: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
+
+	// blocks of a spilled file are replaced in its backing file
+	f, err := vfs.OpenFile("/large", os.O_RDWR, 0)
 	if err != nil {
-		t.Fatalf("Getwd: %v", err)
+		t.Fatalf("OpenFile error: %s", err)
 	}
-	close(c)
-	for i := 0; i < N; i++ {
-		pwd := <-cpwd
-		if pwd != d {
-			t.Errorf("Getwd returned %q; want %q", pwd, d)
+	if _, err := f.WriteAt([]byte(dots), 2*blockSize-8); err != nil {
+		t.Fatalf("WriteAt error: %s", err)
+	}
+	copy(contents[2*blockSize-8:], dots)
+	if err := f.Truncate(2*blockSize + 3); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	contents = contents[:2*blockSize+3]
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync error: %s", err)
+	}
+	got := make([]byte, len(contents))
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("ReadAt: err = %v, contents match = %t", err, bytes.Equal(got, contents))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	if err := vfs.Remove("/large"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
+	if n := backingFiles(); n != 0 {
+		t.Errorf("%d backing files exist after removing the large file, want 0", n)
+	}
+
+	// backing files are wiped before they are removed, however the
+	// contents are freed
+	if err := ioutil.WriteFile(vfs, "/large", contents, 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	backing, err := os.Open(sealedData(t, vfs, "/large").backing.Name())
+	if err != nil {
+		t.Fatalf("error opening backing file: %v", err)
+	}
+	defer backing.Close()
+	if err := vfs.Truncate("/large", 0); err != nil {
+		t.Fatalf("Truncate error: %s", err)
+	}
+	if n := backingFiles(); n != 0 {
+		t.Errorf("%d backing files exist after truncating the large file, want 0", n)
+	}
+	wiped, err := io.ReadAll(backing)
+	if err != nil {
+		t.Fatalf("error reading backing file: %v", err)
+	}
+	if len(wiped) == 0 || !bytes.Equal(wiped, make([]byte, len(wiped))) {
+		t.Errorf("backing file of truncated file was not wiped")
+	}
+}
+
+func TestUsageByType(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	if usage := vfs.UsageByType(); len(usage) != 0 {
+		t.Errorf("UsageByType of empty VFS = %v", usage)
+	}
+
+	if err := vfs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.Mkdir("/c", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	sizes := map[string]int{
+		"/file":     100,
+		"/a/file":   blockSize + 1,
+		"/a/b/file": 10,
+		"/c/file":   20,
+	}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(vfs, name, make([]byte, size), 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
 		}
 	}
+	// a hard link is counted under the first directory it's found in
+	if err := vfs.Link("/c/file", "/a/link"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+
+	want := map[string]int64{
+		"/":  int64(100 + core.Overhead),
+		"/a": int64(blockSize+core.Overhead) + int64(1+core.Overhead) + int64(10+core.Overhead) + int64(20+core.Overhead),
+	}
+	usage := vfs.UsageByType()
+	if fmt.Sprint(usage) != fmt.Sprint(want) {
+		t.Errorf("UsageByType = %v, want %v", usage, want)
+	}
+
+	var sum int64
+	for _, n := range usage {
+		sum += n
+	}
+	if _, total := vfs.Usage(); sum != total {
+		t.Errorf("UsageByType sums to %d, Usage = %d", sum, total)
+	}
 }
 
-func newFile(testName string, fs absfs.FileSystem, t *testing.T) (f absfs.File) {
-	f, err := ioutil.TempFile(fs, "/", "_Go_"+testName)
+func TestRedactedFS(t *testing.T) {
+	vfs, err := FromMap(map[string]MapFile{
+		"secrets/key":   {Data: []byte(abc), Mode: 0600},
+		"secrets/empty": {},
+		"readme.txt":    {Data: []byte(dots)},
+		"link":          {Data: []byte("secrets/key"), Mode: fs.ModeSymlink},
+	})
 	if err != nil {
-		t.Fatalf("TempFile %s: %s", testName, err)
+		t.Fatalf("FromMap error: %s", err)
 	}
-	return
-}
+	redacted := vfs.(*pbFS).RedactedFS()
 
-func TestSeek(t *testing.T) {
-	vfs := NewFS()
-	f := newFile("TestSeek", vfs, t)
-	defer f.Close()
+	listing := func(fsys fs.FS) string {
+		var lines []string
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s %v %d", name, fi.Mode(), fi.Size()))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WalkDir error: %s", err)
+		}
+		return strings.Join(lines, "\n")
+	}
+	if got, want := listing(redacted), listing(vfs.FS()); got != want {
+		t.Errorf("redacted listing:\n%s\nwant:\n%s", got, want)
+	}
 
-	const data = "hello, world\n"
-	io.WriteString(f, data)
+	for name, want := range map[string]string{
+		"secrets/key":   "XXXXXXXXXXXXXXXX",
+		"secrets/empty": "",
+		"readme.txt":    "XXXXXXXXXXXXXXXX",
+		"link":          "XXXXXXXXXXXXXXXX",
+	} {
+		if b, err := fs.ReadFile(redacted, name); err != nil || string(b) != want {
+			t.Errorf("ReadFile(%q) = %q, %v; want %q", name, b, err, want)
+		}
+	}
 
-	type test struct {
-		in     int64
-		whence int
-		out    int64
+	if err := fstest.TestFS(redacted, "secrets/key", "readme.txt"); err != nil {
+		t.Errorf("error testing redacted FS: %v", err)
 	}
-	tests := []test{
-		{0, io.SeekCurrent, int64(len(data))},
-		{0, io.SeekStart, 0},
-		{5, io.SeekStart, 5},
-		{0, io.SeekEnd, int64(len(data))},
-		{0, io.SeekStart, 0},
-		{-1, io.SeekEnd, int64(len(data)) - 1},
-		{1 << 33, io.SeekStart, 1 << 33},
-		{1 << 33, io.SeekEnd, 1<<33 + int64(len(data))},
+}
 
-		// Issue 21681, Windows 4G-1, etc:
-		{1<<32 - 1, io.SeekStart, 1<<32 - 1},
-		{0, io.SeekCurrent, 1<<32 - 1},
-		{2<<32 - 1, io.SeekStart, 2<<32 - 1},
-		{0, io.SeekCurrent, 2<<32 - 1},
+func TestReadDirChunks(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
 	}
-	for i, tt := range tests {
-		off, err := f.Seek(tt.in, tt.whence)
-		if off != tt.out || err != nil {
-			t.Errorf("#%d: Seek(%v, %v) = %v, %v want %v, nil", i, tt.in, tt.whence, off, err, tt.out)
+	// "-a" sorts before the "." and ".." entries
+	for _, name := range []string{"-a", "b", "c"} {
+		if err := ioutil.WriteFile(vfs, "/dir/"+name, nil, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
 		}
 	}
-}
 
-func TestReadAt(t *testing.T) {
-	vfs := NewFS()
-	f := newFile("TestReadAt", vfs, t)
+	f, err := vfs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
 	defer f.Close()
 
-	const data = "hello, world\n"
-	io.WriteString(f, data)
-
-	b := make([]byte, 5)
-	n, err := f.ReadAt(b, 7)
-	if err != nil || n != len(b) {
-		t.Fatalf("ReadAt 7: %d, %v", n, err)
+	var names []string
+	for {
+		entries, err := f.ReadDir(2)
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadDir error: %s", err)
+		}
 	}
-	if string(b) != "world" {
-		t.Fatalf("ReadAt 7: have %q want %q", string(b), "world")
+	if got, want := strings.Join(names, ","), "-a,b,c"; got != want {
+		t.Errorf("ReadDir in chunks returned %s, want %s", got, want)
+	}
+	if entries, err := f.ReadDir(-1); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir at end of directory = %v, %v; want no entries", entries, err)
 	}
 }
 
-// Verify that ReadAt doesn't affect seek offset.
-func TestReadAtOffset(t *testing.T) {
+func TestReadDirPagination(t *testing.T) {
 	vfs := NewFS()
-	f := newFile("TestReadAtOffset", vfs, t)
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ioutil.WriteFile(vfs, fmt.Sprintf("/dir/%d", i), nil, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
+	}
+
+	f, err := vfs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
 	defer f.Close()
 
-	const data = "hello, world\n"
-	io.WriteString(f, data)
+	var chunks []string
+	for {
+		entries, err := f.ReadDir(3)
+		if err == io.EOF {
+			if len(entries) != 0 {
+				t.Errorf("ReadDir returned %d entries with io.EOF", len(entries))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadDir error: %s", err)
+		}
+		if len(entries) == 0 || len(entries) > 3 {
+			t.Fatalf("ReadDir(3) returned %d entries", len(entries))
+		}
 
-	f.Seek(0, 0)
-	b := make([]byte, 5)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		chunks = append(chunks, strings.Join(names, ","))
 
-	n, err := f.ReadAt(b, 7)
-	if err != nil || n != len(b) {
-		t.Fatalf("ReadAt 7: %d, %v", n, err)
+		// removing an entry that was already returned must not cause
+		// any of the remaining ones to be skipped
+		if err := vfs.Remove("/dir/" + names[0]); err != nil {
+			t.Fatalf("Remove error: %s", err)
+		}
 	}
-	if string(b) != "world" {
-		t.Fatalf("ReadAt 7: have %q want %q", string(b), "world")
+	if got, want := strings.Join(chunks, " "), "0,1,2 3,4,5 6,7,8 9"; got != want {
+		t.Errorf("ReadDir(3) returned %s, want %s", got, want)
 	}
+}
 
-	n, err = f.Read(b)
-	if err != nil || n != len(b) {
-		t.Fatalf("Read: %d, %v", n, err)
+func TestReadDirLargeN(t *testing.T) {
+	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0777); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
 	}
-	if string(b) != "hello" {
-		t.Fatalf("Read: have %q want %q", string(b), "hello")
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(vfs, "/dir/"+name, nil, 0666); err != nil {
+			t.Fatalf("WriteFile error: %s", err)
+		}
 	}
-}
 
-// Verify that ReadAt doesn't allow negative offset.
-func TestReadAtNegativeOffset(t *testing.T) {
-	vfs := NewFS()
-	f := newFile("TestReadAtNegativeOffset", vfs, t)
+	f, err := vfs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
 	defer f.Close()
 
-	const data = "hello, world\n"
-	io.WriteString(f, data)
-
-	f.Seek(0, 0)
-	b := make([]byte, 5)
-
-	n, err := f.ReadAt(b, -10)
-
-	const wantsub = "negative offset"
-	if !strings.Contains(fmt.Sprint(err), wantsub) || n != 0 {
-		t.Errorf("ReadAt(-10) = %v, %v; want 0, ...%q...", n, err, wantsub)
+	if entries, err := f.ReadDir(100); err != nil || len(entries) != 3 {
+		t.Errorf("ReadDir(100) = %d entries, %v; want 3 entries", len(entries), err)
+	}
+	if entries, err := f.ReadDir(100); err != io.EOF || len(entries) != 0 {
+		t.Errorf("ReadDir(100) at end of directory = %d entries, %v; want io.EOF", len(entries), err)
 	}
 }
 
-func TestWriteAt(t *testing.T) {
-	vfs := NewFS()
-	f := newFile("TestWriteAt", vfs, t)
-	defer f.Close()
+func TestNoTimestamps(t *testing.T) {
+	fsys, err := NewFSWithOptions(Options{NoTimestamps: true})
+	if err != nil {
+		t.Fatalf("NewFSWithOptions error: %s", err)
+	}
+	vfs := fsys.(*pbFS)
+	root, err := vfs.Stat("/")
+	if err != nil {
+		t.Fatalf("Stat error: %s", err)
+	}
+	created := root.ModTime()
 
-	const data = "hello, world\n"
-	io.WriteString(f, data)
+	time.Sleep(10 * time.Millisecond)
+	if err := vfs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.WriteFile("/dir/file", []byte(abc), 0666); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	if err := vfs.Link("/dir/file", "/dir/sub/link"); err != nil {
+		t.Fatalf("Link error: %s", err)
+	}
+	if err := vfs.Symlink("file", "/dir/symlink"); err != nil {
+		t.Fatalf("Symlink error: %s", err)
+	}
+	if err := vfs.Remove("/dir/sub/link"); err != nil {
+		t.Fatalf("Remove error: %s", err)
+	}
 
-	n, err := f.WriteAt([]byte("WORLD"), 7)
-	if err != nil || n != 5 {
-		t.Fatalf("WriteAt 7: %d, %v", n, err)
+	for _, name := range []string{"/", "/dir", "/dir/sub", "/dir/file", "/dir/symlink"} {
+		fi, err := vfs.Lstat(name)
+		if err != nil {
+			t.Fatalf("Lstat error: %s", err)
+		}
+		node := fi.Sys().(*inode.Inode)
+		for _, tm := range []time.Time{node.Ctime, node.Atime, node.Mtime} {
+			if !tm.Equal(created) {
+				t.Errorf("%s: timestamp %v, want %v", name, tm, created)
+			}
+		}
 	}
 
-	b, err := ioutil.ReadFile(vfs, f.Name())
-	if err != nil {
-		t.Fatalf("ReadFile %s: %v", f.Name(), err)
+	// times can still be set explicitly
+	mtime := created.Add(-time.Hour)
+	if err := vfs.Chtimes("/dir/file", time.Time{}, mtime); err != nil {
+		t.Fatalf("Chtimes error: %s", err)
 	}
-	if string(b) != "hello, WORLD\n" {
-		t.Fatalf("after write: have %q want %q", string(b), "hello, WORLD\n")
+	if fi, err := vfs.Stat("/dir/file"); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("ModTime after Chtimes = %v, %v; want %v", fi.ModTime(), err, mtime)
 	}
 }
 
-// Verify that WriteAt doesn't allow negative offset.
-func TestWriteAtNegativeOffset(t *testing.T) {
-	vfs := NewFS()
-	f := newFile("TestWriteAtNegativeOffset", vfs, t)
-	defer f.Close()
-
-	n, err := f.WriteAt([]byte("WORLD"), -10)
+func BenchmarkTimestamps(b *testing.B) {
+	for _, noTimes := range []bool{false, true} {
+		b.Run(fmt.Sprintf("NoTimestamps=%t", noTimes), func(b *testing.B) {
+			fsys, err := NewFSWithOptions(Options{NoTimestamps: noTimes})
+			if err != nil {
+				b.Fatal(err)
+			}
+			vfs := fsys.(*pbFS)
+			if err := vfs.WriteFile("/file", nil, 0666); err != nil {
+				b.Fatal(err)
+			}
 
-	const wantsub = "negative offset"
-	if !strings.Contains(fmt.Sprint(err), wantsub) || n != 0 {
-		t.Errorf("WriteAt(-10) = %v, %v; want 0, ...%q...", n, err, wantsub)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := vfs.Link("/file", "/link"); err != nil {
+					b.Fatal(err)
+				}
+				if err := vfs.Rename("/link", "/renamed"); err != nil {
+					b.Fatal(err)
+				}
+				if err := vfs.Remove("/renamed"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
 
-// Verify that WriteAt doesn't work in append mode.
-func TestWriteAtInAppendMode(t *testing.T) {
+func TestDeadline(t *testing.T) {
 	vfs := NewFS()
-	f, err := vfs.OpenFile("write_at_in_append_mode.txt", os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		t.Fatalf("OpenFile: %v", err)
-	}
-	defer f.Close()
+	f := newFile("TestDeadline", vfs, t)
 
-	_, err = f.WriteAt([]byte(""), 1)
-	if err != os.ErrPermission {
-		t.Fatalf("f.WriteAt returned %v, expected %v", err, os.ErrPermission)
+	type deadliner interface {
+		SetDeadline(time.Time) error
+		SetReadDeadline(time.Time) error
+		SetWriteDeadline(time.Time) error
 	}
-}
-
-func writeFile(vfs absfs.FileSystem, t *testing.T, fname string, flag int, text string) string {
-	f, err := vfs.OpenFile(fname, flag, 0666)
-	if err != nil {
-		t.Fatalf("Open: %v", err)
+	d, ok := f.(deadliner)
+	if !ok {
+		t.Fatalf("%T does not support deadlines", f)
 	}
-	n, err := io.WriteString(f, text)
-	if err != nil {
-		t.Fatalf("WriteString: %d, %v", n, err)
+	deadline := time.Now().Add(time.Millisecond)
+	for _, set := range []func(time.Time) error{d.SetDeadline, d.SetReadDeadline, d.SetWriteDeadline} {
+		if err := set(deadline); !errors.Is(err, os.ErrNoDeadline) {
+			t.Errorf("setting deadline: got %v, want %v", err, os.ErrNoDeadline)
+		}
 	}
+
 	f.Close()
-	data, err := ioutil.ReadFile(vfs, fname)
-	if err != nil {
-		t.Fatalf("ReadFile: %v", err)
+	if err := d.SetReadDeadline(deadline); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("SetReadDeadline of closed file: got %v, want %v", err, fs.ErrClosed)
 	}
-	return string(data)
 }
 
-func TestAppend(t *testing.T) {
+func TestChmod(t *testing.T) {
 	vfs := NewFS()
-	const f = "append.txt"
-	s := writeFile(vfs, t, f, os.O_CREATE|os.O_TRUNC|os.O_RDWR, "new")
-	if s != "new" {
-		t.Fatalf("writeFile: have %q want %q", s, "new")
-	}
-	s = writeFile(vfs, t, f, os.O_APPEND|os.O_RDWR, "|append")
-	if s != "new|append" {
-		t.Fatalf("writeFile: have %q want %q", s, "new|append")
-	}
-	s = writeFile(vfs, t, f, os.O_CREATE|os.O_APPEND|os.O_RDWR, "|append")
-	if s != "new|append|append" {
-		t.Fatalf("writeFile: have %q want %q", s, "new|append|append")
+	if err := vfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
 	}
-	err := vfs.Remove(f)
-	if err != nil {
-		t.Fatalf("Remove: %v", err)
+	if err := vfs.WriteFile("/dir/file", nil, 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
 	}
-	s = writeFile(vfs, t, f, os.O_CREATE|os.O_APPEND|os.O_RDWR, "new&append")
-	if s != "new&append" {
-		t.Fatalf("writeFile: after append have %q want %q", s, "new&append")
+
+	tests := []struct {
+		name string
+		mode fs.FileMode
+		want fs.FileMode
+	}{
+		{"/dir/file", 0600, 0600},
+		{"/dir/file", 0755 | fs.ModeSetuid, 0755 | fs.ModeSetuid},
+		// the type of a file can't be changed
+		{"/dir/file", fs.ModeDir | 0700, 0700},
+		{"/dir", 0777 | fs.ModeSticky, fs.ModeDir | fs.ModeSticky | 0777},
+	}
+	for _, test := range tests {
+		if err := vfs.Chmod(test.name, test.mode); err != nil {
+			t.Fatalf("Chmod(%q, %v) error: %s", test.name, test.mode, err)
+		}
+		fi, err := vfs.Stat(test.name)
+		if err != nil {
+			t.Fatalf("Stat error: %s", err)
+		}
+		if fi.Mode() != test.want {
+			t.Errorf("Chmod(%q, %v): mode is %v, want %v", test.name, test.mode, fi.Mode(), test.want)
+		}
 	}
-	s = writeFile(vfs, t, f, os.O_CREATE|os.O_RDWR, "old")
-	if s != "old&append" {
-		t.Fatalf("writeFile: after create have %q want %q", s, "old&append")
+
+	if err := vfs.Chmod("/nonexistent", 0600); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chmod of nonexistent file: got %v, want %v", err, fs.ErrNotExist)
 	}
-	s = writeFile(vfs, t, f, os.O_CREATE|os.O_TRUNC|os.O_RDWR, "new")
-	if s != "new" {
-		t.Fatalf("writeFile: after truncate have %q want %q", s, "new")
+	if err := vfs.Chown("/dir/file", 0, 0); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Chown: got %v, want %v", err, errors.ErrUnsupported)
 	}
 }
 
-func TestModTime(t *testing.T) {
+func TestConcurrentChmod(t *testing.T) {
 	vfs := NewFS()
+	if err := vfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %s", err)
+	}
+	if err := vfs.WriteFile("/dir/file", nil, 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
 
-	tBeforeWrite := time.Now()
-	ioutil.WriteFile(vfs, "/readme.txt", []byte{0, 0, 0}, 0666)
-	fi, _ := vfs.Stat("/readme.txt")
-	mtimeAfterWrite := fi.ModTime()
+	const iters = 100
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iters; i++ {
+			mode := fs.FileMode(0755)
+			if i%2 == 1 {
+				mode = 0700
+			}
+			now := time.Now()
+			if err := vfs.Chmod("/dir", mode); err != nil {
+				t.Errorf("Chmod error: %s", err)
+				return
+			}
+			if err := vfs.Chtimes("/dir", now, now); err != nil {
+				t.Errorf("Chtimes error: %s", err)
+				return
+			}
+			if err := vfs.(*pbFS).SetTimes("/dir", now, now, now); err != nil {
+				t.Errorf("SetTimes error: %s", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iters; i++ {
+			// resolving a path reads the mode of every directory on it
+			if _, err := vfs.Stat("/dir/file"); err != nil {
+				t.Errorf("Stat error: %s", err)
+				return
+			}
+			fi, err := vfs.Lstat("/dir")
+			if err != nil {
+				t.Errorf("Lstat error: %s", err)
+				return
+			}
+			fi.(*FileInfo).Snapshot()
 
-	if !mtimeAfterWrite.After(tBeforeWrite) {
-		t.Error("Open should modify mtime")
-	}
+			// adding and removing entries changes the directory's times
+			if err := vfs.Mkdir("/dir/sub", 0755); err != nil {
+				t.Errorf("Mkdir error: %s", err)
+				return
+			}
+			if err := vfs.Remove("/dir/sub"); err != nil {
+				t.Errorf("Remove error: %s", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
 
-	f, err := vfs.OpenFile("/readme.txt", os.O_RDONLY, 0666)
+func TestClose(t *testing.T) {
+	vfs, err := NewFSWithOptions(Options{MaxBytes: 1 << 20, Dedup: true})
 	if err != nil {
-		t.Fatalf("Could not open file: %s", err)
+		t.Fatalf("NewFSWithOptions error: %s", err)
 	}
-	f.Close()
-	tAfterRead := fi.ModTime()
+	if err := vfs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %s", err)
+	}
+	if err := vfs.WriteFile("/a/b/file", []byte(dots), 0644); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	f, err := vfs.Open("/a/b/file")
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	defer f.Close()
+	blocks := vfs.(*pbFS).data[f.(*file).node.Ino].blocks
+	ciphertext := blocks[0].ciphertext
 
-	if tAfterRead != mtimeAfterWrite {
-		t.Error("Open with O_RDONLY should not modify mtime")
+	if err := vfs.(io.Closer).Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if !bytes.Equal(ciphertext, make([]byte, len(ciphertext))) {
+		t.Error("sealed contents were not wiped")
+	}
+	if got := vfs.(*pbFS).quota.used; got != 0 {
+		t.Errorf("%d bytes used after Close, want 0", got)
+	}
+	if entries, err := vfs.ReadDir("/"); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir of root after Close = %d entries, %v; want 0", len(entries), err)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read of open file after Close = %d, %v; want 0, EOF", n, err)
+	}
+
+	// the VFS can still be used
+	if err := vfs.WriteFile("/file", []byte(abc), 0644); err != nil {
+		t.Fatalf("WriteFile after Close error: %s", err)
+	}
+	if b, err := vfs.ReadFile("/file"); err != nil || string(b) != abc {
+		t.Errorf("ReadFile after Close = %q, %v; want %q", b, err, abc)
 	}
 }
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"math/bits"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -14,6 +16,8 @@ import (
 	"github.com/awnumar/fastrand"
 	"github.com/awnumar/memguard"
 	"github.com/awnumar/memguard/core"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
 
 	"github.com/capnspacehook/pandorasbox/inode"
 )
@@ -26,34 +30,707 @@ type file struct {
 	fs *pbFS
 
 	name  string
+	path  string // absolute path the file was opened at, for events
 	flags int
 	node  *inode.Inode
 	data  *sealedFile
 
-	offset    int64
-	diroffset int
+	offset int64
+	// dirpos is the name of the last entry returned by ReadDir. Entries
+	// are kept sorted by name, so listing resumes right after it even if
+	// entries were added or removed in the meantime.
+	dirpos string
 }
 
-type sealedFile struct {
-	f *file
+// blockSize is the size of the plaintext blocks that file contents are
+// split into. Every block is sealed under its own key, so reads and
+// writes only have to decrypt and re-seal the blocks they overlap.
+const (
+	blockShift = 16
+	blockSize  = 1 << blockShift
+)
+
+// maxFileSize is the largest size a file can grow to. The blocks of a
+// file are indexed by a slice, so sparse files past it would need
+// unreasonable amounts of memory even if none of their blocks are
+// written.
+const maxFileSize = 1 << 40
+
+// bufPools holds transient plaintext and ciphertext buffers, indexed by
+// the base 2 logarithm of their size, so that reads and writes don't
+// allocate a new buffer every time.
+var bufPools [blockShift + 2]sync.Pool
+
+// getBuf returns a zeroed buffer of the smallest power of two size that
+// is at least size, which must not be larger than twice blockSize.
+func getBuf(size int64) *[]byte {
+	i := bits.Len64(uint64(size - 1))
+	if bp, ok := bufPools[i].Get().(*[]byte); ok {
+		return bp
+	}
+
+	buf := make([]byte, 1<<i)
+	return &buf
+}
+
+// putBuf wipes a buffer returned by getBuf and returns it to its pool.
+// Buffers are always wiped before they are pooled so plaintext can
+// never be handed to a later caller.
+func putBuf(bp *[]byte) {
+	core.Wipe(*bp)
+	bufPools[bits.Len64(uint64(len(*bp)-1))].Put(bp)
+}
 
+// sealedBlock is a single encrypted block of file contents. If the VFS
+// doesn't encrypt contents, key is nil and ciphertext holds the
+// plaintext as is.
+type sealedBlock struct {
 	ciphertext []byte
 	key        *memguard.Enclave
+
+	length     int  // length of the plaintext
+	compressed bool // whether the plaintext was compressed before sealing
+
+	// where the ciphertext is stored instead if the block has been
+	// spilled to disk
+	backing *os.File
+	off     int64
+	clen    int
+
+	// keyed hash of the plaintext and number of files holding the
+	// block, only used by blocks shared through a dedupStore
+	sum  [blake2b.Size256]byte
+	refs int
 }
 
-func (f *file) updateSize() {
-	if len(f.data.ciphertext) == 0 {
-		f.node.Size = 0
+// randomKey is the default source of key material, generating a new
+// random key every time data is sealed.
+func randomKey() ([]byte, error) {
+	return fastrand.Bytes(keySize), nil
+}
+
+// sealBlock encrypts plaintext under a key obtained from newKey. If level
+// is not zero, plaintext is first compressed at that flate compression
+// level, unless that wouldn't make it any smaller. If newKey is nil,
+// plaintext is copied into the block without being encrypted.
+func sealBlock(plaintext []byte, newKey func() ([]byte, error), level int) (*sealedBlock, error) {
+	data, compressed := plaintext, false
+	if level != 0 && len(plaintext) > 1 {
+		bp := getBuf(int64(len(plaintext)))
+		defer putBuf(bp)
+		if n, ok := compress(*bp, plaintext, level); ok {
+			data, compressed = (*bp)[:n], true
+		}
+	}
+
+	if newKey == nil {
+		return &sealedBlock{
+			ciphertext: append([]byte(nil), data...),
+			length:     len(plaintext),
+			compressed: compressed,
+		}, nil
+	}
+
+	k, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != keySize {
+		core.Wipe(k)
+		return nil, core.ErrInvalidKeyLength
+	}
+
+	key := memguard.NewBufferFromBytes(k)
+	ciphertext, err := core.Encrypt(data, key.Bytes())
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	return &sealedBlock{
+		ciphertext: ciphertext,
+		key:        key.Seal(),
+		length:     len(plaintext),
+		compressed: compressed,
+	}, nil
+}
+
+// len returns the length of the block's plaintext.
+func (b *sealedBlock) len() int {
+	if b == nil {
+		return 0
+	}
+
+	return b.length
+}
+
+// open decrypts the block into buf and returns the length of the
+// plaintext. A nil block has no plaintext.
+func (b *sealedBlock) open(buf []byte) (int, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	ciphertext := b.ciphertext
+	if b.backing != nil {
+		cp := getBuf(int64(b.clen))
+		defer putBuf(cp)
+		ciphertext = (*cp)[:b.clen]
+		if _, err := b.backing.ReadAt(ciphertext, b.off); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.key == nil {
+		if !b.compressed {
+			return copy(buf, ciphertext), nil
+		}
+		if err := decompress(buf[:b.length], ciphertext); err != nil {
+			return 0, err
+		}
+
+		return b.length, nil
+	}
+
+	key, err := b.key.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer key.Destroy()
+
+	// core.Decrypt allocates a buffer for the plaintext on every call,
+	// so open the box directly into buf instead. The ciphertext has the
+	// same layout core.Encrypt produces: the nonce followed by the box.
+	var nonce [24]byte
+	copy(nonce[:], ciphertext[:len(nonce)])
+	if !b.compressed {
+		plaintext, ok := secretbox.Open(buf[:0], ciphertext[len(nonce):], &nonce, key.ByteArray32())
+		if !ok {
+			return 0, core.ErrDecryptionFailed
+		}
+
+		return len(plaintext), nil
+	}
+
+	bp := getBuf(int64(len(ciphertext) - core.Overhead))
+	defer putBuf(bp)
+	data, ok := secretbox.Open((*bp)[:0], ciphertext[len(nonce):], &nonce, key.ByteArray32())
+	if !ok {
+		return 0, core.ErrDecryptionFailed
+	}
+	if err := decompress(buf[:b.length], data); err != nil {
+		return 0, err
+	}
+
+	return b.length, nil
+}
+
+// sealedFile holds the encrypted contents of a file as a list of blocks
+// of at most blockSize bytes. Any bytes of the file that lie past the
+// end of a block's plaintext, including those of nil blocks, are zero.
+type sealedFile struct {
+	mtx sync.RWMutex
+
+	size   int64
+	blocks []*sealedBlock
+
+	newKey      func() ([]byte, error)
+	compression int // flate compression level, zero if disabled
+	quota       *quota
+	dedup       *dedupStore  // nil unless blocks are deduplicated
+	spill       *spillConfig // nil unless large files are spilled to disk
+	backing     *os.File     // set once the file has been spilled
+
+	// number of open handles, and whether every link to the file has
+	// been removed; the contents are freed once both are true
+	opens   int
+	removed bool
+
+	// number of blocks that have been encrypted for the file
+	seals uint64
+}
+
+// quota tracks the total size of the contents of the files in a VFS.
+type quota struct {
+	max  int64 // zero if there is no limit
+	used int64
+}
+
+// reserve adds n bytes to the space used, failing with ENOSPC if that
+// would exceed the limit. Negative values of n release space.
+func (q *quota) reserve(n int64) error {
+	for {
+		used := atomic.LoadInt64(&q.used)
+		if n > 0 && q.max > 0 && used+n > q.max {
+			return syscall.ENOSPC
+		}
+		if atomic.CompareAndSwapInt64(&q.used, used, used+n) {
+			return nil
+		}
+	}
+}
+
+// open records that a new handle to the file was opened.
+func (s *sealedFile) open() {
+	s.mtx.Lock()
+	s.opens++
+	s.mtx.Unlock()
+}
+
+// close records that a handle to the file was closed, freeing the file's
+// contents if it was the last handle to a file that has been removed.
+func (s *sealedFile) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.opens--
+	if s.opens == 0 && s.removed {
+		s.free()
+	}
+}
+
+// remove records that every link to the file has been removed, freeing
+// the file's contents if no handles to it are open. It reports whether
+// the file had not already been removed.
+func (s *sealedFile) remove() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.removed {
+		return false
+	}
+	s.removed = true
+	if s.opens == 0 {
+		s.free()
+	}
+
+	return true
+}
+
+// isRemoved reports whether every link to the file has been removed.
+func (s *sealedFile) isRemoved() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.removed
+}
+
+// free drops the sealed contents of the file, wiping every block that
+// isn't shared with another file, and its backing file on disk if it
+// was spilled.
+func (s *sealedFile) free() {
+	for _, b := range s.blocks {
+		s.release(b)
+	}
+	s.removeBacking()
+	s.quota.reserve(-s.size)
+	s.size = 0
+	s.blocks = nil
+}
+
+// wipe overwrites the sealed contents of the file and frees them. Open
+// handles to the file see it as removed.
+func (s *sealedFile) wipe() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, b := range s.blocks {
+		if b != nil {
+			core.Wipe(b.ciphertext)
+		}
+	}
+	s.free()
+	s.removed = true
+}
+
+// seal returns a block holding plaintext, which is shared with other
+// files if deduplication is enabled and the file hasn't been spilled.
+func (s *sealedFile) seal(plaintext []byte) (*sealedBlock, error) {
+	if s.dedup != nil && s.backing == nil {
+		return s.dedup.seal(plaintext, s.sealBlock)
+	}
+
+	return s.sealBlock(plaintext)
+}
+
+// sealBlock seals plaintext into a new block that isn't shared. The
+// caller must hold s.mtx for writing.
+func (s *sealedFile) sealBlock(plaintext []byte) (*sealedBlock, error) {
+	if s.newKey != nil {
+		s.seals++
+	}
+	return sealBlock(plaintext, s.newKey, s.compression)
+}
+
+// release drops a block that is no longer part of the file, wiping its
+// ciphertext and dropping its key once no other file shares it.
+func (s *sealedFile) release(b *sealedBlock) {
+	if b == nil {
+		return
+	}
+	if s.dedup != nil && b.backing == nil && !s.dedup.release(b) {
 		return
 	}
+	core.Wipe(b.ciphertext)
+	b.key = nil
+}
+
+// decrypt opens the sealed data and returns the plaintext contents of
+// the file. The caller is responsible for wiping the returned buffer.
+func (s *sealedFile) decrypt() ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.size == 0 {
+		return nil, nil
+	}
+
+	plaintext := make([]byte, s.size)
+	if _, err := s.read(plaintext, 0); err != nil {
+		core.Wipe(plaintext)
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// encrypt seals plaintext with freshly generated keys, replacing the
+// previously sealed data.
+func (s *sealedFile) encrypt(plaintext []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.free()
+
+	return s.write(plaintext, 0)
+}
+
+// reseal re-encrypts every block of the sealed data under a new key.
+func (s *sealedFile) reseal() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	bp := getBuf(blockSize)
+	defer putBuf(bp)
+	buf := *bp
+
+	for i, b := range s.blocks {
+		if b == nil {
+			continue
+		}
+
+		n, err := b.open(buf)
+		if err != nil {
+			return err
+		}
+		var nb *sealedBlock
+		if s.dedup != nil && s.backing == nil {
+			nb, err = s.dedup.reseal(buf[:n], s.sealBlock)
+		} else {
+			nb, err = s.sealBlock(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.setBlock(int64(i), nb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sealedSize returns the number of bytes of ciphertext held for the file.
+// Blocks in seen are skipped, and the blocks that are counted are added
+// to it, so blocks shared between files are only counted once.
+func (s *sealedFile) sealedSize(seen map[*sealedBlock]bool) int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var size int64
+	for _, b := range s.blocks {
+		if b != nil && !seen[b] {
+			seen[b] = true
+			size += int64(len(b.ciphertext))
+		}
+	}
+
+	return size
+}
+
+// readAt decrypts the blocks overlapping p and copies their contents
+// from off into p. It returns the number of bytes read, which is only
+// less than len(p) if the end of the file was reached.
+func (s *sealedFile) readAt(p []byte, off int64) (int, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.read(p, off)
+}
+
+func (s *sealedFile) read(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= s.size {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	if end > s.size {
+		end = s.size
+	}
+
+	// small files never need a full block of plaintext
+	bp := getBuf(min64(blockSize, s.size))
+	defer putBuf(bp)
+	buf := *bp
+
+	for i := off / blockSize; i*blockSize < end; i++ {
+		start := i * blockSize
+		lo, hi := max64(off, start), min64(end, start+blockSize)
+		dst := p[lo-off : hi-off]
+
+		var n int
+		if i < int64(len(s.blocks)) {
+			var err error
+			if n, err = s.blocks[i].open(buf); err != nil {
+				return 0, err
+			}
+		}
+
+		copied := 0
+		if lo-start < int64(n) {
+			copied = copy(dst, buf[lo-start:n])
+		}
+		core.Wipe(dst[copied:])
+	}
+
+	return int(end - off), nil
+}
+
+// writeTo writes the contents of the file to w a block at a time.
+func (s *sealedFile) writeTo(w io.Writer) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	bp := getBuf(blockSize)
+	defer putBuf(bp)
+	buf := *bp
+
+	for off := int64(0); off < s.size; off += blockSize {
+		n, err := s.read(buf, off)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeAt copies p into the file at off, re-sealing only the blocks that
+// p overlaps. The file is extended if necessary.
+func (s *sealedFile) writeAt(p []byte, off int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.write(p, off)
+}
+
+// append copies p to the end of the file. The end is found while the
+// file is locked, so concurrent appends never overwrite each other.
+func (s *sealedFile) append(p []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.write(p, s.size)
+}
+
+func (s *sealedFile) write(p []byte, off int64) error {
+	if off < 0 {
+		return syscall.EINVAL
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	if off > maxFileSize-int64(len(p)) {
+		return syscall.EFBIG
+	}
+	end := off + int64(len(p))
+	size := max64(s.size, end)
+	if err := s.quota.reserve(size - s.size); err != nil {
+		return err
+	}
+
+	err := s.trimBlocks(s.size)
+	if err == nil {
+		err = s.writeBlocks(p, off, size)
+	}
+	if err != nil {
+		// drop anything that was written past the end of the file, so
+		// that growing it later doesn't read it back
+		s.trimBlocks(s.size)
+		s.quota.reserve(s.size - size)
+		return err
+	}
+	s.size = size
+
+	return s.maybeSpill()
+}
+
+// writeBlocks seals the blocks overlapped by p written at off, in a file
+// that will be size bytes long. The caller must hold s.mtx for writing.
+func (s *sealedFile) writeBlocks(p []byte, off, size int64) error {
+	bp := getBuf(min64(blockSize, size))
+	defer putBuf(bp)
+	buf := *bp
+
+	end := off + int64(len(p))
+	last := (end - 1) / blockSize
+	if n := last + 1; n > int64(len(s.blocks)) {
+		s.blocks = append(s.blocks, make([]*sealedBlock, n-int64(len(s.blocks)))...)
+	}
+
+	for i := off / blockSize; i <= last; i++ {
+		start := i * blockSize
+		lo, hi := max64(off, start), min64(end, start+blockSize)
+		blen := min64(size-start, blockSize)
+
+		// existing contents only need to be decrypted if the block
+		// is not entirely overwritten
+		core.Wipe(buf)
+		if lo > start || hi < start+blen {
+			if _, err := s.blocks[i].open(buf); err != nil {
+				return err
+			}
+		}
+		copy(buf[lo-start:], p[lo-off:hi-off])
+
+		b, err := s.seal(buf[:blen])
+		if err != nil {
+			return err
+		}
+		if err := s.setBlock(i, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncate changes the size of the file. Only the new last block has to
+// be re-sealed when shrinking the file, and nothing has to be sealed when
+// growing it, as bytes past the end of the sealed data are zero, unless
+// a failed write left plaintext past the end of the last block.
+func (s *sealedFile) truncate(size int64) error {
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	if size > maxFileSize {
+		return syscall.EFBIG
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// an empty file is represented by no sealed data at all
+	if size == 0 {
+		s.free()
+		return nil
+	}
+	if size > s.size {
+		if err := s.quota.reserve(size - s.size); err != nil {
+			return err
+		}
+		// a write that failed may have left plaintext past the end
+		if err := s.trimBlocks(s.size); err != nil {
+			s.quota.reserve(s.size - size)
+			return err
+		}
+	}
+	if size < s.size {
+		if err := s.trimBlocks(size); err != nil {
+			return err
+		}
+		s.quota.reserve(size - s.size)
+	}
+	s.size = size
+
+	return nil
+}
+
+// trimBlocks drops the blocks of the file past size, and re-seals the
+// last block that remains if its plaintext extends past size, so that
+// growing the file later reads zeros there. The caller must hold s.mtx
+// for writing.
+func (s *sealedFile) trimBlocks(size int64) error {
+	n := (size + blockSize - 1) / blockSize
+	if n < int64(len(s.blocks)) {
+		for i, b := range s.blocks[n:] {
+			s.release(b)
+			s.blocks[n+int64(i)] = nil
+		}
+		s.blocks = s.blocks[:n]
+	}
+
+	i := n - 1
+	if i < 0 || i >= int64(len(s.blocks)) {
+		return nil
+	}
+	blen := size - i*blockSize
+	if int64(s.blocks[i].len()) <= blen {
+		return nil
+	}
+
+	// the discarded tail of the plaintext is wiped along with the rest
+	// of buf when it's returned to the pool
+	bp := getBuf(blockSize)
+	defer putBuf(bp)
+	buf := *bp
+
+	if _, err := s.blocks[i].open(buf); err != nil {
+		return err
+	}
+	b, err := s.seal(buf[:blen])
+	if err != nil {
+		return err
+	}
+
+	return s.setBlock(i, b)
+}
 
-	f.node.Size = int64(len(f.data.ciphertext) - core.Overhead)
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (f *file) updateSize() {
+	f.data.mtx.RLock()
+	atomic.StoreInt64(&f.node.Size, f.data.size)
+	f.data.mtx.RUnlock()
 }
 
 func (f *file) Name() string {
 	return f.name
 }
 
+// Read reads up to len(p) bytes from the file at its offset. A read sees
+// the contents of the file as of the moment it is made: every write that
+// completed before it is fully visible, and none that started after it
+// is. Writes made through other handles while the file is open, such as
+// appends that extend it past the end reached by an earlier Read, are
+// returned by later reads without needing to reopen the file.
 func (f *file) Read(p []byte) (int, error) {
 	n, err := f.read(p, atomic.LoadInt64(&f.offset))
 	atomic.AddInt64(&f.offset, int64(n))
@@ -74,43 +751,16 @@ func (f *file) read(p []byte, offset int64) (int, error) {
 	if f.node.IsDir() {
 		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
 	}
-	if offset >= atomic.LoadInt64(&f.node.Size) {
-		return 0, io.EOF
-	}
-
-	var (
-		err error
-		key *memguard.LockedBuffer
-	)
-
-	if atomic.LoadInt64(&f.node.Size) != 0 {
-		f.mtx.RLock()
-		key, err = f.data.key.Open()
-		f.mtx.RUnlock()
-		if err != nil {
-			return 0, err
-		}
-	} else {
-		return 0, io.EOF
-	}
 
-	plaintext := make([]byte, f.node.Size)
-	f.mtx.RLock()
-	_, err = core.Decrypt(f.data.ciphertext, key.Bytes(), plaintext)
-	key.Destroy()
-	f.mtx.RUnlock()
+	// the size of the sealed contents is checked while they are locked,
+	// rather than the size of the inode, which is only updated after a
+	// write completes
+	n, err := f.data.readAt(p, offset)
 	if err != nil {
-		return 0, err
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
 	}
-
-	core.Copy(p, plaintext[offset:])
-	core.Wipe(plaintext)
-
-	var n int
-	if len(p) < len(plaintext[offset:]) {
-		n = len(p)
-	} else {
-		n = len(plaintext[offset:])
+	if n == 0 {
+		return 0, io.EOF
 	}
 
 	if len(p) > n {
@@ -120,6 +770,47 @@ func (f *file) read(p []byte, offset int64) (int, error) {
 	return n, nil
 }
 
+// WriteTo implements io.WriterTo. The contents of the file from the
+// current offset are written to w a block at a time, so each block is
+// only decrypted once instead of once per chunk as io.Copy would
+// otherwise do.
+func (f *file) WriteTo(w io.Writer) (int64, error) {
+	if f.node == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.flags&_O_ACCESS == os.O_WRONLY {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.node.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	bp := getBuf(blockSize)
+	defer putBuf(bp)
+	buf := *bp
+
+	var written int64
+	for {
+		offset := atomic.LoadInt64(&f.offset)
+		// read up to the next block boundary so only one block is
+		// decrypted per iteration
+		n, err := f.data.readAt(buf[:blockSize-offset%blockSize], offset)
+		if err != nil {
+			return written, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		if n == 0 {
+			return written, nil
+		}
+
+		n, err = w.Write(buf[:n])
+		atomic.AddInt64(&f.offset, int64(n))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
 func (f *file) ReadAt(b []byte, off int64) (n int, err error) {
 	if f.node == nil {
 		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: fs.ErrClosed}
@@ -137,6 +828,11 @@ func (f *file) ReadAt(b []byte, off int64) (n int, err error) {
 	return f.read(b, off)
 }
 
+// ReadDir reads the contents of the directory and returns up to n of
+// its entries, or all of the rest of them if n <= 0, sorted by name.
+// Successive calls continue after the last name returned, so entries
+// added or removed in between don't cause others to be repeated or
+// skipped.
 func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
 	if f.node == nil {
 		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
@@ -152,112 +848,90 @@ func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
-	dirs := f.node.Dir
-	if f.diroffset >= len(dirs) {
-		if n <= 0 {
-			return nil, nil
+	f.node.RLock()
+	entries := f.node.Dir.Entries()
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Name > f.dirpos
+	})
+	var infos []fs.DirEntry
+	for _, entry := range entries[start:] {
+		if n > 0 && len(infos) == n {
+			break
 		}
-		return nil, io.EOF
-	}
-
-	if n <= 0 {
-		// if there are only 2 dirs ('.' and '..'), return
-		// since we are skipping them below
-		if len(dirs) == 2 {
-			return nil, nil
+		// skip '.' and '..' to retain compatibility with os.ReadDir
+		if entry.Name == "." || entry.Name == ".." {
+			continue
 		}
-		n = len(dirs)
-	}
-	// skip '.' and '..' to retain compatibility with os.ReadDir
-	if f.diroffset == 0 {
-		f.diroffset = 2
-	}
-
-	infosLen := n - f.diroffset
-	if infosLen <= 0 {
-		infosLen = n
+		infos = append(infos, &DirEntry{entry.Name, entry.Inode})
 	}
+	f.node.RUnlock()
 
-	infos := make([]fs.DirEntry, infosLen)
-	for i, entry := range dirs[f.diroffset:] {
-		if i == n {
-			break
+	if len(infos) == 0 {
+		if n > 0 {
+			return nil, io.EOF
 		}
-
-		infos[i] = &DirEntry{entry.Name, entry.Inode}
+		return []fs.DirEntry{}, nil
 	}
-	f.diroffset += n
+	f.dirpos = infos[len(infos)-1].Name()
 
 	return infos, nil
 }
 
+// Write writes p to the file at its offset. If the file was opened with
+// O_APPEND, p is instead written at the end of the file as of the
+// moment it is written, ignoring the offset, and the offset is then
+// moved to the end of the file.
 func (f *file) Write(p []byte) (int, error) {
+	if f.flags&os.O_APPEND != 0 {
+		n, err := f.write(p, appendOffset)
+		if f.node != nil {
+			atomic.StoreInt64(&f.offset, atomic.LoadInt64(&f.node.Size))
+		}
+		return n, err
+	}
+
 	n, err := f.write(p, atomic.LoadInt64(&f.offset))
 	atomic.AddInt64(&f.offset, int64(n))
 
 	return n, err
 }
 
+// appendOffset is passed to write in place of an offset to write at the
+// end of the file.
+const appendOffset = -1
+
 func (f *file) write(p []byte, offset int64) (int, error) {
 	if f.node == nil {
 		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
 	}
-	if f.flags&_O_ACCESS == os.O_RDONLY {
-		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
-	}
 	if f.node.IsDir() {
 		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
 	}
-
-	var (
-		err       error
-		plaintext = make([]byte, f.node.Size)
-	)
-
-	if atomic.LoadInt64(&f.node.Size) != 0 {
-		f.mtx.RLock()
-		key, err := f.data.key.Open()
-		if err != nil {
-			return 0, err
-		}
-		_, err = core.Decrypt(f.data.ciphertext, key.Bytes(), plaintext)
-		if err != nil {
-			return 0, err
-		}
-		key.Destroy()
-		f.mtx.RUnlock()
-
+	if f.flags&_O_ACCESS == os.O_RDONLY || f.node.IsImmutable() {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
 	}
 
-	data := plaintext
-	size := len(p) + int(offset)
-	if int64(size) > f.node.Size {
-		data = make([]byte, size)
-		core.Copy(data, plaintext)
+	var err error
+	if offset == appendOffset {
+		err = f.data.append(p)
+	} else {
+		err = f.data.writeAt(p, offset)
 	}
-
-	core.Copy(data[offset:], p)
-	newKey := memguard.NewBufferFromBytes(fastrand.Bytes(keySize))
-
-	f.mtx.Lock()
-	f.data.ciphertext, err = core.Encrypt(data, newKey.Bytes())
-	f.data.key = newKey.Seal()
-	f.updateSize()
-	core.Wipe(data)
-	f.mtx.Unlock()
-
 	if err != nil {
-		return 0, err
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: err}
 	}
+	f.updateSize()
+	f.fs.notify(Write, f.path)
 
-	var n int
-	if len(p) < len(data[offset:]) {
-		n = len(p)
-	} else {
-		n = len(data[offset:])
+	// data is only ever held in memory, so O_SYNC instead forces the
+	// file to be re-sealed after every write
+	if f.flags&os.O_SYNC != 0 {
+		if err := f.data.reseal(); err != nil {
+			return 0, &fs.PathError{Op: "write", Path: f.name, Err: err}
+		}
 	}
 
-	return n, nil
+	return len(p), nil
 }
 
 func (f *file) WriteAt(b []byte, off int64) (n int, err error) {
@@ -267,14 +941,55 @@ func (f *file) WriteAt(b []byte, off int64) (n int, err error) {
 	if off < 0 {
 		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: errors.New("negative offset")}
 	}
+	if f.node.IsDir() {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: syscall.EISDIR}
+	}
 	if f.flags&_O_ACCESS == os.O_RDONLY {
 		return 0, fs.ErrPermission
 	}
+
+	return f.write(b, off)
+}
+
+// ReadFrom implements io.ReaderFrom. The contents of r are read and
+// written to the file a block at a time, so each block of the file is
+// only sealed once instead of once per chunk as io.Copy would otherwise
+// do, and at most one block of plaintext is buffered.
+func (f *file) ReadFrom(r io.Reader) (int64, error) {
+	if f.node == nil {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
 	if f.node.IsDir() {
-		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: syscall.EISDIR}
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
+	}
+	if f.flags&_O_ACCESS == os.O_RDONLY {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
 	}
 
-	return f.write(b, off)
+	bp := getBuf(blockSize)
+	defer putBuf(bp)
+
+	// read a block at a time, aligned to the blocks of the file so
+	// every write seals whole blocks instead of re-sealing partial ones
+	var n int64
+	chunk := blockSize - int(atomic.LoadInt64(&f.offset)%blockSize)
+	for {
+		m, rerr := io.ReadFull(r, (*bp)[:chunk])
+		if m > 0 {
+			w, err := f.Write((*bp)[:m])
+			n += int64(w)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+		chunk = blockSize
+	}
 }
 
 func (f *file) WriteString(s string) (n int, err error) {
@@ -289,6 +1004,12 @@ func (f *file) Stat() (os.FileInfo, error) {
 	return &FileInfo{filepath.Base(f.name), f.node}, nil
 }
 
+// Unlinked reports whether every link to the file has been removed
+// while it was held open, so its name no longer refers to it.
+func (f *file) Unlinked() bool {
+	return f.data != nil && f.data.isRemoved()
+}
+
 func (f *file) Seek(offset int64, whence int) (int64, error) {
 	if f.node == nil {
 		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
@@ -297,115 +1018,112 @@ func (f *file) Seek(offset int64, whence int) (int64, error) {
 		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EISDIR}
 	}
 
-	var ret int64
-	switch whence {
-	case io.SeekStart:
-		if offset < 0 {
+	// as with os.File, seeking before the start of the file is an
+	// error and leaves the offset unchanged
+	for {
+		cur := atomic.LoadInt64(&f.offset)
+
+		var ret int64
+		switch whence {
+		case io.SeekStart:
+			ret = offset
+		case io.SeekCurrent:
+			ret = cur + offset
+		case io.SeekEnd:
+			ret = atomic.LoadInt64(&f.node.Size) + offset
+		default:
 			return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
 		}
-
-		atomic.StoreInt64(&f.offset, offset)
-		ret = offset
-	case io.SeekCurrent:
-		if offset < 0 && (atomic.LoadInt64(&f.node.Size)+offset) < 0 {
+		if ret < 0 {
 			return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
 		}
 
-		ret = atomic.AddInt64(&f.offset, offset)
-	case io.SeekEnd:
-		ret = atomic.LoadInt64(&f.node.Size) + offset
-		atomic.StoreInt64(&f.offset, ret)
+		if atomic.CompareAndSwapInt64(&f.offset, cur, ret) {
+			return ret, nil
+		}
 	}
-
-	return ret, nil
 }
 
+// Sync re-seals the file's contents under a newly generated key, wiping
+// the transient plaintext afterwards. This allows callers to force key
+// rotation at checkpoints of their choosing.
 func (f *file) Sync() error {
 	if f.node == nil {
 		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
 	}
-	if f.flags&_O_ACCESS == os.O_RDONLY {
+	if f.node.IsDir() {
 		return nil
 	}
 
-	f.fs.mtx.Lock()
-	f.fs.data[int(f.node.Ino)] = f.data
-	f.fs.mtx.Unlock()
+	if err := f.data.reseal(); err != nil {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: err}
+	}
 
 	return nil
 }
 
+// SetDeadline sets the read and write deadlines of the file. The VFS
+// has no files that reads or writes can block on, so like os.File with
+// a regular file, it always fails with os.ErrNoDeadline.
+func (f *file) SetDeadline(t time.Time) error {
+	return f.setDeadline("SetDeadline")
+}
+
+// SetReadDeadline sets the read deadline of the file. It always fails
+// with os.ErrNoDeadline, as reads never block.
+func (f *file) SetReadDeadline(t time.Time) error {
+	return f.setDeadline("SetReadDeadline")
+}
+
+// SetWriteDeadline sets the write deadline of the file. It always fails
+// with os.ErrNoDeadline, as writes never block.
+func (f *file) SetWriteDeadline(t time.Time) error {
+	return f.setDeadline("SetWriteDeadline")
+}
+
+func (f *file) setDeadline(op string) error {
+	if f.node == nil {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return &fs.PathError{Op: op, Path: f.name, Err: os.ErrNoDeadline}
+}
+
 func (f *file) Truncate(size int64) error {
 	if f.node == nil {
 		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrClosed}
 	}
-	if f.flags&_O_ACCESS == os.O_RDONLY {
-		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
-	}
 	if f.node.IsDir() {
 		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EISDIR}
 	}
-
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-
-	var (
-		err       error
-		plaintext []byte
-	)
-
-	if f.node.Size != 0 {
-		key, err := f.data.key.Open()
-		if err != nil {
-			return err
-		}
-		plaintext = make([]byte, f.node.Size)
-		_, err = core.Decrypt(f.data.ciphertext, key.Bytes(), plaintext)
-		if err != nil {
-			return err
-		}
-		key.Destroy()
-	} else if size == 0 { // data is already nil, no-op
-		return nil
-	}
-
-	// TODO: should this be copied in constant time?
-	if size <= f.node.Size {
-		plaintext = plaintext[:int(size)]
-		newKey := memguard.NewBufferFromBytes(fastrand.Bytes(keySize))
-		f.data.ciphertext, err = core.Encrypt(plaintext, newKey.Bytes())
-		f.data.key = newKey.Seal()
-		core.Wipe(plaintext)
-		f.updateSize()
-		if err != nil {
-			return err
-		}
-		return nil
+	if f.flags&_O_ACCESS == os.O_RDONLY || f.node.IsImmutable() {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
 	}
 
-	data := make([]byte, int(size))
-	core.Move(data, plaintext)
-
-	newKey := memguard.NewBufferFromBytes(fastrand.Bytes(keySize))
-	f.data.ciphertext, err = core.Encrypt(data, newKey.Bytes())
-	f.data.key = newKey.Seal()
-	core.Wipe(data)
+	err := f.data.truncate(size)
 	f.updateSize()
 	if err != nil {
-		return err
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: err}
 	}
+	f.fs.notify(Write, f.path)
 
 	return nil
 }
 
 func (f *file) Close() error {
-	if err := f.Sync(); err != nil {
-		return err
-	}
 	f.mtx.Lock()
+	node := f.node
 	f.node = nil
 	f.mtx.Unlock()
 
+	if node == nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.fs.flocks.release(node, f)
+	if f.data != nil && !node.IsDir() {
+		f.data.close()
+	}
+
 	return nil
 }
 
@@ -430,6 +1148,38 @@ func (d *DirEntry) Info() (fs.FileInfo, error) {
 	return &FileInfo{name: d.name, node: d.node}, nil
 }
 
+// WalkError is yielded by All in place of a directory entry when the
+// tree cannot be walked. It implements fs.DirEntry so that it can be
+// yielded in-band, but describes no file.
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+func (e *WalkError) Error() string {
+	return "walk " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WalkError) Name() string {
+	return filepath.Base(e.Path)
+}
+
+func (e *WalkError) IsDir() bool {
+	return false
+}
+
+func (e *WalkError) Type() fs.FileMode {
+	return fs.ModeIrregular
+}
+
+func (e *WalkError) Info() (fs.FileInfo, error) {
+	return nil, e.Err
+}
+
 type FileInfo struct {
 	name string
 	node *inode.Inode
@@ -440,7 +1190,7 @@ func (i *FileInfo) Name() string {
 }
 
 func (i *FileInfo) Size() int64 {
-	return i.node.Size
+	return atomic.LoadInt64(&i.node.Size)
 }
 
 func (i *FileInfo) Mode() os.FileMode {
@@ -451,6 +1201,17 @@ func (i *FileInfo) ModTime() time.Time {
 	return i.node.Mtime
 }
 
+// AccessTime returns the time the file was last accessed.
+func (i *FileInfo) AccessTime() time.Time {
+	return i.node.Atime
+}
+
+// CreationTime returns the time the file was created, unless it has
+// been changed with SetTimes.
+func (i *FileInfo) CreationTime() time.Time {
+	return i.node.Ctime
+}
+
 func (i *FileInfo) IsDir() bool {
 	return i.node.IsDir()
 }
@@ -458,3 +1219,69 @@ func (i *FileInfo) IsDir() bool {
 func (i *FileInfo) Sys() interface{} {
 	return i.node
 }
+
+// Snapshot returns a copy of the information i currently describes. A
+// FileInfo reflects later changes to its file, such as writes changing
+// its size, while the returned fs.FileInfo never changes and is safe to
+// retain. Its Sys method still returns the inode of the file.
+func (i *FileInfo) Snapshot() fs.FileInfo {
+	i.node.RLock()
+	defer i.node.RUnlock()
+
+	return &fileInfoSnapshot{
+		name:  i.name,
+		size:  atomic.LoadInt64(&i.node.Size),
+		mode:  i.node.Mode,
+		mtime: i.node.Mtime,
+		atime: i.node.Atime,
+		ctime: i.node.Ctime,
+		node:  i.node,
+	}
+}
+
+// fileInfoSnapshot is a FileInfo whose values are copied from an inode
+// when it is created.
+type fileInfoSnapshot struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	atime time.Time
+	ctime time.Time
+	node  *inode.Inode
+}
+
+func (i *fileInfoSnapshot) Name() string {
+	return i.name
+}
+
+func (i *fileInfoSnapshot) Size() int64 {
+	return i.size
+}
+
+func (i *fileInfoSnapshot) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i *fileInfoSnapshot) ModTime() time.Time {
+	return i.mtime
+}
+
+// AccessTime returns the time the file was last accessed before the
+// snapshot was taken.
+func (i *fileInfoSnapshot) AccessTime() time.Time {
+	return i.atime
+}
+
+// CreationTime returns the time the file was created.
+func (i *fileInfoSnapshot) CreationTime() time.Time {
+	return i.ctime
+}
+
+func (i *fileInfoSnapshot) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i *fileInfoSnapshot) Sys() interface{} {
+	return i.node
+}
@@ -0,0 +1,108 @@
+// Package vfstest implements support for testing the state of
+// filesystems.
+package vfstest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/capnspacehook/pandorasbox/absfs"
+)
+
+// A ManifestEntry describes what a single file in a filesystem is
+// expected to be.
+type ManifestEntry struct {
+	Size int64       // size of the file, not checked for directories
+	Mode fs.FileMode // file mode, including type bits
+	Hash string      // Hash of the contents, only checked for regular files
+}
+
+// Hash returns the hash of data that a ManifestEntry expects the contents
+// of a regular file to have: its SHA-256 sum in hex.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AssertManifest walks fsys from its root and reports an error through t
+// for every file that doesn't match its entry in manifest, and for every
+// path that is only in one of them. Like an fstest.MapFS, manifest maps
+// slash separated paths relative to the root, such as "dir/file", to
+// entries, and the root itself is not included. Symbolic links are not
+// followed.
+func AssertManifest(t testing.TB, fsys absfs.FileSystem, manifest map[string]ManifestEntry) {
+	t.Helper()
+
+	seen := make(map[string]bool, len(manifest))
+	var walk func(dir string)
+	walk = func(dir string) {
+		t.Helper()
+
+		entries, err := fsys.ReadDir(path.Join("/", dir))
+		if err != nil {
+			t.Errorf("reading directory %q: %v", dir, err)
+			return
+		}
+		for _, e := range entries {
+			name := path.Join(dir, e.Name())
+			seen[name] = true
+
+			fi, err := fsys.Lstat("/" + name)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			want, ok := manifest[name]
+			if !ok {
+				t.Errorf("%s: not in manifest", name)
+			} else {
+				checkEntry(t, fsys, name, fi, want)
+			}
+			if fi.IsDir() {
+				walk(name)
+			}
+		}
+	}
+	walk("")
+
+	var missing []string
+	for name := range manifest {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		t.Errorf("%s: does not exist", name)
+	}
+}
+
+func checkEntry(t testing.TB, fsys absfs.FileSystem, name string, fi fs.FileInfo, want ManifestEntry) {
+	t.Helper()
+
+	if fi.Mode() != want.Mode {
+		t.Errorf("%s: mode = %v, want %v", name, fi.Mode(), want.Mode)
+	}
+	if fi.IsDir() {
+		return
+	}
+	if fi.Size() != want.Size {
+		t.Errorf("%s: size = %d, want %d", name, fi.Size(), want.Size)
+	}
+	if !fi.Mode().IsRegular() {
+		return
+	}
+
+	data, err := fsys.ReadFile("/" + name)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if hash := Hash(data); hash != want.Hash {
+		t.Errorf("%s: hash = %s, want %s", name, hash, want.Hash)
+	}
+}
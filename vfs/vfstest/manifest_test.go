@@ -0,0 +1,58 @@
+package vfstest_test
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/capnspacehook/pandorasbox/vfs"
+	"github.com/capnspacehook/pandorasbox/vfs/vfstest"
+)
+
+// recorder records the errors reported to it instead of failing.
+type recorder struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func TestAssertManifest(t *testing.T) {
+	fsys, err := vfs.FromMap(map[string]vfs.MapFile{
+		"dir/file": {Data: []byte("contents"), Mode: 0644},
+		"extra":    {Mode: 0600},
+		"link":     {Data: []byte("dir/file"), Mode: fs.ModeSymlink | 0777},
+	})
+	if err != nil {
+		t.Fatalf("FromMap error: %s", err)
+	}
+
+	manifest := map[string]vfstest.ManifestEntry{
+		"dir":      {Mode: fs.ModeDir | 0755},
+		"dir/file": {Size: 8, Mode: 0644, Hash: vfstest.Hash([]byte("contents"))},
+		"extra":    {Mode: 0600, Hash: vfstest.Hash(nil)},
+		"link":     {Size: 8, Mode: fs.ModeSymlink | 0777},
+	}
+	vfstest.AssertManifest(t, fsys, manifest)
+
+	manifest["dir/file"] = vfstest.ManifestEntry{Size: 9, Mode: 0600, Hash: vfstest.Hash([]byte("content"))}
+	manifest["missing"] = vfstest.ManifestEntry{Mode: 0644}
+	delete(manifest, "extra")
+
+	r := &recorder{TB: t}
+	vfstest.AssertManifest(r, fsys, manifest)
+	want := []string{
+		"dir/file: mode = -rw-r--r--, want -rw-------",
+		"dir/file: size = 8, want 9",
+		fmt.Sprintf("dir/file: hash = %s, want %s", vfstest.Hash([]byte("contents")), vfstest.Hash([]byte("content"))),
+		"extra: not in manifest",
+		"missing: does not exist",
+	}
+	if fmt.Sprint(r.errs) != fmt.Sprint(want) {
+		t.Errorf("reported errors:\n%q\nwant:\n%q", r.errs, want)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"os"
 	pathpkg "path"
+	"slices"
 	"testing"
 )
 
@@ -127,3 +128,52 @@ func TestWalkDir(t *testing.T) {
 	}
 	checkMarks(t, true)
 }
+
+func TestWalkDirOrder(t *testing.T) {
+	vfs := NewFS().(*pbFS)
+	// created out of lexical order
+	for _, f := range []struct {
+		name string
+		dir  bool
+	}{
+		{"/b", true}, {"/b/z", false}, {"/a", true}, {"/B", true},
+		{"/b/_", false}, {"/a.txt", false}, {"/b/y", true}, {"/a/c", false},
+	} {
+		var err error
+		if f.dir {
+			err = vfs.Mkdir(f.name, 0755)
+		} else {
+			err = vfs.WriteFile(f.name, nil, 0644)
+		}
+		if err != nil {
+			t.Fatalf("error creating %s: %v", f.name, err)
+		}
+	}
+	want := []string{".", "B", "a", "a/c", "a.txt", "b", "b/_", "b/y", "b/z"}
+
+	var got []string
+	err := vfs.WalkDir("/", func(path string, _ fs.DirEntry, err error) error {
+		got = append(got, path)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WalkDir error: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("WalkDir visited %q, want %q", got, want)
+	}
+
+	// hide ReadDir of the io/fs view so the ReadDir method of each
+	// directory is used instead
+	got = nil
+	err = fs.WalkDir(struct{ fs.FS }{vfs.FS()}, ".", func(path string, _ fs.DirEntry, err error) error {
+		got = append(got, path)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("fs.WalkDir error: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("fs.WalkDir using directory ReadDir visited %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,60 @@
+package vfs
+
+import "sync"
+
+// watchBuffer is the number of events a channel returned by Watch can
+// hold before events are dropped.
+const watchBuffer = 256
+
+// watchers holds the channels returned by Watch. It has its own lock so
+// that events can be sent whether or not fs.mtx is held.
+type watchers struct {
+	mtx   sync.Mutex
+	chans map[chan Event]struct{}
+}
+
+// Watch returns a channel that receives an Event for every file or
+// directory that is created, written to, truncated, removed or renamed
+// in the VFS from then on, and a function that stops sending events and
+// closes the channel. A rename is reported as a Rename event for the old
+// path followed by a Create event for the new one. Events are sent
+// without blocking, as they may be sent while the VFS is locked, so they
+// are dropped if the receiver falls too far behind.
+func (fs *pbFS) Watch() (<-chan Event, func()) {
+	ch := make(chan Event, watchBuffer)
+
+	w := fs.watchers
+	w.mtx.Lock()
+	if w.chans == nil {
+		w.chans = make(map[chan Event]struct{})
+	}
+	w.chans[ch] = struct{}{}
+	w.mtx.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			w.mtx.Lock()
+			delete(w.chans, ch)
+			close(ch)
+			w.mtx.Unlock()
+		})
+	}
+
+	return ch, cancel
+}
+
+// notify sends an event for the file at the absolute path name to every
+// watcher that has room for it.
+func (fs *pbFS) notify(op Op, name string) {
+	w := fs.watchers
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for ch := range w.chans {
+		select {
+		case ch <- Event{Name: name, Op: op}:
+		default:
+		}
+	}
+}
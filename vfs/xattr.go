@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	stdfs "io/fs"
+	"syscall"
+)
+
+// Setxattr sets the extended attribute key of the named file to value,
+// which is copied. Extended attributes belong to the inode of the file,
+// so they are kept across renames and shared by hard links. Unlike file
+// contents, they are held in ordinary memory and are not encrypted.
+func (fs *pbFS) Setxattr(name, key string, value []byte) error {
+	node, err := fs.lookup("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return &stdfs.PathError{Op: "setxattr", Path: name, Err: syscall.EINVAL}
+	}
+	if node.IsImmutable() {
+		return &stdfs.PathError{Op: "setxattr", Path: name, Err: stdfs.ErrPermission}
+	}
+	node.Setxattr(key, value)
+
+	return nil
+}
+
+// Getxattr returns the value of the extended attribute key of the named
+// file. If it isn't set, the error is ENODATA.
+func (fs *pbFS) Getxattr(name, key string) ([]byte, error) {
+	node, err := fs.lookup("getxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := node.Getxattr(key)
+	if !ok {
+		return nil, &stdfs.PathError{Op: "getxattr", Path: name, Err: syscall.ENODATA}
+	}
+
+	return value, nil
+}
+
+// Listxattr returns the sorted names of the extended attributes of the
+// named file.
+func (fs *pbFS) Listxattr(name string) ([]string, error) {
+	node, err := fs.lookup("listxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.Listxattr(), nil
+}
+
+// Removexattr removes the extended attribute key of the named file. If
+// it isn't set, the error is ENODATA.
+func (fs *pbFS) Removexattr(name, key string) error {
+	node, err := fs.lookup("removexattr", name, true)
+	if err != nil {
+		return err
+	}
+	if node.IsImmutable() {
+		return &stdfs.PathError{Op: "removexattr", Path: name, Err: stdfs.ErrPermission}
+	}
+	if !node.Removexattr(key) {
+		return &stdfs.PathError{Op: "removexattr", Path: name, Err: syscall.ENODATA}
+	}
+
+	return nil
+}
+
+// copyXattrs returns a deep copy of the extended attributes xattrs.
+func copyXattrs(xattrs map[string][]byte) map[string][]byte {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	c := make(map[string][]byte, len(xattrs))
+	for key, value := range xattrs {
+		c[key] = append([]byte(nil), value...)
+	}
+
+	return c
+}